@@ -1,15 +1,16 @@
 import { useEffect, useState } from 'react';
 import { useParams, Link } from 'react-router-dom';
-import { API, Photo } from './api';
+import { API, Exif, Photo, displaySrc, displaySrcSet, isVideo } from './api';
+import { placeholderStyle } from './blurhash';
 import { Map, Marker } from 'pigeon-maps';
 
 export function DetailView() {
     const { date } = useParams<{ date: string }>();
     const [photo, setPhoto] = useState<Photo | null>(null);
-    const [exif, setExif] = useState<Record<string, string>>({});
 
     const [prevDay, setPrevDay] = useState<string | null>(null);
     const [nextDay, setNextDay] = useState<string | null>(null);
+    const [playLive, setPlayLive] = useState(false);
 
     useEffect(() => {
         if (!date) return;
@@ -17,9 +18,6 @@ export function DetailView() {
             const idx = photos.findIndex(p => p.Day === date);
             if (idx >= 0) {
                 setPhoto(photos[idx]);
-                try {
-                    setExif(JSON.parse(photos[idx].ExifData || '{}'));
-                } catch { setExif({}) }
 
                 // List is DESC (Newest first)
                 // Next (Newer) is idx - 1
@@ -31,20 +29,12 @@ export function DetailView() {
                 else setPrevDay(null);
             }
         });
+        setPlayLive(false);
     }, [date]);
 
     if (!photo) return <div style={{ padding: 20 }}>Loading or not found... <Link to="/">Back</Link></div>;
 
-    // Filter interesting EXIF
-    const exifKeys = [
-        { label: 'Camera', key: 'Model' },
-        { label: 'Lens', key: 'LensModel' },
-        { label: 'F-Stop', key: 'FNumber' },
-        { label: 'ISO', key: 'ISOSpeedRatings' },
-        { label: 'Shutter', key: 'ExposureTime' },
-        { label: 'Date', key: 'DateTimeOriginal' },
-    ];
-
+    const exifRows = formatExif(photo.Exif || {});
     const hasCoords = photo.Lat !== 0 || photo.Lon !== 0;
 
     return (
@@ -73,12 +63,37 @@ export function DetailView() {
 
             {/* Main Image */}
             <div style={{ padding: 20, display: 'flex', justifyContent: 'center', background: 'var(--card-bg)' }}>
-                <img
-                    src={photo.Filepath}
-                    alt={photo.Day}
-                    style={{ maxHeight: '60vh', maxWidth: '100%', objectFit: 'contain' }}
-                />
+                {isVideo(photo) || playLive ? (
+                    <video
+                        src={photo.LiveVideo && !isVideo(photo) ? photo.LiveVideo : photo.Filepath}
+                        poster={photo.Renditions?.length ? displaySrc(photo) : undefined}
+                        controls={isVideo(photo)}
+                        autoPlay={playLive}
+                        playsInline
+                        onEnded={() => setPlayLive(false)}
+                        width={photo.Width || undefined}
+                        height={photo.Height || undefined}
+                        style={{ maxHeight: '60vh', maxWidth: '100%', width: 'auto', height: 'auto', ...placeholderStyle(photo) }}
+                    />
+                ) : (
+                    <img
+                        src={displaySrc(photo)}
+                        srcSet={displaySrcSet(photo)}
+                        sizes="(min-width: 1100px) 1060px, 100vw"
+                        alt={photo.Day}
+                        width={photo.Width || undefined}
+                        height={photo.Height || undefined}
+                        style={{ maxHeight: '60vh', maxWidth: '100%', width: 'auto', height: 'auto', objectFit: 'contain', ...placeholderStyle(photo) }}
+                    />
+                )}
             </div>
+            {photo.LiveVideo && !isVideo(photo) && (
+                <div style={{ display: 'flex', justifyContent: 'center', background: 'var(--card-bg)', paddingBottom: 10 }}>
+                    <button onClick={() => setPlayLive(!playLive)} style={{ background: 'none', border: '1px solid var(--border-color)', color: 'var(--text-color)', borderRadius: 4, padding: '4px 12px', cursor: 'pointer' }}>
+                        {playLive ? 'Stop' : '▶ Live'}
+                    </button>
+                </div>
+            )}
 
             <div style={{ padding: 20, display: 'flex', flexWrap: 'wrap', gap: 20 }}>
                 {/* Notes */}
@@ -93,16 +108,36 @@ export function DetailView() {
                 <div style={{ flex: '1 1 200px' }}>
                     <h3 style={{ borderBottom: '1px solid var(--border-color)', paddingBottom: 5, marginTop: 0 }}>Details</h3>
                     <div style={{ display: 'grid', gridTemplateColumns: 'auto 1fr', gap: '8px 15px', fontSize: 14 }}>
-                        {exifKeys.map(({ label, key }) => {
-                            const val = exif[key];
-                            if (!val) return null;
-                            return (
-                                <div key={key} style={{ display: 'contents' }}>
-                                    <div style={{ color: 'var(--text-muted)' }}>{label}</div>
-                                    <div style={{ color: 'var(--text-color)' }}>{cleanExifVal(val)}</div>
+                        {photo.Format && (
+                            <div style={{ display: 'contents' }}>
+                                <div style={{ color: 'var(--text-muted)' }}>File type</div>
+                                <div style={{ color: 'var(--text-color)' }}>
+                                    <a href={photo.Filepath} download style={{ color: 'var(--text-color)' }}>{photo.Format.toUpperCase()}</a>
                                 </div>
-                            );
-                        })}
+                            </div>
+                        )}
+                        {photo.Duration !== undefined && (
+                            <div style={{ display: 'contents' }}>
+                                <div style={{ color: 'var(--text-muted)' }}>Duration</div>
+                                <div style={{ color: 'var(--text-color)' }}>{formatDuration(photo.Duration)}</div>
+                            </div>
+                        )}
+                        {photo.Palette && photo.Palette.length > 0 && (
+                            <div style={{ display: 'contents' }}>
+                                <div style={{ color: 'var(--text-muted)' }}>Palette</div>
+                                <div style={{ display: 'flex', height: 18, borderRadius: 4, overflow: 'hidden', maxWidth: 200 }}>
+                                    {photo.Palette.map(c => (
+                                        <div key={c.Color} title={c.Color} style={{ flex: c.Weight, background: c.Color }} />
+                                    ))}
+                                </div>
+                            </div>
+                        )}
+                        {exifRows.map(([label, val]) => (
+                            <div key={label} style={{ display: 'contents' }}>
+                                <div style={{ color: 'var(--text-muted)' }}>{label}</div>
+                                <div style={{ color: 'var(--text-color)' }}>{val}</div>
+                            </div>
+                        ))}
                     </div>
                 </div>
 
@@ -119,10 +154,36 @@ export function DetailView() {
     );
 }
 
-// Clean up some raw EXIF values (like arrays/quotes)
-function cleanExifVal(val: string): string {
-    if (val.startsWith('"') && val.endsWith('"')) {
-        return val.slice(1, -1);
+// Label/value rows for the camera fields that were recorded
+function formatExif(e: Exif): [string, string][] {
+    const rows: [string, string][] = [];
+    const camera = e.Model && e.Make && !e.Model.toLowerCase().startsWith(e.Make.toLowerCase())
+        ? `${e.Make} ${e.Model}` : e.Model || e.Make;
+    if (camera) rows.push(['Camera', camera]);
+    if (e.Lens) rows.push(['Lens', e.Lens]);
+    if (e.FocalLength) {
+        const eq = e.FocalLength35 && e.FocalLength35 !== Math.round(e.FocalLength) ? ` (${e.FocalLength35} mm equiv.)` : '';
+        rows.push(['Focal length', `${round(e.FocalLength)} mm${eq}`]);
+    }
+    if (e.Aperture) rows.push(['F-Stop', `f/${round(e.Aperture)}`]);
+    if (e.ExposureTime) {
+        const t = e.ExposureTime;
+        rows.push(['Shutter', t < 1 ? `1/${Math.round(1 / t)} s` : `${round(t)} s`]);
     }
-    return val;
+    if (e.ISO) rows.push(['ISO', String(e.ISO)]);
+    if (e.ExposureBias !== undefined) rows.push(['Exposure', `${e.ExposureBias > 0 ? '+' : ''}${round(e.ExposureBias)} EV`]);
+    if (e.Flash !== undefined) rows.push(['Flash', e.Flash ? 'Fired' : 'Off']);
+    if (e.TakenAt) rows.push(['Taken', e.TakenAt.replace('T', ' ')]);
+    if (e.GPSAltitude !== undefined) rows.push(['Altitude', `${Math.round(e.GPSAltitude)} m`]);
+    if (e.GPSDirection !== undefined) rows.push(['Direction', `${Math.round(e.GPSDirection)}°`]);
+    return rows;
+}
+
+function formatDuration(s: number): string {
+    if (s < 60) return `${round(s)} s`;
+    return `${Math.floor(s / 60)}:${String(Math.round(s % 60)).padStart(2, '0')}`;
+}
+
+function round(v: number): number {
+    return Math.round(v * 10) / 10;
 }
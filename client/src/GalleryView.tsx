@@ -1,6 +1,7 @@
 import { useEffect, useState } from 'react';
-import { API, Photo } from './api';
+import { API, Photo, isVideo } from './api';
 import { Link } from 'react-router-dom';
+import { placeholderStyle } from './blurhash';
 
 export function GalleryView() {
     const [photos, setPhotos] = useState<Photo[]>([]);
@@ -113,12 +114,28 @@ function MonthSection({ month, photos }: { month: string, photos: Photo[] }) {
                 {days.map(d => (
                     <div key={d.dayStr} style={{ aspectRatio: '1', position: 'relative', background: 'var(--card-bg)', borderRadius: 4, overflow: 'hidden' }}>
                         {d.photo ? (
-                            <Link to={`/day/${d.photo.Day}`} style={{ display: 'block', width: '100%', height: '100%' }}>
-                                <img
-                                    src={d.photo.ThumbnailPath || d.photo.Filepath}
-                                    alt={d.photo.Day}
-                                    style={{ width: '100%', height: '100%', objectFit: 'cover' }}
-                                />
+                            <Link to={`/day/${d.photo.Day}`} style={{ display: 'block', width: '100%', height: '100%', ...placeholderStyle(d.photo) }}>
+                                {d.photo.ThumbnailPath ? (
+                                    <img
+                                        src={d.photo.ThumbnailPath}
+                                        alt={d.photo.Day}
+                                        loading="lazy"
+                                        style={{ width: '100%', height: '100%', objectFit: 'cover' }}
+                                    />
+                                ) : (
+                                    <div style={{ display: 'flex', alignItems: 'center', justifyContent: 'center', height: '100%', fontSize: 10, color: 'var(--text-muted)' }}>
+                                        {d.photo.Status === 'failed' ? 'Failed' : d.photo.Status === 'processing' ? 'Processing…' : isVideo(d.photo) ? 'Video' : ''}
+                                    </div>
+                                )}
+                                {(isVideo(d.photo) || d.photo.LiveVideo) && (
+                                    <div style={{
+                                        position: 'absolute', bottom: 2, left: 2,
+                                        fontSize: 10, color: '#fff',
+                                        textShadow: '0 1px 2px rgba(0,0,0,0.8)'
+                                    }}>
+                                        {isVideo(d.photo) ? '▶' : 'LIVE'}
+                                    </div>
+                                )}
                             </Link>
                         ) : (
                             <div style={{ opacity: 0.1, display: 'flex', alignItems: 'center', justifyContent: 'center', height: '100%' }}>
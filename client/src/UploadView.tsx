@@ -1,21 +1,50 @@
-import { useState } from 'react';
-import { API } from './api';
+import { useEffect, useState } from 'react';
+import { API, DayConflictError, DayPolicy, Settings } from './api';
+
+const timezones: string[] = (Intl as any).supportedValuesOf?.('timeZone') ?? [];
 
 export function UploadView() {
     const [file, setFile] = useState<File | null>(null);
-    const [day, setDay] = useState(new Date().toISOString().split('T')[0]);
+    const [live, setLive] = useState<File | null>(null);
+    // Empty lets the server pick: the photo's capture date, else today in the user's time zone
+    const [day, setDay] = useState('');
     const [notes, setNotes] = useState('');
     const [status, setStatus] = useState('');
+    const [settings, setSettings] = useState<Settings | null>(null);
+    const [conflict, setConflict] = useState<DayConflictError | null>(null);
+
+    useEffect(() => {
+        API.getSettings().then(setSettings).catch(() => setSettings(null));
+    }, []);
+
+    const changeSettings = async (change: Partial<Settings>) => {
+        if (!settings) return;
+        try {
+            setSettings(await API.putSettings({ ...settings, ...change }));
+        } catch (e: any) {
+            setStatus('Error: ' + e.message);
+        }
+    };
 
-    const handleUpload = async () => {
+    const handleUpload = async (dayPolicy?: DayPolicy) => {
         if (!file) return;
+        setConflict(null);
         try {
             setStatus('Uploading...');
-            await API.uploadPhoto(file, day, notes);
-            setStatus('Uploaded!');
+            const result = await API.uploadPhoto(file, day, notes, dayPolicy, live || undefined);
+            const moved = result.DaySource === 'exif' && result.RequestedDay ? ` (the photo's date, not ${result.RequestedDay})` : '';
+            setStatus(result.Duplicate
+                ? `Uploaded to ${result.Day}${moved}! (same file as ${result.Duplicate.Day})`
+                : `Uploaded to ${result.Day}${moved}! Previews appear once processing finishes.`);
             setFile(null);
+            setLive(null);
             setNotes('');
         } catch (e: any) {
+            if (e instanceof DayConflictError) {
+                setConflict(e);
+                setStatus(`This photo was taken on ${e.detectedDay}, not ${e.requestedDay}.`);
+                return;
+            }
             setStatus('Error: ' + e.message);
         }
     };
@@ -24,8 +53,17 @@ export function UploadView() {
         <div style={{ padding: 20, maxWidth: 600, margin: '0 auto' }}>
             <h2>Upload Photo</h2>
             <div style={{ display: 'flex', flexDirection: 'column', gap: 15 }}>
-                <input type="date" value={day} onChange={e => setDay(e.target.value)} style={inputStyle} />
-                <input type="file" accept="image/*" onChange={e => setFile(e.target.files?.[0] || null)} style={inputStyle} />
+                <label style={labelStyle}>
+                    Day (leave empty to use the date the photo was taken)
+                    <input type="date" value={day} onChange={e => setDay(e.target.value)} style={inputStyle} />
+                </label>
+                <input type="file" accept="image/*,video/mp4,video/quicktime,.heic,.heif,.dng,.cr2,.cr3,.nef,.arw,.pef,.mp4,.mov" onChange={e => setFile(e.target.files?.[0] || null)} style={inputStyle} />
+                {file && !file.type.startsWith('video/') && (
+                    <label style={labelStyle}>
+                        Live Photo video (optional)
+                        <input type="file" accept="video/mp4,video/quicktime,.mp4,.mov" onChange={e => setLive(e.target.files?.[0] || null)} style={inputStyle} />
+                    </label>
+                )}
                 <textarea
                     value={notes}
                     onChange={e => setNotes(e.target.value)}
@@ -33,8 +71,33 @@ export function UploadView() {
                     rows={4}
                     style={inputStyle}
                 />
-                <button onClick={handleUpload} style={btnStyle}>Upload</button>
+                <button onClick={() => handleUpload()} style={btnStyle}>Upload</button>
                 {status && <p>{status}</p>}
+                {conflict && (
+                    <div style={{ display: 'flex', gap: 10 }}>
+                        <button onClick={() => handleUpload('client')} style={btnStyle}>Use {conflict.requestedDay}</button>
+                        <button onClick={() => handleUpload('exif')} style={btnStyle}>Use {conflict.detectedDay}</button>
+                    </div>
+                )}
+                {settings && (
+                    <label style={labelStyle}>
+                        Time zone for photos without a date
+                        <select value={settings.Timezone} onChange={e => changeSettings({ Timezone: e.target.value })} style={inputStyle}>
+                            <option value="">Server default ({settings.DefaultTimezone})</option>
+                            {timezones.map(tz => <option key={tz} value={tz}>{tz}</option>)}
+                        </select>
+                    </label>
+                )}
+                {settings && (
+                    <label style={labelStyle}>
+                        When the day above and the photo's date differ
+                        <select value={settings.DayPolicy || 'exif'} onChange={e => changeSettings({ DayPolicy: e.target.value as DayPolicy })} style={inputStyle}>
+                            <option value="exif">Use the photo's date</option>
+                            <option value="client">Use the day above</option>
+                            <option value="reject">Ask me</option>
+                        </select>
+                    </label>
+                )}
             </div>
         </div>
     );
@@ -49,6 +112,14 @@ const inputStyle = {
     fontSize: 16,
 };
 
+const labelStyle = {
+    display: 'flex',
+    flexDirection: 'column' as const,
+    gap: 6,
+    fontSize: 14,
+    color: 'var(--text-muted)',
+};
+
 const btnStyle = {
     padding: 15,
     background: '#eee',
@@ -7,7 +7,110 @@ export interface Photo {
     Lat: number;
     Lon: number;
     Notes: string;
-    ExifData: string;
+    ExifData: string; // raw tag dump, JSON
+    SHA256: string;
+    Format: string; // original's file type, e.g. jpeg, heic, dng, mp4
+    LiveVideo?: string; // a Live Photo's motion clip
+    Duration?: number; // seconds, for videos and Live Photos
+    Status?: 'processing' | 'failed'; // absent once renditions are ready
+    // Placeholder data, zero/empty until processing has finished
+    Width: number;
+    Height: number;
+    BlurHash: string;
+    Color: string; // dominant color, #rrggbb
+    Renditions?: Rendition[];
+    Palette?: PaletteColor[]; // dominant colors, most common first
+    Exif?: Exif;
+}
+
+// Camera metadata in usable units; fields the camera didn't record are absent.
+export interface Exif {
+    Make?: string;
+    Model?: string;
+    Lens?: string;
+    FocalLength?: number; // mm
+    FocalLength35?: number; // 35mm-equivalent mm
+    Aperture?: number; // f-number
+    ExposureTime?: number; // seconds
+    ISO?: number;
+    ExposureBias?: number; // EV
+    Flash?: boolean; // fired
+    TakenAt?: string; // 2006-01-02T15:04:05, plus +07:00 when the offset is known
+    GPSAltitude?: number; // meters above sea level
+    GPSDirection?: number; // degrees
+}
+
+export interface PaletteColor {
+    Color: string; // #rrggbb
+    Weight: number; // share of the photo, 0-1
+}
+
+export interface ColorMatch {
+    Day: string;
+    ID: string;
+    ThumbnailPath: string;
+    Color: string; // the photo's palette color closest to the one searched
+    Weight: number;
+    Distance: number; // ΔE; under ~2.3 is indistinguishable
+}
+
+// A derived image of a photo; the one at ThumbnailPath is the grid thumbnail.
+export interface Rendition {
+    Name: string;
+    URL: string;
+    Width: number;
+    Height: number;
+}
+
+export function isVideo(photo: Photo): boolean {
+    return photo.Format === 'mp4' || photo.Format === 'mov';
+}
+
+// Renditions meant for the viewer: all but a square grid thumbnail, which is
+// cropped. A square photo's display sizes are square as well, so the shape
+// alone can't tell them apart.
+function displayRenditions(photo: Photo): Rendition[] {
+    return (photo.Renditions || []).filter(r => !(r.URL === photo.ThumbnailPath && r.Width === r.Height));
+}
+
+// srcset of a photo's display renditions, falling back to the original.
+export function displaySrcSet(photo: Photo): string | undefined {
+    const sizes = displayRenditions(photo);
+    if (sizes.length === 0) return undefined;
+    return sizes.map(r => `${r.URL} ${r.Width}w`).join(', ');
+}
+
+// Largest display rendition, so originals browsers can't show (HEIC) never load.
+export function displaySrc(photo: Photo): string {
+    const sizes = displayRenditions(photo);
+    return sizes.length > 0 ? sizes[sizes.length - 1].URL : photo.Filepath;
+}
+
+export interface UploadResult {
+    ID: string;
+    Day: string; // the day actually used
+    RequestedDay?: string;
+    DetectedDay?: string; // capture date from EXIF
+    DaySource: 'client' | 'exif' | 'today';
+    SHA256: string;
+    Status?: string;
+    Duplicate?: { ID: string; Day: string };
+}
+
+// Which day wins when the chosen day and the photo's capture date differ
+export type DayPolicy = 'exif' | 'client' | 'reject';
+
+export interface Settings {
+    Timezone: string; // IANA name for the day of photos without a capture date; '' = server's
+    DayPolicy: DayPolicy | ''; // '' = exif
+    DefaultTimezone?: string;
+}
+
+// Thrown by uploadPhoto when the day policy is reject and the days differ.
+export class DayConflictError extends Error {
+    constructor(message: string, public requestedDay: string, public detectedDay: string) {
+        super(message);
+    }
 }
 
 export const API = {
@@ -17,16 +120,49 @@ export const API = {
         return res.json();
     },
 
-    async uploadPhoto(file: File, day: string, notes: string): Promise<void> {
+    async searchColor(hex: string, distance?: number): Promise<ColorMatch[]> {
+        const params = new URLSearchParams({ hex });
+        if (distance !== undefined) params.set('distance', String(distance));
+        const res = await fetch(`/api/photos/color?${params}`);
+        if (!res.ok) throw new Error(await res.text());
+        return res.json();
+    },
+
+    async uploadPhoto(file: File, day: string, notes: string, dayPolicy?: DayPolicy, live?: File): Promise<UploadResult> {
+        // Large files go in resumable chunks; Live Photo pairs need the form
+        if (!live && file.size > RESUMABLE_CHUNK) return uploadResumable(file, day, notes, dayPolicy);
         const formData = new FormData();
         formData.append('photo', file);
-        formData.append('day', day);
+        if (live) formData.append('live', live); // a Live Photo's clip, with the still as photo
+        if (day) formData.append('day', day); // otherwise the photo's own date, or today in the user's time zone
+        if (dayPolicy) formData.append('day_policy', dayPolicy); // otherwise the user's default
         formData.append('notes', notes);
         const res = await fetch('/api/photos', {
             method: 'POST',
             body: formData,
         });
+        if (res.status === 409) {
+            const c = await res.json();
+            throw new DayConflictError(c.Error, c.RequestedDay, c.DetectedDay);
+        }
+        if (!res.ok) throw new Error(await res.text());
+        return res.json();
+    },
+
+    async getSettings(): Promise<Settings> {
+        const res = await fetch('/api/settings');
         if (!res.ok) throw new Error(await res.text());
+        return res.json();
+    },
+
+    async putSettings(settings: Settings): Promise<Settings> {
+        const res = await fetch('/api/settings', {
+            method: 'PUT',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(settings),
+        });
+        if (!res.ok) throw new Error(await res.text());
+        return res.json();
     },
 
     // Auth methods will be added here (WebAuthn is complex, might use a library or raw API)
@@ -108,6 +244,95 @@ export const API = {
     }
 };
 
+// Resumable uploads (tus 1.0.0 at /api/uploads). The upload URL is kept in
+// localStorage, so picking the same file again after a reload or a dropped
+// connection continues where the server got to.
+const RESUMABLE_CHUNK = 5 << 20;
+const RETRY_DELAYS = [1000, 3000, 5000, 10000, 20000];
+const tusHeaders = { 'Tus-Resumable': '1.0.0' };
+
+async function uploadResumable(file: File, day: string, notes: string, dayPolicy?: DayPolicy): Promise<UploadResult> {
+    const key = `upload:${file.name}:${file.size}:${file.lastModified}:${day}`;
+    let url = localStorage.getItem(key);
+    let offset = url ? await uploadOffset(url) : null;
+    if (!url || offset === null) {
+        const meta: Record<string, string> = { filename: file.name, notes };
+        if (day) meta.day = day;
+        if (dayPolicy) meta.day_policy = dayPolicy;
+        const res = await fetch('/api/uploads', {
+            method: 'POST',
+            headers: {
+                ...tusHeaders,
+                'Upload-Length': String(file.size),
+                'Upload-Metadata': Object.entries(meta).map(([k, v]) => `${k} ${base64(v)}`).join(','),
+            },
+        });
+        if (!res.ok) throw new Error(await res.text());
+        url = res.headers.get('Location')!;
+        offset = 0;
+        localStorage.setItem(key, url);
+    }
+
+    for (let failures = 0; ;) {
+        let res: Response | null = null;
+        try {
+            res = await fetch(url, {
+                method: 'PATCH',
+                headers: {
+                    ...tusHeaders,
+                    'Content-Type': 'application/offset+octet-stream',
+                    'Upload-Offset': String(offset),
+                    ...(dayPolicy ? { 'Day-Policy': dayPolicy } : {}),
+                },
+                body: file.slice(offset, offset + RESUMABLE_CHUNK),
+            });
+        } catch (e) {
+            if (failures >= RETRY_DELAYS.length) throw e;
+        }
+        if (res?.status === 204) {
+            offset = Number(res.headers.get('Upload-Offset'));
+            failures = 0;
+            if (offset < file.size) continue;
+            // The last PATCH only names the photo; the upload holds the full response
+            localStorage.removeItem(key);
+            const done = await fetch(url);
+            if (!done.ok) throw new Error(await done.text());
+            return done.json();
+        }
+        // A day conflict keeps the upload; uploading again with a policy finishes it
+        if (res?.status === 409 && res.headers.get('Content-Type')?.startsWith('application/json')) {
+            const c = await res.json();
+            throw new DayConflictError(c.Error, c.RequestedDay, c.DetectedDay);
+        }
+        // Dropped connections, offset mismatches and server errors: wait, then resume from the server's offset
+        if (!res || res.status === 409 || res.status >= 500) {
+            if (failures >= RETRY_DELAYS.length) throw new Error(res ? await res.text() : 'Upload failed');
+            await new Promise(r => setTimeout(r, RETRY_DELAYS[failures++]));
+            const resumed = await uploadOffset(url).catch(() => offset);
+            if (resumed === null) break;
+            offset = resumed;
+            continue;
+        }
+        localStorage.removeItem(key);
+        throw new Error(await res.text());
+    }
+    localStorage.removeItem(key);
+    throw new Error('Upload expired, please try again');
+}
+
+// How much of an upload the server has, or null when it's gone.
+async function uploadOffset(url: string): Promise<number | null> {
+    const res = await fetch(url, { method: 'HEAD', headers: tusHeaders });
+    return res.ok ? Number(res.headers.get('Upload-Offset')) : null;
+}
+
+function base64(s: string): string {
+    const bytes = new TextEncoder().encode(s);
+    let binary = '';
+    bytes.forEach(b => { binary += String.fromCharCode(b); });
+    return btoa(binary);
+}
+
 // Utils
 function base64URLToBuffer(base64URL: string): ArrayBuffer {
     const base64 = base64URL.replace(/-/g, '+').replace(/_/g, '/');
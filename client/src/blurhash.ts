@@ -0,0 +1,94 @@
+import type { CSSProperties } from 'react';
+
+// Minimal BlurHash decoder (https://blurha.sh), rendering to a small data URL
+// the browser scales up smoothly as a placeholder.
+
+const CHARS = '0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~';
+
+function decode83(s: string): number {
+    let v = 0;
+    for (const c of s) v = v * 83 + CHARS.indexOf(c);
+    return v;
+}
+
+function toLinear(c: number): number {
+    const v = c / 255;
+    return v <= 0.04045 ? v / 12.92 : Math.pow((v + 0.055) / 1.055, 2.4);
+}
+
+function toSRGB(v: number): number {
+    v = Math.max(0, Math.min(1, v));
+    return Math.round(v <= 0.0031308 ? v * 12.92 * 255 : (1.055 * Math.pow(v, 1 / 2.4) - 0.055) * 255);
+}
+
+const signPow = (v: number, e: number) => Math.sign(v) * Math.pow(Math.abs(v), e);
+
+const cache = new Map<string, string>();
+
+// blurhashToDataURL decodes hash into a width x height PNG data URL, or
+// undefined when the hash is missing or malformed.
+export function blurhashToDataURL(hash: string | undefined, width = 32, height = 32): string | undefined {
+    if (!hash || hash.length < 6) return undefined;
+    const key = `${hash}:${width}x${height}`;
+    const hit = cache.get(key);
+    if (hit) return hit;
+
+    const size = decode83(hash[0]);
+    const nx = (size % 9) + 1, ny = Math.floor(size / 9) + 1;
+    if (hash.length !== 4 + 2 * nx * ny) return undefined;
+    const maxValue = (decode83(hash[1]) + 1) / 166;
+
+    const colors: number[][] = [];
+    const dc = decode83(hash.slice(2, 6));
+    colors.push([toLinear(dc >> 16), toLinear((dc >> 8) & 255), toLinear(dc & 255)]);
+    for (let i = 1; i < nx * ny; i++) {
+        const v = decode83(hash.slice(4 + i * 2, 6 + i * 2));
+        colors.push([
+            signPow((Math.floor(v / 361) - 9) / 9, 2) * maxValue,
+            signPow((Math.floor(v / 19) % 19 - 9) / 9, 2) * maxValue,
+            signPow((v % 19 - 9) / 9, 2) * maxValue,
+        ]);
+    }
+
+    const canvas = document.createElement('canvas');
+    canvas.width = width;
+    canvas.height = height;
+    const ctx = canvas.getContext('2d');
+    if (!ctx) return undefined;
+    const img = ctx.createImageData(width, height);
+    for (let y = 0; y < height; y++) {
+        for (let x = 0; x < width; x++) {
+            let r = 0, g = 0, b = 0;
+            for (let j = 0; j < ny; j++) {
+                for (let i = 0; i < nx; i++) {
+                    const basis = Math.cos(Math.PI * x * i / width) * Math.cos(Math.PI * y * j / height);
+                    const c = colors[i + j * nx];
+                    r += c[0] * basis;
+                    g += c[1] * basis;
+                    b += c[2] * basis;
+                }
+            }
+            const p = 4 * (x + y * width);
+            img.data[p] = toSRGB(r);
+            img.data[p + 1] = toSRGB(g);
+            img.data[p + 2] = toSRGB(b);
+            img.data[p + 3] = 255;
+        }
+    }
+    ctx.putImageData(img, 0, 0);
+    const url = canvas.toDataURL();
+    cache.set(key, url);
+    return url;
+}
+
+// placeholderStyle paints a photo's dominant color and blurred preview behind
+// its image, so tiles have content before the thumbnail arrives.
+export function placeholderStyle(photo: { BlurHash?: string; Color?: string }): CSSProperties {
+    const url = blurhashToDataURL(photo.BlurHash);
+    return {
+        backgroundColor: photo.Color || undefined,
+        backgroundImage: url ? `url(${url})` : undefined,
+        backgroundSize: 'cover',
+        backgroundPosition: 'center',
+    };
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"m365/internal/blob"
+	"m365/internal/gc"
+	"m365/internal/media"
+	"m365/internal/process"
+	"m365/internal/store"
+)
+
+type issue struct {
+	kind   string
+	path   string
+	detail string
+	photo  *store.Photo
+}
+
+const (
+	issueMissingOriginal     = "missing-original"
+	issueUnreadableOriginal  = "unreadable-original"
+	issueMissingThumbnail    = "missing-thumbnail"
+	issueUnreadableThumbnail = "unreadable-thumbnail"
+	issueThumbnailMismatch   = "thumbnail-mismatch"
+	issueOrphan              = "orphan"
+)
+
+func runCheck(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "regenerate renditions and quarantine orphan files")
+	quarantine := fs.String("quarantine", "quarantine", "local directory --repair moves orphan files to")
+	grace := fs.Duration("grace", gc.DefaultGrace, "only report orphans older than this")
+	fs.Parse(args)
+
+	blobs, err := openBlobs()
+	if err != nil {
+		return err
+	}
+	proc, err := process.FromEnv(db, blobs)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	photos := proc.Photos
+	issues, err := check(ctx, photos, blobs, media.ThumbnailSpec(proc.Specs), *grace)
+	if err != nil {
+		return err
+	}
+
+	for _, is := range issues {
+		day := "-"
+		if is.photo != nil {
+			day = is.photo.Day
+		}
+		fmt.Printf("%-21s %-10s %s", is.kind, day, is.path)
+		if is.detail != "" {
+			fmt.Printf(" (%s)", is.detail)
+		}
+		fmt.Println()
+	}
+	if len(issues) == 0 {
+		fmt.Println("no issues found")
+		return nil
+	}
+	if !*repair {
+		return fmt.Errorf("%d issue(s) found", len(issues))
+	}
+
+	unresolved := 0
+	for _, is := range issues {
+		var err error
+		switch is.kind {
+		case issueMissingThumbnail, issueUnreadableThumbnail, issueThumbnailMismatch:
+			// The same path as reprocess: all renditions and the thumbnail pointer
+			if err = proc.Process(ctx, is.photo.ID); err == nil {
+				fmt.Printf("regenerated renditions of %s\n", is.photo.ID)
+			}
+		case issueOrphan:
+			var dst string
+			dst, err = quarantineBlob(ctx, blobs, is.path, *quarantine)
+			if err == nil {
+				fmt.Printf("quarantined %s -> %s\n", is.path, dst)
+			}
+		default:
+			err = errors.New("cannot be repaired automatically")
+		}
+		if err != nil {
+			unresolved++
+			fmt.Printf("unresolved %s %s: %v\n", is.kind, is.path, err)
+		}
+	}
+	if unresolved > 0 {
+		return fmt.Errorf("%d of %d issue(s) unresolved", unresolved, len(issues))
+	}
+	return nil
+}
+
+// check reports problems with each photo's media and files no photo uses.
+// Files newer than grace aren't orphans yet: an upload writes its original
+// before the row, and a running job writes renditions before saving them.
+func check(ctx context.Context, photos *store.PhotoStore, blobs blob.Store, thumbSpec media.RenditionSpec, grace time.Duration) ([]issue, error) {
+	all, err := photos.All()
+	if err != nil {
+		return nil, err
+	}
+
+	var issues []issue
+	referenced := map[string]bool{}
+	// Renditions are only referenced from their own table
+	urls, err := photos.MediaURLs()
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range urls {
+		referenced[blob.KeyFromURL(u)] = true
+	}
+
+	for i := range all {
+		p := &all[i]
+
+		orig := blob.KeyFromURL(p.Filepath)
+		referenced[orig] = true
+		originalOK := false
+		if _, err := decodeConfig(ctx, blobs, orig); errors.Is(err, blob.ErrNotFound) {
+			issues = append(issues, issue{kind: issueMissingOriginal, path: orig, photo: p})
+		} else if err != nil {
+			issues = append(issues, issue{kind: issueUnreadableOriginal, path: orig, detail: err.Error(), photo: p})
+		} else {
+			originalOK = true
+		}
+		if p.LiveVideo != "" {
+			live := blob.KeyFromURL(p.LiveVideo)
+			referenced[live] = true
+			if _, err := decodeConfig(ctx, blobs, live); errors.Is(err, blob.ErrNotFound) {
+				issues = append(issues, issue{kind: issueMissingOriginal, path: live, photo: p})
+			} else if err != nil {
+				issues = append(issues, issue{kind: issueUnreadableOriginal, path: live, detail: err.Error(), photo: p})
+			}
+		}
+
+		// Renditions of queued uploads don't exist yet
+		if p.Status == store.StatusProcessing {
+			continue
+		}
+		if p.ThumbnailPath == "" {
+			// Clips only get renditions when a poster frame could be made
+			if media.Format(p.Format).IsVideo() {
+				continue
+			}
+			issues = append(issues, issue{kind: issueMissingThumbnail, path: "(none)", photo: p})
+			continue
+		}
+		thumb := blob.KeyFromURL(p.ThumbnailPath)
+		referenced[thumb] = true
+		cfg, err := decodeConfig(ctx, blobs, thumb)
+		if errors.Is(err, blob.ErrNotFound) {
+			issues = append(issues, issue{kind: issueMissingThumbnail, path: thumb, photo: p})
+			continue
+		}
+		if err != nil {
+			issues = append(issues, issue{kind: issueUnreadableThumbnail, path: thumb, detail: err.Error(), photo: p})
+			continue
+		}
+		if !originalOK {
+			continue
+		}
+		if path.Base(thumb) != media.RenditionName(p.ID, thumbSpec.Name) {
+			issues = append(issues, issue{kind: issueThumbnailMismatch, path: thumb, detail: "not this photo's " + thumbSpec.Name + " rendition", photo: p})
+		} else if size := thumbSpec.Size; thumbSpec.Square && (cfg.Width != size || cfg.Height != size) {
+			issues = append(issues, issue{kind: issueThumbnailMismatch, path: thumb,
+				detail: fmt.Sprintf("%dx%d, want %dx%d", cfg.Width, cfg.Height, size, size), photo: p})
+		}
+	}
+
+	infos, err := blobs.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-grace)
+	for _, info := range infos {
+		if !referenced[info.Key] && info.ModTime.Before(cutoff) {
+			issues = append(issues, issue{kind: issueOrphan, path: info.Key})
+		}
+	}
+	return issues, nil
+}
+
+func decodeConfig(ctx context.Context, blobs blob.Store, key string) (image.Config, error) {
+	r, _, err := blobs.Get(ctx, key)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer r.Close()
+	// CheckImage also reads HEIC and RAW headers; no pixel limit applies here
+	_, cfg, err := media.CheckImage(r, 0)
+	return cfg, err
+}
+
+// quarantineBlob copies an orphan into a local directory (never served) and
+// removes it from storage. The stored bytes are copied as they are, so with
+// encryption at rest the quarantined file stays encrypted and can be moved
+// back into storage unchanged.
+func quarantineBlob(ctx context.Context, blobs blob.Store, key, quarantine string) (string, error) {
+	if enc, ok := blobs.(*blob.Encrypted); ok {
+		blobs = enc.Inner
+	}
+	r, _, err := blobs.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	dst := filepath.Join(quarantine, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return dst, blobs.Delete(ctx, key)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"m365/internal/gc"
+	"m365/internal/store"
+
+	"github.com/dustin/go-humanize"
+)
+
+func runGC(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report unreferenced media without deleting it")
+	grace := fs.Duration("grace", gc.DefaultGrace, "only delete media older than this")
+	history := fs.Bool("history", false, "show recent runs and total reclaimed space")
+	fs.Parse(args)
+
+	runs := store.NewGCStore(db)
+	if *history {
+		return printGCHistory(runs)
+	}
+
+	blobs, err := openBlobs()
+	if err != nil {
+		return err
+	}
+	c := &gc.Collector{
+		Blobs:  blobs,
+		Photos: store.NewPhotoStore(db),
+		Usage:  store.NewUsageStore(db),
+		Runs:   runs,
+		Grace:  *grace,
+	}
+	rep, err := c.Run(context.Background(), *dryRun)
+	if err != nil {
+		return err
+	}
+
+	verb := "deleted"
+	if *dryRun {
+		verb = "would delete"
+	}
+	for _, o := range rep.Orphans {
+		fmt.Printf("%s %s (%s, %s)\n", verb, o.Key, humanize.IBytes(uint64(o.Size)), humanize.Time(o.ModTime))
+	}
+	fmt.Printf("scanned %d, %s %d, reclaimed %s, %d errors\n",
+		rep.Scanned, verb, len(rep.Orphans), humanize.IBytes(uint64(rep.ReclaimedBytes)), rep.Errors)
+	if rep.Errors > 0 {
+		return fmt.Errorf("%d deletions failed", rep.Errors)
+	}
+	return nil
+}
+
+func printGCHistory(runs *store.GCStore) error {
+	recent, err := runs.Recent(20)
+	if err != nil {
+		return err
+	}
+	total, err := runs.TotalReclaimed()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "started\tmode\tscanned\tdeleted\treclaimed\terrors")
+	for _, r := range recent {
+		mode := "delete"
+		if r.DryRun {
+			mode = "dry-run"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%d\n", r.StartedAt.Format("2006-01-02 15:04"), mode,
+			r.Scanned, r.Deleted, humanize.IBytes(uint64(r.ReclaimedBytes)), r.Errors)
+	}
+	tw.Flush()
+	fmt.Printf("total reclaimed: %s\n", humanize.IBytes(uint64(total)))
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"m365/internal/store"
+)
+
+var jobStates = []string{store.JobPending, store.JobRunning, store.JobDone, store.JobFailed}
+
+func runJobs(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("jobs", flag.ExitOnError)
+	status := fs.String("status", store.JobFailed, "list the latest jobs in this state (empty for any)")
+	limit := fs.Int("n", 20, "how many jobs to list")
+	fs.Parse(args)
+
+	jobs := store.NewJobStore(db)
+	counts, err := jobs.Counts()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, s := range jobStates {
+		fmt.Fprintf(tw, "%s\t%d\n", s, counts[s])
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	recent, err := jobs.Recent(*status, *limit)
+	if err != nil || len(recent) == 0 {
+		return err
+	}
+	fmt.Println()
+	fmt.Fprintln(tw, "id\tkind\tphoto\tstatus\tattempts\tupdated\terror")
+	for _, j := range recent {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d/%d\t%s\t%s\n", j.ID, j.Kind, j.PhotoID, j.Status,
+			j.Attempts, j.MaxAttempts, j.UpdatedAt.Local().Format("2006-01-02 15:04"), j.LastError)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,79 @@
+// Command admin runs maintenance tasks against photos.db and media storage.
+//
+//	go run ./cmd/admin <command> [flags]
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"m365/internal/blob"
+	"m365/internal/store"
+
+	"github.com/joho/godotenv"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type command struct {
+	summary string
+	run     func(db *sql.DB, args []string) error
+}
+
+var commands = map[string]command{
+	"check":           {"verify media storage against the database (--repair to fix)", runCheck},
+	"migrate-storage": {"copy media between backends (--from local --to s3)", runMigrateStorage},
+	"encrypt":         {"encrypt existing media in place with ENCRYPTION_KEY", runEncrypt},
+	"usage":           {"report stored bytes per user (--rebuild to recompute)", runUsage},
+	"gc":              {"delete unreferenced media (--dry-run to report only)", runGC},
+	"reprocess":       {"regenerate renditions and metadata (--from/--to, --missing, resumable)", runReprocess},
+	"jobs":            {"count background jobs by state and list recent ones (--status, -n)", runJobs},
+}
+
+func main() {
+	log.SetFlags(0)
+	_ = godotenv.Load()
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	// The server may be writing at the same time
+	db, err := sql.Open("sqlite3", "photos.db?_busy_timeout=5000")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	if err := store.Migrate(db); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := cmd.run(db, os.Args[2:]); err != nil {
+		log.Fatalf("%s: %v", os.Args[1], err)
+	}
+}
+
+// openBlobs opens the storage backend configured for the server.
+func openBlobs() (blob.Store, error) {
+	return blob.Open(blob.ConfigFromEnv())
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: admin <command> [flags]\n\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", name, commands[name].summary)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+
+	"m365/internal/blob"
+)
+
+func runMigrateStorage(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("migrate-storage", flag.ExitOnError)
+	from := fs.String("from", "local", "source backend (local or s3)")
+	to := fs.String("to", "s3", "destination backend (local or s3)")
+	deleteSource := fs.Bool("delete-source", false, "remove each object from the source once copied")
+	dryRun := fs.Bool("dry-run", false, "list what would be copied")
+	fs.Parse(args)
+
+	if *from == *to {
+		return errors.New("--from and --to must differ")
+	}
+	// Both sides share UPLOADS_DIR / S3_* settings; only the backend differs.
+	// Objects are copied byte for byte, so encrypted media stays encrypted.
+	srcCfg, dstCfg := blob.ConfigFromEnv(), blob.ConfigFromEnv()
+	srcCfg.Backend, dstCfg.Backend = *from, *to
+	srcCfg.EncryptionKey, srcCfg.EncryptionKeyFile = "", ""
+	dstCfg.EncryptionKey, dstCfg.EncryptionKeyFile = "", ""
+	src, err := blob.Open(srcCfg)
+	if err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	dst, err := blob.Open(dstCfg)
+	if err != nil {
+		return fmt.Errorf("destination: %w", err)
+	}
+
+	ctx := context.Background()
+	infos, err := src.List(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	var copied, skipped int
+	var bytes int64
+	for _, info := range infos {
+		if existing, err := dst.Stat(ctx, info.Key); err == nil && existing.Size == info.Size {
+			skipped++
+		} else if *dryRun {
+			fmt.Printf("would copy %s (%d bytes)\n", info.Key, info.Size)
+			continue
+		} else {
+			if err := copyBlob(ctx, src, dst, info); err != nil {
+				return fmt.Errorf("%s: %w", info.Key, err)
+			}
+			copied++
+			bytes += info.Size
+			fmt.Printf("copied %s\n", info.Key)
+		}
+
+		if *deleteSource && !*dryRun {
+			if err := src.Delete(ctx, info.Key); err != nil {
+				return fmt.Errorf("delete %s from source: %w", info.Key, err)
+			}
+		}
+	}
+	fmt.Printf("%d copied (%d bytes), %d already present, %d total\n", copied, bytes, skipped, len(infos))
+	return nil
+}
+
+// copyBlob copies one object and verifies the destination size.
+func copyBlob(ctx context.Context, src, dst blob.Store, info blob.Info) error {
+	r, _, err := src.Get(ctx, info.Key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := dst.Put(ctx, info.Key, r); err != nil {
+		return err
+	}
+	got, err := dst.Stat(ctx, info.Key)
+	if err != nil {
+		return err
+	}
+	if got.Size != info.Size {
+		return fmt.Errorf("size mismatch after copy: %d != %d", got.Size, info.Size)
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"m365/internal/process"
+	"m365/internal/store"
+)
+
+func runReprocess(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("reprocess", flag.ExitOnError)
+	workers := fs.Int("workers", runtime.NumCPU(), "photos processed in parallel")
+	from := fs.String("from", "", "only days on or after YYYY-MM-DD")
+	to := fs.String("to", "", "only days on or before YYYY-MM-DD")
+	missing := fs.String("missing", "", `only photos without this rendition ("any" = any configured one)`)
+	status := fs.String("status", "", "only photos in this status (ready, processing, failed)")
+	statePath := fs.String("state", "reprocess.state", "progress file; finished photos are skipped on the next run")
+	restart := fs.Bool("restart", false, "ignore earlier progress and start over")
+	dryRun := fs.Bool("dry-run", false, "list the photos that would be reprocessed")
+	fs.Parse(args)
+
+	for _, d := range []string{*from, *to} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", d); err != nil {
+			return fmt.Errorf("bad date %q: want YYYY-MM-DD", d)
+		}
+	}
+	if *workers < 1 {
+		*workers = 1
+	}
+
+	blobs, err := openBlobs()
+	if err != nil {
+		return err
+	}
+	proc, err := process.FromEnv(db, blobs)
+	if err != nil {
+		return err
+	}
+
+	if *restart {
+		if err := removeReprocessState(*statePath); err != nil {
+			return err
+		}
+	}
+	done, err := loadReprocessState(*statePath)
+	if err != nil {
+		return err
+	}
+
+	all, err := proc.Photos.All()
+	if err != nil {
+		return err
+	}
+	var candidates []store.Photo
+	for _, p := range all {
+		if *from != "" && p.Day < *from || *to != "" && p.Day > *to {
+			continue
+		}
+		if *status != "" && photoStatus(p) != *status {
+			continue
+		}
+		candidates = append(candidates, p)
+	}
+	if *missing != "" {
+		if candidates, err = missingRendition(proc, candidates, *missing); err != nil {
+			return err
+		}
+	}
+
+	var todo []store.Photo
+	for _, p := range candidates {
+		if !done[p.ID] {
+			todo = append(todo, p)
+		}
+	}
+	if skipped := len(candidates) - len(todo); skipped > 0 {
+		fmt.Printf("resuming: %d already done (--restart to redo them)\n", skipped)
+	}
+	if *dryRun {
+		for _, p := range todo {
+			fmt.Printf("would reprocess %s %s\n", p.Day, p.ID)
+		}
+		fmt.Printf("%d photos\n", len(todo))
+		return nil
+	}
+	if len(todo) == 0 {
+		fmt.Println("nothing to reprocess")
+		return removeReprocessState(*statePath)
+	}
+
+	state, err := os.OpenFile(*statePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+
+	// Ctrl-C stops feeding photos but lets in-flight ones finish, so they run
+	// under a context it doesn't cancel; the state file keeps the rest for
+	// next time. A second Ctrl-C kills the command as usual.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	procCtx := context.WithoutCancel(ctx)
+
+	var (
+		mu              sync.Mutex
+		finished, fails int
+		wg              sync.WaitGroup
+	)
+	ch := make(chan store.Photo)
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range ch {
+				start := time.Now()
+				err := proc.Process(procCtx, p.ID)
+				mu.Lock()
+				finished++
+				if err != nil {
+					fails++
+					fmt.Fprintf(os.Stderr, "[%d/%d] %s %s: %v\n", finished, len(todo), p.Day, p.ID, err)
+				} else {
+					fmt.Fprintln(state, p.ID)
+					fmt.Printf("[%d/%d] %s %s (%s)\n", finished, len(todo), p.Day, p.ID, time.Since(start).Round(time.Millisecond))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, p := range todo {
+		select {
+		case ch <- p:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(ch)
+	wg.Wait()
+
+	fmt.Printf("reprocessed %d, failed %d, remaining %d\n", finished-fails, fails, len(todo)-finished)
+	if ctx.Err() != nil {
+		return fmt.Errorf("interrupted; run again to resume")
+	}
+	if fails > 0 {
+		return fmt.Errorf("%d photos failed; run again to retry them", fails)
+	}
+	state.Close()
+	return removeReprocessState(*statePath)
+}
+
+func removeReprocessState(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func photoStatus(p store.Photo) string {
+	if p.Status == store.StatusReady {
+		return "ready"
+	}
+	return p.Status
+}
+
+// missingRendition keeps the photos lacking the named rendition, or with
+// name "any", lacking any of the configured ones.
+func missingRendition(proc *process.Processor, photos []store.Photo, name string) ([]store.Photo, error) {
+	want := []string{name}
+	if name == "any" {
+		want = nil
+		for _, spec := range proc.Specs {
+			want = append(want, spec.Name)
+		}
+	}
+	ids := make([]string, len(photos))
+	for i, p := range photos {
+		ids[i] = p.ID
+	}
+	have, err := proc.Renditions.ForPhotos(ids)
+	if err != nil {
+		return nil, err
+	}
+	var out []store.Photo
+	for _, p := range photos {
+		names := map[string]bool{}
+		for _, rd := range have[p.ID] {
+			names[rd.Name] = true
+		}
+		for _, n := range want {
+			if !names[n] {
+				out = append(out, p)
+				break
+			}
+		}
+	}
+	return out, nil
+}
+
+// loadReprocessState reads the IDs finished by an earlier, unfinished run.
+func loadReprocessState(path string) (map[string]bool, error) {
+	done := map[string]bool{}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if id := strings.TrimSpace(sc.Text()); id != "" {
+			done[id] = true
+		}
+	}
+	return done, sc.Err()
+}
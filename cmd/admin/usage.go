@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"m365/internal/blob"
+	"m365/internal/store"
+
+	"github.com/dustin/go-humanize"
+)
+
+var usageKinds = []string{store.KindOriginal, store.KindThumbnail, store.KindRendition}
+
+func runUsage(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("usage", flag.ExitOnError)
+	rebuild := fs.Bool("rebuild", false, "recompute the ledger from photo rows and stored sizes")
+	owner := fs.String("user", "", "with --rebuild: owner for photos uploaded before ownership was tracked")
+	fs.Parse(args)
+
+	usage := store.NewUsageStore(db)
+	if *rebuild {
+		if err := rebuildUsage(db, usage, *owner); err != nil {
+			return err
+		}
+	}
+
+	all, err := usage.All()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "user\ttotal\t%s\t\n", strings.Join(usageKinds, "\t"))
+	for _, u := range all {
+		name := u.UserID
+		if name == "" {
+			name = "(project)"
+		}
+		fmt.Fprintf(tw, "%s\t%s", name, humanize.IBytes(uint64(u.Bytes)))
+		for _, k := range usageKinds {
+			fmt.Fprintf(tw, "\t%s", humanize.IBytes(uint64(u.ByKind[k])))
+		}
+		fmt.Fprintln(tw, "\t")
+	}
+	if q := os.Getenv("QUOTA_BYTES"); q != "" {
+		fmt.Fprintf(tw, "quota per user: %s bytes\t\n", q)
+	}
+	return tw.Flush()
+}
+
+func rebuildUsage(db *sql.DB, usage *store.UsageStore, owner string) error {
+	blobs, err := openBlobs()
+	if err != nil {
+		return err
+	}
+	photos, err := store.NewPhotoStore(db).All()
+	if err != nil {
+		return err
+	}
+	if err := usage.Clear(); err != nil {
+		return err
+	}
+
+	renditions := store.NewRenditionStore(db)
+	ctx := context.Background()
+	for _, p := range photos {
+		userID := p.UserID
+		if userID == "" {
+			userID = owner
+		}
+		kinds := map[string]string{p.Filepath: store.KindOriginal, p.LiveVideo: store.KindOriginal, p.ThumbnailPath: store.KindThumbnail}
+		rds, err := renditions.ForPhoto(p.ID)
+		if err != nil {
+			return err
+		}
+		for _, rd := range rds {
+			kind := store.KindRendition
+			if rd.URL == p.ThumbnailPath {
+				kind = store.KindThumbnail
+			}
+			for _, u := range rd.URLs() {
+				if _, ok := kinds[u]; !ok {
+					kinds[u] = kind
+				}
+			}
+		}
+		for url, kind := range kinds {
+			if url == "" {
+				continue
+			}
+			key := blob.KeyFromURL(url)
+			info, err := blobs.Stat(ctx, key)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "skip %s: %v\n", key, err)
+				continue
+			}
+			if err := usage.Record(userID, key, kind, info.Size); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,395 @@
+// Command gen-tz builds internal/tz/boundaries.geojson.gz, the time zone
+// polygons embedded in the server. From a timezone-boundary-builder release
+// (the timezones.geojson.zip asset, unzipped) it simplifies every zone:
+//
+//	go run ./cmd/gen-tz -tbb combined.json
+//
+// Without that data at hand it can also derive zones from country borders,
+// such as Natural Earth's public-domain ne_110m_admin_0_countries.geojson.
+// A country with one zone in zone.tab gets that zone; one with several is
+// split between them by nearest reference location, so zone borders inside
+// such countries are approximate but national ones are not:
+//
+//	go run ./cmd/gen-tz -countries ne_110m_admin_0_countries.geojson
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"m365/internal/tz"
+)
+
+type point = [2]float64 // lon, lat
+type ring = []point
+type polygon = []ring // outer ring, then holes
+
+type feature struct {
+	Properties map[string]any `json:"properties"`
+	Geometry   struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	} `json:"geometry"`
+}
+
+// overseasDistance is how far, in km, a piece of a country holding none of
+// its reference locations may lie from all of them before it is taken to be
+// an overseas territory with zones of its own (French Guiana in France) and
+// left out.
+const overseasDistance = 1500
+
+// Natural Earth entities without an ISO code of their own, by adm0_a3
+var countryOverrides = map[string]string{
+	"CYN": "CY", // Northern Cyprus
+	"KOS": "RS", // Kosovo keeps Europe/Belgrade
+	"SOL": "SO", // Somaliland
+}
+
+func main() {
+	tbb := flag.String("tbb", "", "timezone-boundary-builder GeoJSON to simplify")
+	countries := flag.String("countries", "", "country borders GeoJSON to split into zones instead")
+	tolerance := flag.Float64("tolerance", 0.01, "simplification tolerance in degrees (-tbb only)")
+	out := flag.String("o", "internal/tz/boundaries.geojson.gz", "output file")
+	flag.Parse()
+
+	var zones map[string][]polygon
+	var err error
+	switch {
+	case *tbb != "" && *countries == "":
+		zones, err = fromTBB(*tbb, *tolerance)
+	case *countries != "" && *tbb == "":
+		zones, err = fromCountries(*countries)
+	default:
+		log.Fatal("pass one of -tbb or -countries")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := write(*out, zones); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Wrote %d zones to %s", len(zones), *out)
+}
+
+func readFeatures(path string) ([]feature, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var fc struct {
+		Features []feature `json:"features"`
+	}
+	if err := json.NewDecoder(f).Decode(&fc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return fc.Features, nil
+}
+
+func polygons(f feature) ([]polygon, error) {
+	switch f.Geometry.Type {
+	case "Polygon":
+		var p polygon
+		err := json.Unmarshal(f.Geometry.Coordinates, &p)
+		return []polygon{p}, err
+	case "MultiPolygon":
+		var ps []polygon
+		err := json.Unmarshal(f.Geometry.Coordinates, &ps)
+		return ps, err
+	}
+	return nil, nil
+}
+
+func fromTBB(path string, tolerance float64) (map[string][]polygon, error) {
+	features, err := readFeatures(path)
+	if err != nil {
+		return nil, err
+	}
+	zones := map[string][]polygon{}
+	for _, f := range features {
+		name, _ := f.Properties["tzid"].(string)
+		ps, err := polygons(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		for _, p := range ps {
+			var out polygon
+			for i, rg := range p {
+				rg = simplify(rg, tolerance)
+				if len(rg) < 4 {
+					if i == 0 {
+						break // the outer ring collapsed: a speck of land
+					}
+					continue
+				}
+				out = append(out, rg)
+			}
+			if len(out) > 0 {
+				zones[name] = append(zones[name], out)
+			}
+		}
+	}
+	return zones, nil
+}
+
+func fromCountries(path string) (map[string][]polygon, error) {
+	features, err := readFeatures(path)
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string][]tz.Reference{}
+	for _, r := range tz.References() {
+		refs[r.Country] = append(refs[r.Country], r)
+	}
+	zones := map[string][]polygon{}
+	for _, f := range features {
+		code, _ := f.Properties["iso_a2"].(string)
+		if c, ok := countryOverrides[fmt.Sprint(f.Properties["adm0_a3"])]; ok {
+			code = c
+		}
+		ps, err := polygons(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", code, err)
+		}
+		ps = slices.DeleteFunc(ps, func(p polygon) bool { return len(p) == 0 || len(p[0]) == 0 })
+		country := refs[code]
+		if len(country) == 0 {
+			log.Printf("Skipping %v: no zone for %q", f.Properties["name"], code)
+			continue
+		}
+		for _, p := range ps {
+			if !nearAny(p, country) {
+				continue
+			}
+			for _, r := range country {
+				if cell := voronoiCell(p, r, country); cell != nil {
+					zones[r.Zone] = append(zones[r.Zone], cell)
+				}
+			}
+		}
+	}
+	return zones, nil
+}
+
+func nearAny(p polygon, refs []tz.Reference) bool {
+	lon, lat := centroid(p)
+	for _, r := range refs {
+		if contains(p[0], point{r.Lon, r.Lat}) || distance(lat, lon, r.Lat, r.Lon) <= overseasDistance {
+			return true
+		}
+	}
+	return false
+}
+
+// contains is the even-odd rule, as tz applies it.
+func contains(rg ring, pt point) bool {
+	in := false
+	for i, j := 0, len(rg)-1; i < len(rg); j, i = i, i+1 {
+		xi, yi, xj, yj := rg[i][0], rg[i][1], rg[j][0], rg[j][1]
+		if (yi > pt[1]) != (yj > pt[1]) && pt[0] < (xj-xi)*(pt[1]-yi)/(yj-yi)+xi {
+			in = !in
+		}
+	}
+	return in
+}
+
+// centroid is the mean of p's outer ring's points.
+func centroid(p polygon) (lon, lat float64) {
+	for _, pt := range p[0] {
+		lon, lat = lon+pt[0], lat+pt[1]
+	}
+	return lon / float64(len(p[0])), lat / float64(len(p[0]))
+}
+
+// distance is the great-circle distance in km.
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat, dLon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * 6371 * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// voronoiCell clips p to the points nearer r than any other reference in
+// refs. Distances are measured on a plane scaled to p's latitude, and
+// longitudes are unwrapped around p so a polygon just west of the
+// antimeridian isn't taken to be a world away from one just east of it.
+func voronoiCell(p polygon, r tz.Reference, refs []tz.Reference) polygon {
+	cx, cy := centroid(p)
+	k2 := math.Pow(math.Cos(cy*math.Pi/180), 2)
+	unwrap := func(lon float64) float64 {
+		return lon - 360*math.Round((lon-cx)/360)
+	}
+
+	cell := p
+	ri := point{unwrap(r.Lon), r.Lat}
+	for _, o := range refs {
+		if o.Zone == r.Zone {
+			continue
+		}
+		rj := point{unwrap(o.Lon), o.Lat}
+		mx, my := (ri[0]+rj[0])/2, (ri[1]+rj[1])/2
+		dx, dy := rj[0]-ri[0], rj[1]-ri[1]
+		// Negative on r's side of the bisector
+		side := func(pt point) float64 {
+			return k2*(pt[0]-mx)*dx + (pt[1]-my)*dy
+		}
+		var clipped polygon
+		for i, rg := range cell {
+			rg = clip(rg, side)
+			if len(rg) < 4 {
+				if i == 0 {
+					return nil
+				}
+				continue
+			}
+			clipped = append(clipped, rg)
+		}
+		cell = clipped
+	}
+	return cell
+}
+
+// clip keeps the part of a closed ring where side is at most zero
+// (Sutherland-Hodgman). A concave ring cut in several pieces comes out as
+// one ring joined along the cut, which the even-odd rule still reads right.
+func clip(rg ring, side func(point) float64) ring {
+	var out ring
+	for i := 0; i+1 < len(rg); i++ {
+		a, b := rg[i], rg[i+1]
+		sa, sb := side(a), side(b)
+		if sa <= 0 {
+			out = append(out, a)
+		}
+		if (sa < 0 && sb > 0) || (sa > 0 && sb < 0) {
+			t := sa / (sa - sb)
+			out = append(out, point{a[0] + t*(b[0]-a[0]), a[1] + t*(b[1]-a[1])})
+		}
+	}
+	if len(out) > 0 {
+		out = append(out, out[0])
+	}
+	return out
+}
+
+// simplify is Douglas-Peucker on a closed ring: points closer than
+// tolerance to the line through their neighbours are dropped.
+func simplify(rg ring, tolerance float64) ring {
+	if len(rg) < 4 {
+		return rg
+	}
+	keep := make([]bool, len(rg))
+	keep[0], keep[len(rg)-1] = true, true
+	// The ring starts and ends on the same point: split it at the farthest one
+	far, farD := 0, -1.0
+	for i, pt := range rg {
+		if d := math.Hypot(pt[0]-rg[0][0], pt[1]-rg[0][1]); d > farD {
+			far, farD = i, d
+		}
+	}
+	keep[far] = true
+	var dp func(lo, hi int)
+	dp = func(lo, hi int) {
+		best, bestD := 0, tolerance
+		for i := lo + 1; i < hi; i++ {
+			if d := lineDistance(rg[i], rg[lo], rg[hi]); d > bestD {
+				best, bestD = i, d
+			}
+		}
+		if best > 0 {
+			keep[best] = true
+			dp(lo, best)
+			dp(best, hi)
+		}
+	}
+	dp(0, far)
+	dp(far, len(rg)-1)
+	var out ring
+	for i, k := range keep {
+		if k {
+			out = append(out, rg[i])
+		}
+	}
+	return out
+}
+
+func lineDistance(p, a, b point) float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	if dx == 0 && dy == 0 {
+		return math.Hypot(p[0]-a[0], p[1]-a[1])
+	}
+	return math.Abs(dy*(p[0]-a[0])-dx*(p[1]-a[1])) / math.Hypot(dx, dy)
+}
+
+// write stores zones as gzipped GeoJSON, one MultiPolygon per zone, with
+// coordinates rounded to about 100 meters.
+func write(path string, zones map[string][]polygon) error {
+	names := make([]string, 0, len(zones))
+	for name := range zones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(`{"type":"FeatureCollection","features":[`)
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString(",\n")
+		}
+		fmt.Fprintf(&b, `{"type":"Feature","properties":{"tzid":%q},"geometry":{"type":"MultiPolygon","coordinates":[`, name)
+		for j, p := range zones[name] {
+			if j > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteByte('[')
+			for k, rg := range p {
+				if k > 0 {
+					b.WriteByte(',')
+				}
+				b.WriteByte('[')
+				for l, pt := range rg {
+					if l > 0 {
+						b.WriteByte(',')
+					}
+					fmt.Fprintf(&b, "[%s,%s]", coord(pt[0]), coord(pt[1]))
+				}
+				b.WriteByte(']')
+			}
+			b.WriteByte(']')
+		}
+		b.WriteString("]}}")
+	}
+	b.WriteString("]}\n")
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	zw, err := gzip.NewWriterLevel(f, gzip.BestCompression)
+	if err == nil {
+		_, err = zw.Write([]byte(b.String()))
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func coord(v float64) string {
+	s := fmt.Sprintf("%.3f", v)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if s == "-0" {
+		s = "0"
+	}
+	return s
+}
@@ -1,106 +1,119 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"flag"
 	"fmt"
-	"io"
 	"log"
-	"os"
-	"path/filepath"
 	"time"
 
-	_ "modernc.org/sqlite"
+	"m365/internal/blob"
+	"m365/internal/jobs"
+	"m365/internal/process"
+	"m365/internal/store"
+
 	"github.com/google/uuid"
+	"github.com/joho/godotenv"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 func main() {
-	db, err := sql.Open("sqlite", "photos.db")
+	owner := flag.String("user", "", "username that owns the seeded photos (default: the source photo's owner)")
+	days := flag.Int("days", 45, "seed this many days back from today")
+	flag.Parse()
+	_ = godotenv.Load()
+
+	// The server may be running; it processes the queued jobs
+	db, err := sql.Open("sqlite3", "photos.db?_busy_timeout=5000")
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
+	if err := store.Migrate(db); err != nil {
+		log.Fatal(err)
+	}
 
 	// 1. Get the source photo (the latest one)
-	var id, filepathSrc, thumbPathSrc, notes, exif string
-	var lat, lon float64
-	
-	row := db.QueryRow("SELECT id, filepath, thumbnail_path, lat, lon, notes, exif_data FROM photos ORDER BY day DESC LIMIT 1")
-	err = row.Scan(&id, &filepathSrc, &thumbPathSrc, &lat, &lon, &notes, &exif)
-	if err != nil {
+	photos := store.NewPhotoStore(db)
+	latest, err := photos.List(1)
+	if err != nil || len(latest) == 0 {
 		log.Fatalf("No photos found to seed from: %v", err)
 	}
+	src := latest[0]
+	fmt.Printf("Seeding from photo ID: %s (%s)\n", src.ID, src.Filepath)
 
-	fmt.Printf("Seeding from photo ID: %s (%s)\n", id, filepathSrc)
-
-	// 2. Define Range: Nov 15 2025 to Dec 29 2025 (Assuming current year 2025 from user context, logic works for any recent year)
-    // Actually, let's just go back 45 days from today.
-    
-    end := time.Now()
-    start := end.AddDate(0, 0, -45) 
-    
-    // Create 'uploads' dir if safe? It exists.
-    
-    count := 0
-    for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
-        dayStr := d.Format("2006-01-02")
-        
-        // Skip if exists
-        var exists bool
-        db.QueryRow("SELECT EXISTS(SELECT 1 FROM photos WHERE day = ?)", dayStr).Scan(&exists)
-        if exists {
-            fmt.Printf("Skipping %s (exists)\n", dayStr)
-            continue
-        }
-
-        // Generate new ID
-        newID := uuid.New().String()
-        
-        // Copy File
-        newFilename := fmt.Sprintf("%s.jpg", newID)
-        newPath := filepath.Join("uploads", newFilename)
-        if err := copyFile(filepathSrc[1:], newPath); err != nil { // Remove leading '/' from filepathSrc if present?
-             // filepathSrc in DB is likely "/uploads/..." from my previous code?
-             // Actually my code saves as "/uploads/..." (abs-ish path string for URL) but on disk it is relative to cwd "uploads/..."
-             // Let's check filepathSrc. If it starts with "/", strip it for disk access.
-             src := filepathSrc
-             if src[0] == '/' { src = src[1:] }
-             copyFile(src, newPath)
-        }
-        
-        // Copy Thumbnail
-        newThumbFilename := fmt.Sprintf("%s_thumb.jpg", newID)
-        newThumbPath := filepath.Join("uploads", newThumbFilename)
-         // src thumb
-         srcThumb := thumbPathSrc
-         if srcThumb[0] == '/' { srcThumb = srcThumb[1:] }
-         copyFile(srcThumb, newThumbPath)
-         
-         // Insert DB
-         _, err = db.Exec(`INSERT INTO photos (day, id, filepath, thumbnail_path, lat, lon, notes, exif_data, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-            dayStr, newID, "/"+newPath, "/"+newThumbPath, lat, lon, fmt.Sprintf("Seeded clone %s", dayStr), exif, time.Now())
-        if err != nil {
-            log.Printf("Failed to insert %s: %v", dayStr, err)
-        } else {
-            count++
-        }
-    }
-    
-    fmt.Printf("Seeded %d new photos.\n", count)
-}
+	userID := *owner
+	if userID == "" {
+		userID = src.UserID
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", userID).Scan(&exists); err != nil {
+		log.Fatal(err)
+	}
+	if !exists {
+		log.Fatalf("No user %q; pass -user with an existing username", userID)
+	}
 
-func copyFile(src, dst string) error {
-	sourceFile, err := os.Open(src)
+	blobs, err := blob.Open(blob.ConfigFromEnv())
 	if err != nil {
-		return err
+		log.Fatal(err)
+	}
+	// Originals are content-addressed: clones share the source's files
+	sizes := map[string]int64{}
+	for _, u := range []string{src.Filepath, src.LiveVideo} {
+		if u == "" {
+			continue
+		}
+		info, err := blobs.Stat(context.Background(), blob.KeyFromURL(u))
+		if err != nil {
+			log.Fatalf("Source media %s: %v", u, err)
+		}
+		sizes[u] = info.Size
 	}
-	defer sourceFile.Close()
 
-	destFile, err := os.Create(dst)
-	if err != nil {
-		return err
+	usage := store.NewUsageStore(db)
+	queue := jobs.NewQueue(store.NewJobStore(db))
+	end := time.Now()
+	start := end.AddDate(0, 0, -*days)
+	count := 0
+	for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+		dayStr := d.Format("2006-01-02")
+
+		// Skip if exists
+		if _, err := photos.GetByDay(dayStr); err == nil {
+			fmt.Printf("Skipping %s (exists)\n", dayStr)
+			continue
+		}
+
+		// Renditions, thumbnail and metadata come from the processing job
+		p := &store.Photo{
+			Day:       dayStr,
+			ID:        uuid.New().String(),
+			Filepath:  src.Filepath,
+			LiveVideo: src.LiveVideo,
+			Notes:     fmt.Sprintf("Seeded clone %s", dayStr),
+			SHA256:    src.SHA256,
+			Format:    src.Format,
+			Duration:  src.Duration,
+			Status:    store.StatusProcessing,
+			UserID:    userID,
+			CreatedAt: time.Now(),
+		}
+		if err := photos.Save(p); err != nil {
+			log.Printf("Failed to insert %s: %v", dayStr, err)
+			continue
+		}
+		for u, size := range sizes {
+			if err := usage.Record(userID, blob.KeyFromURL(u), store.KindOriginal, size); err != nil {
+				log.Printf("usage: %v", err)
+			}
+		}
+		if err := queue.Enqueue(process.Kind, p.ID); err != nil {
+			log.Printf("Failed to queue %s: %v", dayStr, err)
+		}
+		count++
 	}
-	defer destFile.Close()
 
-	_, err = io.Copy(destFile, sourceFile)
-	return err
+	fmt.Printf("Seeded %d new photos; the server makes their renditions.\n", count)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"log"
     "io"
@@ -10,11 +11,20 @@ import (
 
     "m365/internal/api"
     "m365/internal/auth"
+    "m365/internal/blob"
+    "m365/internal/gc"
+    "m365/internal/jobs"
+    "m365/internal/media"
+    "m365/internal/process"
+    "m365/internal/store"
+    "m365/internal/tz"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	_ "github.com/mattn/go-sqlite3"
+    "strconv"
     "strings"
+    "time"
     "github.com/joho/godotenv"
 )
 
@@ -22,7 +32,8 @@ func main() {
     // Load .env
     _ = godotenv.Load()
 
-	dbPath := "photos.db"
+	// Workers write concurrently with requests; wait on the lock instead of failing
+	dbPath := "photos.db?_busy_timeout=5000"
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		log.Fatal(err)
@@ -30,13 +41,27 @@ func main() {
 	defer db.Close()
 
     // Initialize schema
-    schema, err := os.ReadFile("internal/store/schema.sql")
-    if err == nil {
-        if _, err := db.Exec(string(schema)); err != nil {
-            log.Printf("Error applying schema: %v", err)
+    if err := store.Migrate(db); err != nil {
+        log.Printf("Error applying schema: %v", err)
+    }
+
+    // Media storage (local disk or S3)
+    blobs, err := blob.Open(blob.ConfigFromEnv())
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    // Recover from interrupted uploads: drop half-written temp files
+    inner := blobs
+    if enc, ok := blobs.(*blob.Encrypted); ok {
+        inner = enc.Inner
+    }
+    if local, ok := inner.(*blob.Local); ok {
+        if removed, err := local.CleanTemp(); err != nil {
+            log.Printf("Warning: upload recovery failed: %v", err)
+        } else if len(removed) > 0 {
+            log.Printf("Removed %d incomplete upload(s)", len(removed))
         }
-    } else {
-        log.Printf("Warning: Could not read schema.sql: %v", err)
     }
 
 	r := chi.NewRouter()
@@ -50,21 +75,116 @@ func main() {
     appOrigin := os.Getenv("APP_ORIGIN")
     if appOrigin == "" { appOrigin = "http://localhost:8080" }
 
+    // Security headers (SPA + API)
+    secCfg := api.DefaultSecurityConfig(appOrigin)
+    if v := os.Getenv("CSP"); v != "" { secCfg.CSP = v }
+    if v := os.Getenv("CSP_IMG_SRC"); v != "" { secCfg.ImgSources = append(secCfg.ImgSources, strings.Fields(v)...) }
+    if v := os.Getenv("HSTS_MAX_AGE"); v != "" {
+        if n, err := strconv.Atoi(v); err == nil { secCfg.HSTSMaxAge = n }
+    }
+    if v := os.Getenv("REFERRER_POLICY"); v != "" { secCfg.ReferrerPolicy = v }
+    if v := os.Getenv("PERMISSIONS_POLICY"); v != "" { secCfg.PermissionsPolicy = v }
+    r.Use(api.SecurityHeaders(secCfg))
+
     // Initialize Auth
     authService, err := auth.NewService(db, appDomain, appOrigin)
     if err != nil {
         log.Fatal(err)
     }
 
-    h := api.NewHandler(db, authService)
+    h := api.NewHandler(db, authService, blobs)
+    if v := os.Getenv("MAX_UPLOAD_BYTES"); v != "" {
+        if n, err := strconv.ParseInt(v, 10, 64); err == nil { h.MaxUploadBytes = n }
+    }
+    if v := os.Getenv("MAX_IMAGE_PIXELS"); v != "" {
+        if n, err := strconv.Atoi(v); err == nil { h.MaxPixels = n }
+    }
+    if v := os.Getenv("QUOTA_BYTES"); v != "" {
+        if n, err := strconv.ParseInt(v, 10, 64); err == nil { h.QuotaBytes = n }
+    }
+    // Resumable (tus) uploads; RESUMABLE_DIR= disables them
+    if v, ok := os.LookupEnv("RESUMABLE_DIR"); ok { h.ResumableDir = v }
+    if v := os.Getenv("RESUMABLE_EXPIRY"); v != "" {
+        if d, err := time.ParseDuration(v); err == nil && d > 0 { h.ResumableExpiry = d }
+    }
+    if h.ResumableDir != "" {
+        go h.ScheduleUploadExpiry(context.Background(), time.Hour)
+    }
+
+    // Exact time zone polygons for GPS-dated uploads, instead of the coarse built-in ones
+    if v := os.Getenv("TZ_BOUNDARIES"); v != "" {
+        b, err := tz.LoadBoundaries(v)
+        if err != nil {
+            log.Fatal("TZ_BOUNDARIES: ", err)
+        }
+        tz.SetBoundaries(b)
+    }
+
+    // On-demand resizes (/api/media/{id}); encrypted like the media when a key is set
+    if v := os.Getenv("RESIZE_SIZES"); v != "" {
+        sizes, err := api.ParseResizeSizes(v)
+        if err != nil {
+            log.Fatal("RESIZE_SIZES: ", err)
+        }
+        h.ResizeSizes = sizes
+    }
+    cacheCfg := blob.ConfigFromEnv()
+    cacheCfg.Backend, cacheCfg.Dir = "local", "cache"
+    if v, ok := os.LookupEnv("RESIZE_CACHE_DIR"); ok {
+        cacheCfg.Dir = v
+    }
+    if cacheCfg.Dir != "" {
+        h.ResizeCache, err = blob.Open(cacheCfg)
+        if err != nil {
+            log.Fatal("RESIZE_CACHE_DIR: ", err)
+        }
+    }
+
+    // Renditions and metadata are produced by background jobs after upload
+    proc, err := process.FromEnv(db, blobs)
+    if err != nil {
+        log.Fatal(err)
+    }
+    // Decrypted originals and tool files a killed run left behind
+    if removed, err := media.CleanScratch(); err != nil {
+        log.Printf("Warning: scratch cleanup failed: %v", err)
+    } else if len(removed) > 0 {
+        log.Printf("Removed %d scratch file(s)", len(removed))
+    }
+
+    queue := jobs.NewQueue(store.NewJobStore(db))
+    if v := os.Getenv("JOB_WORKERS"); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n > 0 { queue.Workers = n }
+    }
+    if v := os.Getenv("JOB_MAX_ATTEMPTS"); v != "" {
+        if n, err := strconv.Atoi(v); err == nil && n > 0 { queue.MaxAttempts = n }
+    }
+    queue.Handle(process.Kind, proc.Handle, proc.Failed)
+    go queue.Run(context.Background())
+    h.Queue = queue
     h.RegisterRoutes(r)
 
-    // Serve uploads explicitly
-    workDir, _ := os.Getwd()
-    uploadsDir := http.Dir(filepath.Join(workDir, "uploads"))
-    FileServer(r, "/uploads", uploadsDir)
+    // Garbage-collect media no row references (GC_INTERVAL=0 disables)
+    gcInterval, gcGrace := 24*time.Hour, gc.DefaultGrace
+    if v := os.Getenv("GC_INTERVAL"); v != "" {
+        if d, err := time.ParseDuration(v); err == nil { gcInterval = d }
+    }
+    if v := os.Getenv("GC_GRACE"); v != "" {
+        if d, err := time.ParseDuration(v); err == nil { gcGrace = d }
+    }
+    if gcInterval > 0 {
+        collector := &gc.Collector{
+            Blobs:  blobs,
+            Photos: h.Photos,
+            Usage:  h.Usage,
+            Runs:   store.NewGCStore(db),
+            Grace:  gcGrace,
+        }
+        go collector.Schedule(context.Background(), gcInterval)
+    }
 
     // Serve frontend files (placeholder for now)
+    workDir, _ := os.Getwd()
     filesDir := http.Dir(filepath.Join(workDir, "client/dist"))
     FileServer(r, "/", filesDir)
 
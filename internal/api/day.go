@@ -0,0 +1,82 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Day policies decide which day an upload goes on when the form's day and
+// the photo's capture date disagree.
+const (
+	DayPolicyExif   = "exif"   // the capture date wins (the default)
+	DayPolicyClient = "client" // the form's day wins
+	DayPolicyReject = "reject" // the upload is refused with 409 Conflict
+)
+
+// Where an upload's day came from, reported as DaySource.
+const (
+	DaySourceClient = "client"
+	DaySourceExif   = "exif"
+	DaySourceToday  = "today" // neither given: today in the user's time zone
+)
+
+// validDay accepts an empty day (none requested) or YYYY-MM-DD.
+func validDay(day string) bool {
+	_, err := time.Parse("2006-01-02", day)
+	return day == "" || err == nil
+}
+
+func validDayPolicy(p string) bool {
+	return p == DayPolicyExif || p == DayPolicyClient || p == DayPolicyReject
+}
+
+// dayConflict is a reject-policy upload whose day and capture date differ.
+type dayConflict struct {
+	Error        string
+	RequestedDay string
+	DetectedDay  string
+}
+
+// chooseDay settles the form's day against the detected capture day; either
+// may be empty. An empty day means neither was given.
+func chooseDay(requested, detected, policy string) (day, source string, conflict *dayConflict) {
+	switch {
+	case requested == "" && detected == "":
+		return "", "", nil
+	case requested == "":
+		return detected, DaySourceExif, nil
+	case detected == "" || detected == requested:
+		return requested, DaySourceClient, nil
+	}
+	switch policy {
+	case DayPolicyClient:
+		return requested, DaySourceClient, nil
+	case DayPolicyReject:
+		return "", "", &dayConflict{
+			Error:        fmt.Sprintf("photo was taken on %s, not %s; upload again with day_policy=client or day_policy=exif", detected, requested),
+			RequestedDay: requested,
+			DetectedDay:  detected,
+		}
+	}
+	return detected, DaySourceExif, nil
+}
+
+func (c *dayConflict) write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(c)
+}
+
+// userLocation is the named time zone, else the server's.
+func userLocation(name string) *time.Location {
+	if name == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
@@ -1,49 +1,118 @@
 package api
 
 import (
+    "context"
+    "crypto/sha256"
     "database/sql"
 	"encoding/json"
+    "encoding/hex"
+    "errors"
     "fmt"
 	"net/http"
     "io"
-    "os"
-    "path/filepath"
+    "log"
+    "runtime"
+    "sort"
+    "strconv"
+    "sync"
     "time"
 
     "m365/internal/auth"
+    "m365/internal/blob"
+    "m365/internal/jobs"
+    "m365/internal/media"
+    "m365/internal/process"
     "m365/internal/store"
 
     "github.com/google/uuid"
 	"github.com/go-chi/chi/v5"
     "github.com/go-webauthn/webauthn/webauthn"
-    goexif "github.com/rwcarlsen/goexif/exif"
-    "github.com/rwcarlsen/goexif/tiff"
-    "github.com/disintegration/imaging"
 )
 
 type Handler struct {
 	DB      *sql.DB
     Auth    *auth.Service
     Photos  *store.PhotoStore
+    Blobs   blob.Store
+    Usage   *store.UsageStore
+    Renditions *store.RenditionStore
+    Palettes   *store.PaletteStore
+    Exif       *store.ExifStore
+    // Queue runs processing of stored originals in the background
+    Queue *jobs.Queue
+    // ResizeCache holds /api/media results; nil disables the endpoint
+    ResizeCache blob.Store
+    // ResizeSizes is the allow-list of widths and heights /api/media accepts
+    ResizeSizes []int
+    resizeSlots chan struct{}
+    resizeMu    sync.Mutex
+    resizing    map[string]*resizeCall
+    // QuotaBytes caps what one user may store; 0 means unlimited
+    QuotaBytes int64
+    // Upload limits: total request size and width*height before decode
+    MaxUploadBytes int64
+    MaxPixels      int
+    // Resumable uploads: partial data lives in ResumableDir ("" disables
+    // them) until ResumableExpiry passes without a new chunk
+    Uploads         *store.UploadStore
+    ResumableDir    string
+    ResumableExpiry time.Duration
+    uploadsMu       sync.Mutex
+    uploadsBusy     map[string]bool
     // Simple session store: username -> session data
     Sessions map[string]webauthn.SessionData 
 }
 
-func NewHandler(db *sql.DB, auth *auth.Service) *Handler {
+func NewHandler(db *sql.DB, auth *auth.Service, blobs blob.Store) *Handler {
 	return &Handler{
         DB:      db,
         Auth:    auth,
+        Blobs:   blobs,
+        Usage:   store.NewUsageStore(db),
         Photos:  store.NewPhotoStore(db),
+        Renditions: store.NewRenditionStore(db),
+        Palettes:   store.NewPaletteStore(db),
+        Exif:       store.NewExifStore(db),
+        MaxUploadBytes: 64 << 20,
+        MaxPixels:      media.DefaultMaxPixels,
+        Uploads:         store.NewUploadStore(db),
+        ResumableDir:    "incoming",
+        ResumableExpiry: DefaultResumableExpiry,
+        uploadsBusy:     make(map[string]bool),
+        ResizeSizes: DefaultResizeSizes,
+        resizeSlots: make(chan struct{}, runtime.NumCPU()),
+        resizing:    make(map[string]*resizeCall),
         Sessions: make(map[string]webauthn.SessionData),
     }
 }
 
 func (h *Handler) RegisterRoutes(r chi.Router) {
+	r.Get(blob.URLPrefix+"*", h.ServeMedia)
+	r.Head(blob.URLPrefix+"*", h.ServeMedia)
+
 	r.Route("/api", func(r chi.Router) {
 		r.Get("/photos", h.ListPhotos)
+        r.Get("/media/{id}", h.ResizeMedia)
+        r.Head("/media/{id}", h.ResizeMedia)
+        r.Get("/photos/similar", h.SimilarPhotos)
+        r.Get("/photos/color", h.ColorSearch)
+        if h.ResumableDir != "" {
+            r.With(tusResumable).Options("/uploads", h.TusOptions)
+        }
         r.Group(func(r chi.Router) {
             r.Use(h.RequireAuth)
             r.Post("/photos", h.UploadPhoto)
+            if h.ResumableDir != "" {
+                r.With(tusResumable).Post("/uploads", h.CreateUpload)
+                r.With(tusResumable).Head("/uploads/{id}", h.UploadOffset)
+                r.Get("/uploads/{id}", h.UploadResult)
+                r.With(tusResumable).Patch("/uploads/{id}", h.PatchUpload)
+                r.With(tusResumable).Delete("/uploads/{id}", h.TerminateUpload)
+            }
+            r.Delete("/photos/{day}", h.DeletePhoto)
+            r.Get("/usage", h.GetUsage)
+            r.Get("/settings", h.GetSettings)
+            r.Put("/settings", h.PutSettings)
             r.Get("/auth/status", func(w http.ResponseWriter, r *http.Request) {
                 w.Write([]byte(`{"status":"authenticated"}`))
             })
@@ -64,139 +133,636 @@ func (h *Handler) ListPhotos(w http.ResponseWriter, r *http.Request) {
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
+    }
+    ids := make([]string, len(photos))
+    for i := range photos {
+        ids[i] = photos[i].ID
+    }
+    renditions, err := h.Renditions.ForPhotos(ids)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    palettes, err := h.Palettes.ForPhotos(ids)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    exif, err := h.Exif.ForPhotos(ids)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    for i := range photos {
+        photos[i].Renditions = renditions[photos[i].ID]
+        photos[i].Palette = palettes[photos[i].ID]
+        photos[i].Exif = exif[photos[i].ID]
     }
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(photos)
 }
 
-func (h *Handler) UploadPhoto(w http.ResponseWriter, r *http.Request) {
-    // 10MB limit
-    r.ParseMultipartForm(10 << 20) 
+type similarPair struct {
+    A        string // day
+    B        string // day
+    Distance int    // differing dHash bits
+    Exact    bool   // same original bytes
+}
+
+// SimilarPhotos lists pairs of photos whose perceptual hashes differ by at
+// most ?threshold bits (default 10), closest first.
+func (h *Handler) SimilarPhotos(w http.ResponseWriter, r *http.Request) {
+    threshold := 10
+    if v := r.URL.Query().Get("threshold"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 0 || n > 64 {
+            http.Error(w, "threshold must be 0-64", http.StatusBadRequest)
+            return
+        }
+        threshold = n
+    }
 
-    file, handler, err := r.FormFile("photo")
+    photos, err := h.Photos.All()
     if err != nil {
-        http.Error(w, "Error retrieving file", http.StatusBadRequest)
+        http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
-    defer file.Close()
 
-    day := r.FormValue("day")
-    if day == "" {
-        day = time.Now().Format("2006-01-02")
+    type hashed struct {
+        p    *store.Photo
+        hash uint64
+    }
+    var list []hashed
+    for i := range photos {
+        hash, err := media.ParseHash(photos[i].PHash)
+        if err != nil {
+            continue // not hashed yet
+        }
+        list = append(list, hashed{&photos[i], hash})
     }
 
-    // Save file
-    id := uuid.New().String()
-    filename := fmt.Sprintf("%s%s", id, filepath.Ext(handler.Filename))
-    outPath := filepath.Join("uploads", filename)
-    
-    // Ensure upload dir exists
-    os.MkdirAll("uploads", 0755)
+    pairs := []similarPair{}
+    for i := 0; i < len(list); i++ {
+        for j := i + 1; j < len(list); j++ {
+            d := media.HashDistance(list[i].hash, list[j].hash)
+            if d > threshold {
+                continue
+            }
+            a, b := list[i].p, list[j].p
+            pairs = append(pairs, similarPair{
+                A: a.Day, B: b.Day, Distance: d,
+                Exact: a.SHA256 != "" && a.SHA256 == b.SHA256,
+            })
+        }
+    }
+    sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].Distance < pairs[j].Distance })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pairs)
+}
+
+type colorResult struct {
+    Day           string
+    ID            string
+    ThumbnailPath string
+    Color         string  // the matching palette color
+    Weight        float64 // its share of the photo
+    Distance      float64
+}
 
-    dst, err := os.Create(outPath)
+// ColorSearch lists photos whose palette has a color close to ?hex=, nearest
+// first. distance is the largest CIE76 ΔE accepted (default 20; ~2.3 is just
+// noticeable), min_weight ignores colors covering less of the photo (default 0.05).
+func (h *Handler) ColorSearch(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    l, a, b, err := media.ParseHexColor(q.Get("hex"))
     if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+        http.Error(w, err.Error(), http.StatusBadRequest)
         return
     }
-    defer dst.Close()
+    distance, minWeight, limit := 20.0, 0.05, 50
+    if v := q.Get("distance"); v != "" {
+        if distance, err = strconv.ParseFloat(v, 64); err != nil || distance < 0 || distance > 100 {
+            http.Error(w, "distance must be 0-100", http.StatusBadRequest)
+            return
+        }
+    }
+    if v := q.Get("min_weight"); v != "" {
+        if minWeight, err = strconv.ParseFloat(v, 64); err != nil || minWeight < 0 || minWeight > 1 {
+            http.Error(w, "min_weight must be 0-1", http.StatusBadRequest)
+            return
+        }
+    }
+    if v := q.Get("limit"); v != "" {
+        if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > 365 {
+            http.Error(w, "limit must be 1-365", http.StatusBadRequest)
+            return
+        }
+    }
 
-    if _, err := io.Copy(dst, file); err != nil {
+    matches, err := h.Palettes.Near(l, a, b, distance, minWeight, limit)
+    if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
+    results := []colorResult{}
+    for _, m := range matches {
+        p, err := h.Photos.GetByID(m.PhotoID)
+        if err != nil {
+            continue // deleted meanwhile
+        }
+        results = append(results, colorResult{
+            Day: p.Day, ID: p.ID, ThumbnailPath: p.ThumbnailPath,
+            Color: m.Color, Weight: m.Weight, Distance: m.Distance,
+        })
+    }
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
 
-    // Extract EXIF
-    file.Seek(0, 0)
-    var lat, lon float64
-    var exifJson []byte
-    var orientation int
-    
-    x, err := goexif.Decode(file)
-    if err == nil {
-        // Try get coords
-        if latVal, lonVal, err := x.LatLong(); err == nil {
-            lat = latVal
-            lon = lonVal
+func (h *Handler) UploadPhoto(w http.ResponseWriter, r *http.Request) {
+    r.Body = http.MaxBytesReader(w, r.Body, h.MaxUploadBytes)
+    // 10MB in memory, rest spills to temp files
+    if err := r.ParseMultipartForm(10 << 20); err != nil {
+        var tooBig *http.MaxBytesError
+        if errors.As(err, &tooBig) {
+            http.Error(w, fmt.Sprintf("Upload exceeds %d bytes", h.MaxUploadBytes), http.StatusRequestEntityTooLarge)
+            return
         }
-        
-        // Get orientation
-        if o, err := x.Get(goexif.Orientation); err == nil {
-             if val, err := o.Int(0); err == nil {
-                 orientation = val
-             }
+        http.Error(w, "Invalid multipart form: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    file, fileHeader, err := r.FormFile("photo")
+    if err != nil {
+        http.Error(w, "Error retrieving file", http.StatusBadRequest)
+        return
+    }
+    defer file.Close()
+    in := photoUpload{
+        File: file, Size: fileHeader.Size,
+        Day: r.FormValue("day"), DayPolicy: r.FormValue("day_policy"), Notes: r.FormValue("notes"),
+    }
+
+    // A Live Photo's motion clip comes along with the still as "live"
+    if f, fh, err := r.FormFile("live"); err == nil {
+        defer f.Close()
+        in.Live, in.LiveSize = f, fh.Size
+    }
+    resp, fail := h.savePhoto(r, in)
+    if fail != nil {
+        fail.write(w)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(resp)
+}
+
+// photoUpload is an original (and a Live Photo's clip) received whole, by
+// multipart POST or a finished resumable upload, with its form values.
+type photoUpload struct {
+    File     io.ReadSeeker
+    Size     int64
+    Live     io.ReadSeeker // nil unless the still has a motion clip
+    LiveSize int64
+    Day, DayPolicy, Notes string
+}
+
+// uploadFailure is why savePhoto refused an upload: a day conflict, which
+// the client can resolve, or an error message and status.
+type uploadFailure struct {
+    Status   int
+    Msg      string
+    Conflict *dayConflict
+}
+
+func (f *uploadFailure) write(w http.ResponseWriter) {
+    if f.Conflict != nil {
+        f.Conflict.write(w)
+        return
+    }
+    http.Error(w, f.Msg, f.Status)
+}
+
+// savePhoto validates and stores an upload and queues its processing. The
+// caller writes the response.
+func (h *Handler) savePhoto(r *http.Request, in photoUpload) (*uploadResponse, *uploadFailure) {
+    fail := func(msg string, status int) (*uploadResponse, *uploadFailure) {
+        return nil, &uploadFailure{Status: status, Msg: msg}
+    }
+    file := in.File
+
+    // Validate content before anything touches disk
+    format, _, err := media.CheckImage(file, h.MaxPixels)
+    if err == nil && format == media.FormatHEIC && !media.HEIFDecoderAvailable() {
+        err = media.ErrNoHEIFDecoder
+    }
+    if err != nil {
+        return nil, uploadError(err)
+    }
+    file.Seek(0, io.SeekStart)
+
+    live := in.Live
+    var liveFormat media.Format
+    var liveInfo *media.VideoInfo
+    if live != nil {
+        if format.IsVideo() {
+            return fail("live is only accepted with a still photo", http.StatusBadRequest)
         }
-        
-        // Serialize relevant tags (simplified)
-        ew := &exifWalker{exifMap: make(map[string]string)}
-        x.Walk(ew)
-        exifJson, _ = json.Marshal(ew.exifMap)
-
-        // Try to get time from EXIF
-        if tm, err := x.DateTime(); err == nil {
-            day = tm.Format("2006-01-02")
+        liveFormat, _, err = media.CheckImage(live, h.MaxPixels)
+        if err == nil && !liveFormat.IsVideo() {
+            err = media.ErrUnsupportedFormat
         }
+        if err == nil {
+            live.Seek(0, io.SeekStart)
+            liveInfo, err = media.ParseVideo(live)
+        }
+        if err != nil {
+            return fail("live must be an MP4 or MOV clip: "+err.Error(), http.StatusUnsupportedMediaType)
+        }
+        live.Seek(0, io.SeekStart)
     }
 
-    // Generate Thumbnail
-    var thumbnailPath string
-    // Re-open fresh for imaging to handle decoding logic safely
-    thumbImg, err := imaging.Open(outPath)
-    if err == nil {
-        // Apply rotation based on EXIF
-        // 1: Normal
-        // 3: 180 rotate
-        // 6: 270 rotate (Rotate 90 CW -> Rotate270 CCW)
-        // 8: 90 rotate (Rotate 90 CCW -> Rotate90 CCW)
-        
-        switch orientation {
-        case 3:
-            thumbImg = imaging.Rotate180(thumbImg)
-        case 6:
-            // Orientation 6 = Camera rotated 90 CCW (Portrait). Needs 90 CW.
-            // imaging.Rotate270 is 270 CCW = 90 CW.
-            thumbImg = imaging.Rotate270(thumbImg)
-        case 8:
-            // Orientation 8 = Camera rotated 90 CW. Needs 90 CCW.
-            thumbImg = imaging.Rotate90(thumbImg)
+    userID := UserID(r)
+    prefs, err := h.Auth.Settings(userID)
+    if err != nil && !errors.Is(err, sql.ErrNoRows) {
+        return fail(err.Error(), http.StatusInternalServerError)
+    }
+    requested := in.Day
+    if !validDay(requested) {
+        return fail("day must be YYYY-MM-DD", http.StatusBadRequest)
+    }
+    policy := in.DayPolicy
+    if policy == "" {
+        policy = prefs.DayPolicy
+    }
+    if policy == "" {
+        policy = DayPolicyExif
+    }
+    if !validDayPolicy(policy) {
+        return fail("day_policy must be exif, client or reject", http.StatusBadRequest)
+    }
+
+    // The capture day is needed now; everything else comes from the job
+    loc := userLocation(prefs.Timezone)
+    var detected string
+    var duration float64
+    if format.IsVideo() {
+        if info, err := media.ParseVideo(file); err == nil {
+            detected, _ = process.VideoCaptureDay(info, loc)
+            duration = info.Duration.Seconds()
+        }
+    } else if x, err := process.DecodeExif(format, file); err == nil {
+        detected, _ = process.CaptureDay(x)
+    }
+    if liveInfo != nil {
+        if detected == "" {
+            detected, _ = process.VideoCaptureDay(liveInfo, loc)
         }
+        duration = liveInfo.Duration.Seconds()
+    }
+    file.Seek(0, io.SeekStart)
+    day, source, conflict := chooseDay(requested, detected, policy)
+    if conflict != nil {
+        return nil, &uploadFailure{Status: http.StatusConflict, Conflict: conflict}
+    }
+    if day == "" {
+        day = time.Now().In(loc).Format("2006-01-02")
+        source = DaySourceToday
+    }
 
-        thumb := imaging.Fill(thumbImg, 400, 400, imaging.Center, imaging.Lanczos)
-        thumbName := fmt.Sprintf("%s_thumb.jpg", id)
-        thumbOutPath := filepath.Join("uploads", thumbName)
-        if err := imaging.Save(thumb, thumbOutPath); err == nil {
-             thumbnailPath = "/" + thumbOutPath
+    // Content-addressed originals: identical bytes are stored once
+    sum, err := hashFile(file)
+    if err != nil {
+        return fail(err.Error(), http.StatusInternalServerError)
+    }
+    var liveKey string
+    if live != nil {
+        liveSum, err := hashFile(live)
+        if err != nil {
+            return fail(err.Error(), http.StatusInternalServerError)
+        }
+        liveKey = liveSum + liveFormat.Ext()
+    }
+
+    var duplicate *store.Photo
+    if dup, err := h.Photos.GetBySHA256(sum); err == nil {
+        duplicate = dup
+    } else if !errors.Is(err, sql.ErrNoRows) {
+        return fail(err.Error(), http.StatusInternalServerError)
+    }
+
+    id := uuid.New().String()
+    ctx := r.Context()
+    origKey := sum + format.Ext()
+
+    // Quota: originals count unless this user already stores the same bytes
+    if h.QuotaBytes > 0 {
+        var needed int64
+        for key, size := range map[string]int64{origKey: in.Size, liveKey: in.LiveSize} {
+            if has, err := h.Usage.Has(userID, key); key != "" && (err != nil || !has) {
+                needed += size
+            }
+        }
+        usage, err := h.Usage.ForUser(userID)
+        if err != nil {
+            return fail(err.Error(), http.StatusInternalServerError)
+        }
+        if usage.Bytes+needed > h.QuotaBytes {
+            return fail(fmt.Sprintf("Storage quota exceeded: %d of %d bytes used", usage.Bytes, h.QuotaBytes), http.StatusRequestEntityTooLarge)
         }
     }
 
-    // TODO: Resize original if too large? For now, keep original.
+    // The original is removed unless the row is saved
+    var written []string
+    saved := false
+    defer func() {
+        if !saved {
+            for _, key := range written {
+                h.Blobs.Delete(context.Background(), key)
+            }
+        }
+    }()
+
+    put := func(key string, r io.Reader) error {
+        if _, err := h.Blobs.Stat(ctx, key); !errors.Is(err, blob.ErrNotFound) {
+            return err
+        }
+        // Put is atomic: the original is durable before the row exists
+        if err := h.Blobs.Put(ctx, key, r); err != nil {
+            return err
+        }
+        written = append(written, key)
+        return nil
+    }
+    if err := put(origKey, file); err != nil {
+        return fail(err.Error(), http.StatusInternalServerError)
+    }
+    if live != nil {
+        if err := put(liveKey, live); err != nil {
+            return fail(err.Error(), http.StatusInternalServerError)
+        }
+    }
 
     p := &store.Photo{
         Day: day,
         ID: id,
-        Filepath: "/" + outPath,
-        ThumbnailPath: thumbnailPath,
-        Notes: r.FormValue("notes"),
-        Lat: lat,
-        Lon: lon,
-        ExifData: string(exifJson),
+        Filepath: blob.URL(origKey),
+        Notes: in.Notes,
+        SHA256: sum,
+        Format: string(format),
+        Duration: duration,
+        Status: store.StatusProcessing,
+        UserID: userID,
         CreatedAt: time.Now(),
     }
+    if live != nil {
+        p.LiveVideo = blob.URL(liveKey)
+    }
 
+    // A photo already on this day is replaced; its resizes are unreachable
+    replaced, err := h.Photos.GetByDay(day)
+    if err != nil && !errors.Is(err, sql.ErrNoRows) {
+        return fail(err.Error(), http.StatusInternalServerError)
+    }
     if err := h.Photos.Save(p); err != nil {
+        return fail(err.Error(), http.StatusInternalServerError)
+    }
+    saved = true
+    if replaced != nil {
+        h.dropResized(ctx, replaced.ID)
+    }
+
+    if err := h.Usage.Record(userID, origKey, store.KindOriginal, in.Size); err != nil {
+        log.Printf("usage: %v", err)
+    }
+    if live != nil {
+        if err := h.Usage.Record(userID, liveKey, store.KindOriginal, in.LiveSize); err != nil {
+            log.Printf("usage: %v", err)
+        }
+    }
+    // The row stays "processing" if this fails; admin reprocess picks it up
+    if err := h.Queue.Enqueue(process.Kind, p.ID); err != nil {
+        log.Printf("enqueue %s: %v", p.ID, err)
+    }
+
+    resp := uploadResponse{
+        ID: p.ID, Day: p.Day, SHA256: sum, Status: p.Status,
+        RequestedDay: requested, DetectedDay: detected, DaySource: source,
+    }
+    if duplicate != nil {
+        resp.Duplicate = &duplicateInfo{ID: duplicate.ID, Day: duplicate.Day}
+    }
+    return &resp, nil
+}
+
+// hashFile returns the hex SHA-256 of r's content and rewinds it.
+func hashFile(r io.ReadSeeker) (string, error) {
+    hash := sha256.New()
+    if _, err := io.Copy(hash, r); err != nil {
+        return "", err
+    }
+    if _, err := r.Seek(0, io.SeekStart); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+type uploadResponse struct {
+    ID        string
+    // Day is the slot used; RequestedDay and DetectedDay are the form's day
+    // and the capture date, when there were any
+    Day          string
+    RequestedDay string `json:",omitempty"`
+    DetectedDay  string `json:",omitempty"`
+    DaySource    string // client, exif or today
+    SHA256    string
+    // Status is "processing" until renditions and metadata are ready
+    Status    string
+    // Duplicate is set when the same bytes were already uploaded
+    Duplicate *duplicateInfo `json:",omitempty"`
+}
+
+type duplicateInfo struct {
+    ID  string
+    Day string
+}
+
+// DeletePhoto removes a day's photo and its media. The original is kept while
+// another day still references the same content.
+func (h *Handler) DeletePhoto(w http.ResponseWriter, r *http.Request) {
+    day := chi.URLParam(r, "day")
+    p, err := h.Photos.GetByDay(day)
+    if errors.Is(err, sql.ErrNoRows) {
+        http.Error(w, "Photo not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    if err := h.Photos.Delete(day); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    // Row is gone; media cleanup failures only leave orphans for `admin check`
+    ctx := r.Context()
+    renditions, err := h.Renditions.ForPhoto(p.ID)
+    if err != nil {
+        log.Printf("renditions %s: %v", p.ID, err)
+    }
+    for _, rd := range renditions {
+        for _, u := range rd.URLs() {
+            if u != p.ThumbnailPath {
+                h.deleteBlob(ctx, blob.KeyFromURL(u))
+            }
+        }
+    }
+    if err := h.Renditions.DeleteForPhoto(p.ID); err != nil {
+        log.Printf("renditions %s: %v", p.ID, err)
+    }
+    if err := h.Palettes.DeleteForPhoto(p.ID); err != nil {
+        log.Printf("palette %s: %v", p.ID, err)
+    }
+    if err := h.Exif.DeleteForPhoto(p.ID); err != nil {
+        log.Printf("exif %s: %v", p.ID, err)
+    }
+    if p.ThumbnailPath != "" {
+        h.deleteBlob(ctx, blob.KeyFromURL(p.ThumbnailPath))
+    }
+    h.dropResized(ctx, p.ID)
+    for _, orig := range []string{p.Filepath, p.LiveVideo} {
+        if orig == "" {
+            continue
+        }
+        origKey := blob.KeyFromURL(orig)
+        if n, err := h.Photos.CountByFilepath(orig); err == nil && n == 0 {
+            h.deleteBlob(ctx, origKey)
+        } else if n, err := h.Photos.CountByUserFilepath(p.UserID, orig); err == nil && n == 0 {
+            h.Usage.Forget(p.UserID, origKey)
+        }
+    }
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteBlob removes a stored object and its usage entries, logging failures.
+func (h *Handler) deleteBlob(ctx context.Context, key string) {
+    if err := h.Blobs.Delete(ctx, key); err != nil {
+        log.Printf("delete %s: %v", key, err)
+        return
+    }
+    if err := h.Usage.ForgetKey(key); err != nil {
+        log.Printf("usage: %v", err)
+    }
+}
+
+type usageResponse struct {
+    store.Usage
+    QuotaBytes int64 // 0 = unlimited
+}
+
+// GetUsage reports the signed-in user's stored bytes and quota.
+func (h *Handler) GetUsage(w http.ResponseWriter, r *http.Request) {
+    usage, err := h.Usage.ForUser(UserID(r))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(usageResponse{Usage: usage, QuotaBytes: h.QuotaBytes})
+}
+
+type settings struct {
+    auth.Settings
+    DefaultTimezone string `json:",omitempty"` // the server's, read-only
+}
+
+// GetSettings returns the signed-in user's settings.
+func (h *Handler) GetSettings(w http.ResponseWriter, r *http.Request) {
+    prefs, err := h.Auth.Settings(UserID(r))
+    if err != nil && !errors.Is(err, sql.ErrNoRows) {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
+    def := time.Local.String()
+    if def == "Local" { // from /etc/localtime rather than TZ; the abbreviation is all we know
+        def, _ = time.Now().Zone()
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(settings{Settings: prefs, DefaultTimezone: def})
+}
 
-    w.Write([]byte("Photo uploaded"))
+// PutSettings replaces the signed-in user's settings.
+func (h *Handler) PutSettings(w http.ResponseWriter, r *http.Request) {
+    var s settings
+    if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    // LoadLocation("") is UTC and "Local" the server's zone; neither is a real choice
+    if s.Timezone == "Local" {
+        s.Timezone = ""
+    }
+    if s.Timezone != "" {
+        if _, err := time.LoadLocation(s.Timezone); err != nil {
+            http.Error(w, fmt.Sprintf("unknown time zone %q", s.Timezone), http.StatusBadRequest)
+            return
+        }
+    }
+    if s.DayPolicy != "" && !validDayPolicy(s.DayPolicy) {
+        http.Error(w, "DayPolicy must be exif, client or reject", http.StatusBadRequest)
+        return
+    }
+    if err := h.Auth.SaveSettings(UserID(r), s.Settings); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    h.GetSettings(w, r)
 }
 
-type exifWalker struct {
-    exifMap map[string]string
+// ServeMedia streams a stored blob with Range and conditional request support.
+// Renditions stored in several formats are negotiated on the Accept header.
+func (h *Handler) ServeMedia(w http.ResponseWriter, r *http.Request) {
+    key := chi.URLParam(r, "*")
+    served := key
+    if rd, err := h.Renditions.ByURL(blob.URL(key)); err == nil && len(rd.Formats) > 0 {
+        w.Header().Add("Vary", "Accept")
+        if f := negotiateFormat(r.Header.Get("Accept"), rd.Formats); f != "" {
+            served = blob.KeyFromURL(rd.URLFor(f))
+        }
+    }
+    obj, info, err := h.Blobs.Get(r.Context(), served)
+    if err != nil && served != key {
+        // Alternate went missing; the JPEG is always there
+        served = key
+        obj, info, err = h.Blobs.Get(r.Context(), served)
+    }
+    if err != nil {
+        http.NotFound(w, r)
+        return
+    }
+    defer obj.Close()
+    http.ServeContent(w, r, served, info.ModTime, obj)
 }
 
-func (w *exifWalker) Walk(name goexif.FieldName, tag *tiff.Tag) error {
-    w.exifMap[string(name)] = tag.String()
-	return nil
+// uploadError maps media validation errors to client-facing statuses.
+func uploadError(err error) *uploadFailure {
+    msg, status := err.Error(), http.StatusInternalServerError
+    switch {
+    case errors.Is(err, media.ErrUnsupportedFormat):
+        msg, status = "Unsupported file type: only JPEG, PNG, GIF, WebP, HEIC, camera RAW (DNG, CR2, CR3, NEF, ARW, PEF) and MP4/MOV video are accepted", http.StatusUnsupportedMediaType
+    case errors.Is(err, media.ErrNoHEIFDecoder):
+        msg, status = "HEIC uploads are not enabled on this server", http.StatusUnsupportedMediaType
+    case errors.Is(err, media.ErrTooManyPixels):
+        status = http.StatusRequestEntityTooLarge
+    case errors.Is(err, media.ErrNoPreview), errors.Is(err, media.ErrCorrupt):
+        status = http.StatusUnprocessableEntity
+    }
+    return &uploadFailure{Status: status, Msg: msg}
 }
 
 // --- Auth ---
@@ -337,12 +903,22 @@ func (h *Handler) RequireAuth(next http.Handler) http.Handler {
             return
         }
 
-        valid, err := h.Auth.ValidateSession(c.Value)
-        if err != nil || !valid {
+        userID, err := h.Auth.SessionUser(c.Value)
+        if err != nil {
             http.Error(w, "Unauthorized", http.StatusUnauthorized)
             return
         }
 
-        next.ServeHTTP(w, r)
+        next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, userID)))
     })
 }
+
+type ctxKey int
+
+const userKey ctxKey = 0
+
+// UserID returns the signed-in user set by RequireAuth.
+func UserID(r *http.Request) string {
+    id, _ := r.Context().Value(userKey).(string)
+    return id
+}
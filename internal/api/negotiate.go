@@ -0,0 +1,51 @@
+package api
+
+import (
+	"strconv"
+	"strings"
+)
+
+// negotiateFormat picks the best of the available rendition formats ("avif",
+// "webp") the client explicitly accepts, or "" for the JPEG. Wildcards such as
+// */* don't count: clients that send only those may not decode WebP or AVIF.
+func negotiateFormat(accept string, available []string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mime := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(k, "q") {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		for _, f := range available {
+			if mime != "image/"+f {
+				continue
+			}
+			// Ties go to the earlier (smaller) format in preferredFormats
+			if q > bestQ || (q == bestQ && formatRank(f) < formatRank(best)) {
+				best, bestQ = f, q
+			}
+		}
+	}
+	return best
+}
+
+// preferredFormats orders rendition formats by typical size, smallest first.
+var preferredFormats = []string{"avif", "webp"}
+
+func formatRank(f string) int {
+	for i, p := range preferredFormats {
+		if p == f {
+			return i
+		}
+	}
+	return len(preferredFormats)
+}
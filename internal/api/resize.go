@@ -0,0 +1,252 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"m365/internal/blob"
+	"m365/internal/media"
+	"m365/internal/store"
+
+	"github.com/disintegration/imaging"
+	"github.com/go-chi/chi/v5"
+)
+
+// DefaultResizeSizes are the widths and heights /api/media accepts. Anything
+// else is rejected so clients can't fill the cache with arbitrary sizes.
+var DefaultResizeSizes = []int{64, 128, 256, 400, 640, 800, 1080, 1280, 1600, 2048}
+
+// resizeVersion is folded into cache keys and ETags; bump it when the
+// resizing or encoding changes so cached bytes are never served as current.
+const resizeVersion = "1"
+
+// ParseResizeSizes reads a comma-separated list of pixel sizes.
+func ParseResizeSizes(s string) ([]int, error) {
+	var sizes []int
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		n, err := strconv.Atoi(f)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid size %q", f)
+		}
+		sizes = append(sizes, n)
+	}
+	if len(sizes) == 0 {
+		return nil, errors.New("no sizes")
+	}
+	slices.Sort(sizes)
+	return sizes, nil
+}
+
+type resizeParams struct {
+	w, h int
+	// fit is "contain" (within w x h, aspect kept) or "cover" (cropped to exactly w x h)
+	fit string
+}
+
+func (h *Handler) parseResize(r *http.Request) (resizeParams, error) {
+	q := r.URL.Query()
+	p := resizeParams{fit: q.Get("fit")}
+	if p.fit == "" {
+		p.fit = "contain"
+	}
+	if p.fit != "contain" && p.fit != "cover" {
+		return p, fmt.Errorf("fit must be contain or cover")
+	}
+	for _, d := range []struct {
+		name string
+		dst  *int
+	}{{"w", &p.w}, {"h", &p.h}} {
+		v := q.Get(d.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || !slices.Contains(h.ResizeSizes, n) {
+			return p, fmt.Errorf("%s must be one of %s", d.name, joinInts(h.ResizeSizes))
+		}
+		*d.dst = n
+	}
+	if p.w == 0 && p.h == 0 {
+		return p, errors.New("w or h is required")
+	}
+	if p.fit == "cover" && (p.w == 0 || p.h == 0) {
+		return p, errors.New("fit=cover needs both w and h")
+	}
+	return p, nil
+}
+
+// ResizeMedia serves a photo's original scaled to an allowed size; for a
+// video, its poster frame. Results are cached in ResizeCache keyed by photo,
+// content and parameters, and carry a strong ETag derived from the same key.
+func (h *Handler) ResizeMedia(w http.ResponseWriter, r *http.Request) {
+	if h.ResizeCache == nil {
+		http.NotFound(w, r)
+		return
+	}
+	params, err := h.parseResize(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p, err := h.Photos.GetByID(chi.URLParam(r, "id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The original's hash is part of the key: a re-uploaded day never hits stale entries
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%s|%s", p.SHA256, params.w, params.h, params.fit, resizeVersion)))
+	tag := hex.EncodeToString(sum[:16])
+	key := fmt.Sprintf("%s/%dx%d_%s_%s.jpg", p.ID, params.w, params.h, params.fit, tag)
+
+	ctx := r.Context()
+	obj, info, err := h.ResizeCache.Get(ctx, key)
+	// Resizes cached before encryption was enabled are just made again
+	if errors.Is(err, blob.ErrNotFound) || errors.Is(err, blob.ErrPlaintext) {
+		if err = h.resize(ctx, p, params, key); err == nil {
+			obj, info, err = h.ResizeCache.Get(ctx, key)
+		}
+	}
+	if errors.Is(err, errNoPoster) {
+		http.Error(w, "Video has no poster frame to resize", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		log.Printf("resize %s: %v", key, err)
+		http.Error(w, "Could not resize image", http.StatusInternalServerError)
+		return
+	}
+	defer obj.Close()
+
+	w.Header().Set("ETag", `"`+tag+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, key, info.ModTime, obj)
+}
+
+// errNoPoster means a video has no poster frame to resize.
+var errNoPoster = errors.New("video has no poster")
+
+// resizeCall is one render in progress; err is set before done is closed.
+type resizeCall struct {
+	done chan struct{}
+	err  error
+}
+
+// resize renders one cache entry. Concurrent requests for the same key wait
+// for a single render and get its error, and at most cap(resizeSlots)
+// renders run at once.
+func (h *Handler) resize(ctx context.Context, p *store.Photo, params resizeParams, key string) (err error) {
+	h.resizeMu.Lock()
+	if call, ok := h.resizing[key]; ok {
+		h.resizeMu.Unlock()
+		select {
+		case <-call.done:
+			// The leader's request went away; that says nothing about ours
+			if errors.Is(call.err, context.Canceled) || errors.Is(call.err, context.DeadlineExceeded) {
+				return h.resize(ctx, p, params, key)
+			}
+			return call.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	call := &resizeCall{done: make(chan struct{})}
+	h.resizing[key] = call
+	h.resizeMu.Unlock()
+	defer func() {
+		call.err = err
+		h.resizeMu.Lock()
+		delete(h.resizing, key)
+		h.resizeMu.Unlock()
+		close(call.done)
+	}()
+
+	select {
+	case h.resizeSlots <- struct{}{}:
+		defer func() { <-h.resizeSlots }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// A video is resized from its largest rendition, made from the poster frame
+	srcURL, format := p.Filepath, media.Format(p.Format)
+	if format.IsVideo() {
+		rds, err := h.Renditions.ForPhoto(p.ID)
+		if err != nil {
+			return err
+		}
+		if len(rds) == 0 {
+			return errNoPoster
+		}
+		srcURL, format = rds[len(rds)-1].URL, media.FormatJPEG
+	}
+	src, _, err := h.Blobs.Get(ctx, blob.KeyFromURL(srcURL))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	img, _, err := media.DecodeUpright(ctx, format, src)
+	if err != nil {
+		return err
+	}
+
+	var out image.Image
+	switch {
+	case params.fit == "cover":
+		out = imaging.Fill(img, params.w, params.h, imaging.Center, imaging.Lanczos)
+	case params.w == 0:
+		out = imaging.Fit(img, img.Bounds().Dx(), params.h, imaging.Lanczos)
+	case params.h == 0:
+		out = imaging.Fit(img, params.w, img.Bounds().Dy(), imaging.Lanczos)
+	default:
+		out = imaging.Fit(img, params.w, params.h, imaging.Lanczos)
+	}
+
+	var buf bytes.Buffer
+	if err := media.JPEGEncoder.Encode(ctx, &buf, out); err != nil {
+		return err
+	}
+	return h.ResizeCache.Put(ctx, key, &buf)
+}
+
+// dropResized removes a photo's cached resizes.
+func (h *Handler) dropResized(ctx context.Context, photoID string) {
+	if h.ResizeCache == nil {
+		return
+	}
+	infos, err := h.ResizeCache.List(ctx, photoID+"/")
+	if err != nil {
+		log.Printf("resize cache: %v", err)
+		return
+	}
+	for _, info := range infos {
+		h.ResizeCache.Delete(ctx, info.Key)
+	}
+}
+
+func joinInts(ns []int) string {
+	s := make([]string, len(ns))
+	for i, n := range ns {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DefaultTileSources are the hosts the map view loads OpenStreetMap tiles from.
+var DefaultTileSources = []string{"https://tile.openstreetmap.org"}
+
+type SecurityConfig struct {
+	// CSP replaces the generated Content-Security-Policy entirely when set.
+	CSP string
+	// ImgSources are img-src origins besides the app itself (map tiles etc);
+	// CSP_IMG_SRC adds to DefaultTileSources.
+	ImgSources []string
+	// HSTSMaxAge is sent as Strict-Transport-Security when HTTPS is true. 0 disables it.
+	HSTSMaxAge        int
+	HTTPS             bool
+	ReferrerPolicy    string
+	PermissionsPolicy string
+}
+
+// DefaultSecurityConfig returns a strict policy for the SPA served from origin.
+func DefaultSecurityConfig(origin string) SecurityConfig {
+	return SecurityConfig{
+		ImgSources:     DefaultTileSources,
+		HSTSMaxAge:     31536000, // 1 year
+		HTTPS:          strings.HasPrefix(origin, "https://"),
+		ReferrerPolicy: "strict-origin-when-cross-origin",
+		PermissionsPolicy: strings.Join([]string{
+			"camera=()",
+			"microphone=()",
+			"geolocation=()",
+			"payment=()",
+			"usb=()",
+			"interest-cohort=()",
+			"publickey-credentials-create=(self)",
+			"publickey-credentials-get=(self)",
+		}, ", "),
+	}
+}
+
+func (c SecurityConfig) contentSecurityPolicy() string {
+	if c.CSP != "" {
+		return c.CSP
+	}
+	img := append([]string{"'self'", "data:", "blob:"}, c.ImgSources...)
+	directives := []string{
+		"default-src 'self'",
+		"script-src 'self'",
+		"style-src 'self'",
+		"img-src " + strings.Join(img, " "),
+		"media-src 'self' blob:",
+		"connect-src 'self'",
+		"font-src 'self'",
+		"manifest-src 'self'",
+		"object-src 'none'",
+		"base-uri 'self'",
+		"form-action 'self'",
+		"frame-ancestors 'none'",
+	}
+	if c.HTTPS {
+		directives = append(directives, "upgrade-insecure-requests")
+	}
+	return strings.Join(directives, "; ")
+}
+
+// SecurityHeaders sets CSP, HSTS and related headers on every response.
+func SecurityHeaders(cfg SecurityConfig) func(http.Handler) http.Handler {
+	csp := cfg.contentSecurityPolicy()
+	hsts := ""
+	if cfg.HTTPS && cfg.HSTSMaxAge > 0 {
+		hsts = fmt.Sprintf("max-age=%d", cfg.HSTSMaxAge)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hdr := w.Header()
+			hdr.Set("Content-Security-Policy", csp)
+			hdr.Set("X-Content-Type-Options", "nosniff")
+			hdr.Set("X-Frame-Options", "DENY")
+			if cfg.ReferrerPolicy != "" {
+				hdr.Set("Referrer-Policy", cfg.ReferrerPolicy)
+			}
+			if cfg.PermissionsPolicy != "" {
+				hdr.Set("Permissions-Policy", cfg.PermissionsPolicy)
+			}
+			if hsts != "" {
+				hdr.Set("Strict-Transport-Security", hsts)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,454 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"m365/internal/store"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// Resumable uploads speak tus 1.0.0 (https://tus.io/protocols/resumable-upload)
+// with the creation, expiration and termination extensions. Chunks are
+// appended to a file per upload in ResumableDir; the PATCH that completes
+// one runs it through savePhoto like a multipart upload. That PATCH answers
+// 204 like any other, naming the photo in a Photo-Id header; GET on the
+// upload returns the full upload response until the upload expires.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+)
+
+// DefaultResumableExpiry is how long an upload may sit idle before its
+// partial data is deleted.
+const DefaultResumableExpiry = 24 * time.Hour
+
+// tusResumable rejects requests for another protocol version and stamps
+// every response with ours.
+func tusResumable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			http.Error(w, "Tus-Resumable must be "+tusVersion, http.StatusPreconditionFailed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TusOptions describes what the server supports.
+func (h *Handler) TusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.MaxUploadBytes, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateUpload starts a resumable upload. Upload-Metadata may carry the
+// multipart form's day, day_policy and notes, which are checked now so a
+// bad value doesn't surface only after the last chunk.
+func (h *Handler) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "Upload-Defer-Length is not supported", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "Upload-Length must be a positive number of bytes", http.StatusBadRequest)
+		return
+	}
+	if length > h.MaxUploadBytes {
+		http.Error(w, fmt.Sprintf("Upload exceeds %d bytes", h.MaxUploadBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	meta, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "Invalid Upload-Metadata: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validDay(meta["day"]) {
+		http.Error(w, "day must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	if p := meta["day_policy"]; p != "" && !validDayPolicy(p) {
+		http.Error(w, "day_policy must be exif, client or reject", http.StatusBadRequest)
+		return
+	}
+
+	// Only an estimate: bytes this user already stores don't count twice,
+	// which savePhoto checks exactly once they have all arrived
+	userID := UserID(r)
+	if h.QuotaBytes > 0 {
+		usage, err := h.Usage.ForUser(userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if usage.Bytes+length > h.QuotaBytes {
+			http.Error(w, fmt.Sprintf("Storage quota exceeded: %d of %d bytes used", usage.Bytes, h.QuotaBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+
+	now := time.Now()
+	u := &store.Upload{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Length:    length,
+		Metadata:  meta,
+		CreatedAt: now,
+		ExpiresAt: now.Add(h.ResumableExpiry),
+	}
+	if err := os.MkdirAll(h.ResumableDir, 0700); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f, err := os.OpenFile(h.uploadPath(u.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+	if err := h.Uploads.Create(u); err != nil {
+		os.Remove(h.uploadPath(u.ID))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/api/uploads/"+u.ID)
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// UploadOffset tells a client where to resume, and once the upload is
+// finished, which photo it became.
+func (h *Handler) UploadOffset(w http.ResponseWriter, r *http.Request) {
+	u, offset, ok := h.upload(w, r)
+	if !ok {
+		return
+	}
+	if id := resultPhotoID(u); id != "" {
+		w.Header().Set("Photo-Id", id)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// UploadResult returns the upload response of the photo a finished upload
+// became, as POST /api/photos would have.
+func (h *Handler) UploadResult(w http.ResponseWriter, r *http.Request) {
+	u, _, ok := h.upload(w, r)
+	if !ok {
+		return
+	}
+	if u.Result == "" {
+		http.Error(w, "Upload is not finished", http.StatusConflict)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, u.Result)
+}
+
+// PatchUpload appends a chunk at Upload-Offset. The request that completes
+// the upload stores the photo and, on success, answers 204 with a Photo-Id
+// header. A day conflict is answered with savePhoto's 409 and keeps the
+// upload: an empty PATCH at the final offset with a Day-Policy header
+// finishes it again. Repeating the final PATCH of a finished upload, whose
+// response was lost, gets the same 204 without storing anything.
+func (h *Handler) PatchUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	id := chi.URLParam(r, "id")
+	if !h.claimUpload(id) {
+		http.Error(w, "Upload is busy with another request", http.StatusLocked)
+		return
+	}
+	defer h.releaseUpload(id)
+
+	u, offset, ok := h.upload(w, r)
+	if !ok {
+		return
+	}
+	claimed, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Upload-Offset must be a number of bytes", http.StatusBadRequest)
+		return
+	}
+	if claimed != offset {
+		http.Error(w, fmt.Sprintf("Upload-Offset is %d, not %d", offset, claimed), http.StatusConflict)
+		return
+	}
+	policy := r.Header.Get("Day-Policy")
+	if policy != "" && !validDayPolicy(policy) {
+		http.Error(w, "Day-Policy must be exif, client or reject", http.StatusBadRequest)
+		return
+	}
+	if id := resultPhotoID(u); id != "" {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Photo-Id", id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if offset < u.Length {
+		f, err := os.OpenFile(h.uploadPath(u.ID), os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Whatever arrived before a dropped connection is kept
+		n, err := io.Copy(f, http.MaxBytesReader(w, r.Body, u.Length-offset))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		offset += n
+		u.ExpiresAt = time.Now().Add(h.ResumableExpiry)
+		if terr := h.Uploads.Touch(u.ID, u.ExpiresAt); terr != nil {
+			log.Printf("upload %s: %v", u.ID, terr)
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			http.Error(w, fmt.Sprintf("Chunk runs past Upload-Length %d", u.Length), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if offset < u.Length {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+
+	f, err := os.Open(h.uploadPath(u.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if policy == "" {
+		policy = u.Metadata["day_policy"]
+	}
+	resp, fail := h.savePhoto(r, photoUpload{
+		File: f, Size: u.Length,
+		Day: u.Metadata["day"], DayPolicy: policy, Notes: u.Metadata["notes"],
+	})
+	f.Close()
+	if fail != nil {
+		fail.write(w)
+		// Conflicts can be settled and server errors retried; anything else is final
+		if fail.Status != http.StatusConflict && fail.Status < 500 {
+			if err := h.removeUpload(u.ID); err != nil {
+				log.Printf("upload %s: %v", u.ID, err)
+			}
+		}
+		return
+	}
+
+	// The data is no longer needed; the row keeps the response for GET
+	result, err := json.Marshal(resp)
+	if err == nil {
+		u.ExpiresAt = time.Now().Add(h.ResumableExpiry)
+		err = h.Uploads.Finish(u.ID, string(result), u.ExpiresAt)
+	}
+	if err != nil {
+		log.Printf("upload %s: %v", u.ID, err)
+		err = h.removeUpload(u.ID)
+	} else {
+		err = os.Remove(h.uploadPath(u.ID))
+	}
+	if err != nil {
+		log.Printf("upload %s: %v", u.ID, err)
+	}
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Photo-Id", resp.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TerminateUpload abandons an upload and deletes what arrived of it.
+func (h *Handler) TerminateUpload(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !h.claimUpload(id) {
+		http.Error(w, "Upload is busy with another request", http.StatusLocked)
+		return
+	}
+	defer h.releaseUpload(id)
+
+	u, _, ok := h.upload(w, r)
+	if !ok {
+		return
+	}
+	if err := h.removeUpload(u.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// upload loads the caller's unexpired upload named in the URL and how many
+// bytes of it have arrived; all of them, once finished. Anyone else's is
+// reported as not found.
+func (h *Handler) upload(w http.ResponseWriter, r *http.Request) (*store.Upload, int64, bool) {
+	u, err := h.Uploads.Get(chi.URLParam(r, "id"))
+	if errors.Is(err, sql.ErrNoRows) || err == nil && (u.UserID != UserID(r) || time.Now().After(u.ExpiresAt)) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return nil, 0, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, 0, false
+	}
+	if u.Result != "" {
+		return u, u.Length, true
+	}
+	info, err := os.Stat(h.uploadPath(u.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, 0, false
+	}
+	return u, info.Size(), true
+}
+
+// resultPhotoID is the id of the photo a finished upload became, else "".
+func resultPhotoID(u *store.Upload) string {
+	var resp uploadResponse
+	if u.Result == "" || json.Unmarshal([]byte(u.Result), &resp) != nil {
+		return ""
+	}
+	return resp.ID
+}
+
+func (h *Handler) uploadPath(id string) string {
+	return filepath.Join(h.ResumableDir, id)
+}
+
+// claimUpload keeps two requests from writing one upload at once.
+func (h *Handler) claimUpload(id string) bool {
+	h.uploadsMu.Lock()
+	defer h.uploadsMu.Unlock()
+	if h.uploadsBusy[id] {
+		return false
+	}
+	h.uploadsBusy[id] = true
+	return true
+}
+
+func (h *Handler) releaseUpload(id string) {
+	h.uploadsMu.Lock()
+	delete(h.uploadsBusy, id)
+	h.uploadsMu.Unlock()
+}
+
+func (h *Handler) removeUpload(id string) error {
+	if err := os.Remove(h.uploadPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return h.Uploads.Delete(id)
+}
+
+// ExpireUploads deletes uploads idle past their expiry, and data files left
+// without a row by a crash, returning how many it removed.
+func (h *Handler) ExpireUploads() (int, error) {
+	ids, err := h.Uploads.Expired(time.Now())
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, id := range ids {
+		// One being written right now has just been touched
+		if !h.claimUpload(id) {
+			continue
+		}
+		err := h.removeUpload(id)
+		h.releaseUpload(id)
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	entries, err := os.ReadDir(h.ResumableDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return removed, nil
+	}
+	if err != nil {
+		return removed, err
+	}
+	cutoff := time.Now().Add(-h.ResumableExpiry)
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || e.IsDir() || info.ModTime().After(cutoff) {
+			continue
+		}
+		if _, err := h.Uploads.Get(e.Name()); !errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err := os.Remove(h.uploadPath(e.Name())); err == nil {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// ScheduleUploadExpiry runs ExpireUploads every interval until ctx is done.
+func (h *Handler) ScheduleUploadExpiry(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n, err := h.ExpireUploads()
+			if err != nil {
+				log.Printf("uploads: %v", err)
+			}
+			if n > 0 {
+				log.Printf("uploads: removed %d expired upload(s)", n)
+			}
+		}
+	}
+}
+
+// parseUploadMetadata decodes "key base64value,key2 base64value2"; a key
+// may come without a value.
+func parseUploadMetadata(s string) (map[string]string, error) {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, enc, _ := strings.Cut(pair, " ")
+		val, err := base64.StdEncoding.DecodeString(enc)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		meta[key] = string(val)
+	}
+	return meta, nil
+}
@@ -113,6 +113,27 @@ func (s *Service) SaveUser(user *User) error {
     return err
 }
 
+// Settings are a user's preferences; empty fields use the server's defaults.
+type Settings struct {
+    // Timezone is the IANA name deciding the day of photos without a capture date
+    Timezone  string
+    // DayPolicy decides between the upload form's day and the capture date
+    DayPolicy string
+}
+
+// Settings returns the user's preferences.
+func (s *Service) Settings(userID string) (Settings, error) {
+    var st Settings
+    err := s.db.QueryRow("SELECT timezone, day_policy FROM users WHERE id = ?", userID).Scan(&st.Timezone, &st.DayPolicy)
+    return st, err
+}
+
+// SaveSettings replaces the user's preferences.
+func (s *Service) SaveSettings(userID string, st Settings) error {
+    _, err := s.db.Exec("UPDATE users SET timezone = ?, day_policy = ? WHERE id = ?", st.Timezone, st.DayPolicy, userID)
+    return err
+}
+
 // --- Sessions ---
 
 func (s *Service) CreateSession(userID []byte) (string, error) {
@@ -128,6 +149,13 @@ func (s *Service) ValidateSession(token string) (bool, error) {
     return exists, err
 }
 
+// SessionUser returns the user id for a valid session, or sql.ErrNoRows.
+func (s *Service) SessionUser(token string) (string, error) {
+    var userID string
+    err := s.db.QueryRow("SELECT user_id FROM sessions WHERE token = ? AND expires_at > ?", token, time.Now()).Scan(&userID)
+    return userID, err
+}
+
 // Registration
 func (s *Service) BeginRegistration(user *User) (*protocol.CredentialCreation, *webauthn.SessionData, error) {
 	return s.wan.BeginRegistration(user)
@@ -0,0 +1,136 @@
+// Package blob stores media (originals, thumbnails) behind a small
+// key/value interface so uploads can live on local disk or in S3.
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// Info describes a stored object.
+type Info struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Store is implemented by every storage backend. Keys are slash-separated
+// relative names like "3f2a...e1.jpg"; callers never see backend paths.
+type Store interface {
+	// Put stores r under key, replacing any existing object. The object is
+	// either fully written or absent.
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get opens key for reading; the reader supports Seek so it can back
+	// http.ServeContent and Range requests.
+	Get(ctx context.Context, key string) (io.ReadSeekCloser, Info, error)
+	// Delete removes key; deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (Info, error)
+	// List returns every object whose key starts with prefix.
+	List(ctx context.Context, prefix string) ([]Info, error)
+}
+
+// URLPrefix is where media is served; photo rows store URLPrefix+key.
+const URLPrefix = "/uploads/"
+
+// URL returns the public path for key.
+func URL(key string) string {
+	return URLPrefix + key
+}
+
+// KeyFromURL is the inverse of URL. It also accepts the "uploads/x" form
+// older code used on disk.
+func KeyFromURL(u string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(u, "/"), strings.TrimPrefix(URLPrefix, "/"))
+}
+
+// cleanKey rejects keys that could escape the store root.
+func cleanKey(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	clean := path.Clean(key)
+	if clean != key || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return clean, nil
+}
+
+// Config selects and configures a backend.
+type Config struct {
+	Backend string // "local" (default) or "s3"
+	Dir     string // local: root directory
+	S3      S3Config
+	// EncryptionKey (base64, 32 bytes) or EncryptionKeyFile enables
+	// encryption at rest on top of the backend.
+	EncryptionKey     string
+	EncryptionKeyFile string
+	// AllowPlaintext serves objects stored before encryption was enabled;
+	// see Encrypted.
+	AllowPlaintext bool
+}
+
+// ConfigFromEnv reads STORAGE_BACKEND, UPLOADS_DIR, S3_*, ENCRYPTION_KEY(_FILE)
+// and ENCRYPTION_ALLOW_PLAINTEXT.
+func ConfigFromEnv() Config {
+	cfg := Config{
+		Backend: os.Getenv("STORAGE_BACKEND"),
+		Dir:     os.Getenv("UPLOADS_DIR"),
+		S3: S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			Prefix:    os.Getenv("S3_PREFIX"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		},
+		EncryptionKey:     os.Getenv("ENCRYPTION_KEY"),
+		EncryptionKeyFile: os.Getenv("ENCRYPTION_KEY_FILE"),
+	}
+	cfg.AllowPlaintext, _ = strconv.ParseBool(os.Getenv("ENCRYPTION_ALLOW_PLAINTEXT"))
+	if cfg.Backend == "" {
+		cfg.Backend = "local"
+	}
+	if cfg.Dir == "" {
+		cfg.Dir = "uploads"
+	}
+	return cfg
+}
+
+// Open builds the backend named by cfg.Backend, wrapped in Encrypted when a
+// key is configured.
+func Open(cfg Config) (Store, error) {
+	var s Store
+	var err error
+	switch cfg.Backend {
+	case "", "local":
+		s, err = NewLocal(cfg.Dir)
+	case "s3":
+		s, err = NewS3(cfg.S3)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := LoadKey(cfg.EncryptionKey, cfg.EncryptionKeyFile)
+	if err != nil || key == nil {
+		return s, err
+	}
+	enc, err := NewEncrypted(s, key)
+	if err != nil {
+		return nil, err
+	}
+	enc.AllowPlaintext = cfg.AllowPlaintext
+	return enc, nil
+}
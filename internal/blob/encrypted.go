@@ -0,0 +1,365 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Encrypted wraps a Store with envelope encryption. Every object gets its own
+// random data key, sealed with the master key and stored in the object header.
+// Content is split into fixed-size AES-GCM chunks so readers can seek (and
+// serve Range requests) without decrypting from the start.
+//
+// Layout:
+//
+//	magic(8) | key fingerprint(8) | wrap nonce(12) | sealed data key(32+16) | nonce prefix(7)
+//	chunk 0 | chunk 1 | ... each chunkSize plaintext bytes + 16 byte tag
+//
+// A chunk's nonce is prefix | uint32 index | final flag, so chunks can't be
+// reordered or the object truncated without detection.
+//
+// Objects without the magic header are refused with ErrPlaintext, since
+// anyone with write access to the storage could plant them. Set
+// AllowPlaintext while `admin encrypt` converts an existing library, so it
+// stays readable in the meantime.
+//
+// Limits: only content is protected. Until `admin encrypt` has run, legacy
+// objects are stored in plaintext. Keys stay readable, and
+// originals are named by the SHA-256 of their plaintext, so anyone with the
+// bucket listing can tell whether a known file is stored; object sizes
+// show too.
+type Encrypted struct {
+	Inner          Store
+	AllowPlaintext bool
+	master         cipher.AEAD
+	fingerprint    [8]byte
+}
+
+var encMagic = []byte("M365ENC1")
+
+const (
+	chunkSize      = 64 << 10
+	tagSize        = 16
+	prefixSize     = 7
+	wrapNonceSize  = 12
+	dataKeySize    = 32
+	encHeaderSize  = 8 + 8 + wrapNonceSize + dataKeySize + tagSize + prefixSize
+	encChunkSealed = chunkSize + tagSize
+)
+
+var ErrWrongKey = errors.New("blob encrypted with a different master key")
+
+// ErrPlaintext is returned for an object stored before encryption was enabled.
+var ErrPlaintext = errors.New("blob is not encrypted (run `admin encrypt`, or set ENCRYPTION_ALLOW_PLAINTEXT=true until it has)")
+
+func NewEncrypted(inner Store, masterKey []byte) (*Encrypted, error) {
+	if len(masterKey) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(masterKey))
+	}
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	e := &Encrypted{Inner: inner, master: aead}
+	sum := sha256.Sum256(masterKey)
+	copy(e.fingerprint[:], sum[:8])
+	return e, nil
+}
+
+// LoadKey decodes a base64 master key from ENCRYPTION_KEY, or reads it from
+// the file named by ENCRYPTION_KEY_FILE. It returns nil when neither is set.
+func LoadKey(key, keyFile string) ([]byte, error) {
+	if key == "" && keyFile != "" {
+		b, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = string(b)
+	}
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return nil, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key is not valid base64: %w", err)
+	}
+	return raw, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, idx uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[prefixSize:], idx)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// plainSize converts the stored size of an encrypted object to its plaintext size.
+func plainSize(stored int64) (int64, error) {
+	body := stored - encHeaderSize
+	if body < tagSize {
+		return 0, errors.New("encrypted blob is truncated")
+	}
+	chunks := (body + encChunkSealed - 1) / encChunkSealed
+	return body - chunks*tagSize, nil
+}
+
+func (e *Encrypted) Put(ctx context.Context, key string, r io.Reader) error {
+	dataKey := make([]byte, dataKeySize)
+	header := make([]byte, 0, encHeaderSize)
+	wrapNonce := make([]byte, wrapNonceSize)
+	prefix := make([]byte, prefixSize)
+	for _, b := range [][]byte{dataKey, wrapNonce, prefix} {
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+	}
+	header = append(header, encMagic...)
+	header = append(header, e.fingerprint[:]...)
+	header = append(header, wrapNonce...)
+	header = e.master.Seal(header, wrapNonce, dataKey, header[:16])
+	header = append(header, prefix...)
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(sealChunks(pw, r, header, aead, prefix))
+	}()
+	err = e.Inner.Put(ctx, key, pr)
+	pr.CloseWithError(err)
+	return err
+}
+
+func sealChunks(w io.Writer, r io.Reader, header []byte, aead cipher.AEAD, prefix []byte) error {
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	cur := make([]byte, chunkSize)
+	next := make([]byte, chunkSize)
+	out := make([]byte, 0, encChunkSealed)
+
+	n, err := readChunk(r, cur)
+	if err != nil {
+		return err
+	}
+	for idx := uint32(0); ; idx++ {
+		final := n < chunkSize
+		m := 0
+		if !final {
+			if m, err = readChunk(r, next); err != nil {
+				return err
+			}
+			final = m == 0
+		}
+		out = aead.Seal(out[:0], chunkNonce(prefix, idx, final), cur[:n], nil)
+		if _, err := w.Write(out); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+		cur, next, n = next, cur, m
+	}
+}
+
+// readChunk fills buf as far as r allows; a short count means r is exhausted.
+func readChunk(r io.Reader, buf []byte) (int, error) {
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, nil
+	}
+	return n, err
+}
+
+func (e *Encrypted) Get(ctx context.Context, key string) (io.ReadSeekCloser, Info, error) {
+	r, info, err := e.Inner.Get(ctx, key)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	header := make([]byte, encHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		r.Close()
+		return nil, Info{}, err
+	}
+	if n < len(encMagic) || !bytes.Equal(header[:len(encMagic)], encMagic) {
+		if !e.AllowPlaintext {
+			r.Close()
+			return nil, Info{}, fmt.Errorf("%s: %w", key, ErrPlaintext)
+		}
+		// Not encrypted yet: serve as-is
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			r.Close()
+			return nil, Info{}, err
+		}
+		return r, info, nil
+	}
+
+	dr, err := e.openReader(r, header[:n], info.Size)
+	if err != nil {
+		r.Close()
+		return nil, Info{}, fmt.Errorf("%s: %w", key, err)
+	}
+	info.Size = dr.size
+	return dr, info, nil
+}
+
+func (e *Encrypted) openReader(r io.ReadSeekCloser, header []byte, stored int64) (*decryptReader, error) {
+	if len(header) < encHeaderSize {
+		return nil, errors.New("encrypted blob is truncated")
+	}
+	if !bytes.Equal(header[8:16], e.fingerprint[:]) {
+		return nil, ErrWrongKey
+	}
+	wrapNonce := header[16 : 16+wrapNonceSize]
+	sealed := header[16+wrapNonceSize : encHeaderSize-prefixSize]
+	dataKey, err := e.master.Open(nil, wrapNonce, sealed, header[:16])
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key: %w", err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	size, err := plainSize(stored)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		r:        r,
+		aead:     aead,
+		prefix:   append([]byte(nil), header[encHeaderSize-prefixSize:]...),
+		stored:   stored,
+		size:     size,
+		chunkIdx: -1,
+	}, nil
+}
+
+// decryptReader exposes the plaintext of an encrypted object, decrypting one
+// chunk at a time around the current offset.
+type decryptReader struct {
+	r        io.ReadSeekCloser
+	aead     cipher.AEAD
+	prefix   []byte
+	stored   int64
+	size     int64
+	off      int64
+	chunk    []byte
+	chunkIdx int64
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	if d.off >= d.size {
+		return 0, io.EOF
+	}
+	idx := d.off / chunkSize
+	if idx != d.chunkIdx {
+		if err := d.load(idx); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.chunk[d.off-idx*chunkSize:])
+	d.off += int64(n)
+	return n, nil
+}
+
+func (d *decryptReader) load(idx int64) error {
+	start := encHeaderSize + idx*encChunkSealed
+	length := min(int64(encChunkSealed), d.stored-start)
+	if _, err := d.r.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return err
+	}
+	final := start+length == d.stored
+	plain, err := d.aead.Open(d.chunk[:0], chunkNonce(d.prefix, uint32(idx), final), sealed, nil)
+	if err != nil {
+		return fmt.Errorf("decrypt chunk %d: %w", idx, err)
+	}
+	d.chunk, d.chunkIdx = plain, idx
+	return nil
+}
+
+func (d *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = d.off + offset
+	case io.SeekEnd:
+		abs = d.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+	d.off = abs
+	return abs, nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.r.Close()
+}
+
+func (e *Encrypted) Delete(ctx context.Context, key string) error {
+	return e.Inner.Delete(ctx, key)
+}
+
+// Stat reports the plaintext size, which needs the object's header.
+func (e *Encrypted) Stat(ctx context.Context, key string) (Info, error) {
+	r, info, err := e.Get(ctx, key)
+	if err != nil {
+		return Info{}, err
+	}
+	r.Close()
+	return info, nil
+}
+
+// List reports stored sizes; use Stat for the plaintext size of one object.
+func (e *Encrypted) List(ctx context.Context, prefix string) ([]Info, error) {
+	return e.Inner.List(ctx, prefix)
+}
+
+// IsEncrypted reports whether key already carries an encryption header.
+func (e *Encrypted) IsEncrypted(ctx context.Context, key string) (bool, error) {
+	r, _, err := e.Inner.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	magic := make([]byte, len(encMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return false, nil
+	}
+	return bytes.Equal(magic, encMagic), nil
+}
@@ -0,0 +1,63 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// An object without the encryption header is only served while a library
+// is being migrated: otherwise whoever can write to the storage decides
+// what the server serves.
+func TestEncryptedPlaintextNeedsMigrationFlag(t *testing.T) {
+	ctx := context.Background()
+	l, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewEncrypted(l, bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put(ctx, "plain.jpg", strings.NewReader("planted")); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Put(ctx, "sealed.jpg", strings.NewReader("stored")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, allow := range []bool{false, true} {
+		e.AllowPlaintext = allow
+		r, _, err := e.Get(ctx, "plain.jpg")
+		if !allow {
+			if !errors.Is(err, ErrPlaintext) {
+				t.Errorf("Get of a plaintext object = %v, want ErrPlaintext", err)
+			}
+			if _, err := e.Stat(ctx, "plain.jpg"); !errors.Is(err, ErrPlaintext) {
+				t.Errorf("Stat of a plaintext object = %v, want ErrPlaintext", err)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("Get with AllowPlaintext: %v", err)
+			}
+			b, _ := io.ReadAll(r)
+			r.Close()
+			if string(b) != "planted" {
+				t.Errorf("Get with AllowPlaintext = %q, want %q", b, "planted")
+			}
+		}
+
+		r, info, err := e.Get(ctx, "sealed.jpg")
+		if err != nil {
+			t.Fatalf("Get of an encrypted object (AllowPlaintext %v): %v", allow, err)
+		}
+		b, _ := io.ReadAll(r)
+		r.Close()
+		if string(b) != "stored" || info.Size != int64(len("stored")) {
+			t.Errorf("Get of an encrypted object = %q (%d bytes), want %q", b, info.Size, "stored")
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TempPrefix marks in-progress writes; anything with it is garbage after a crash.
+const TempPrefix = ".tmp-"
+
+// Local stores blobs as files under a directory.
+type Local struct {
+	Dir string
+}
+
+func NewLocal(dir string) (*Local, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Local{Dir: dir}, nil
+}
+
+// path maps a key to its file. Keys naming a temp file are not found, so
+// half-written content is never served.
+func (l *Local) path(key string) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	if isTemp(key) {
+		return "", ErrNotFound
+	}
+	return filepath.Join(l.Dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes via a temp file in the same directory, fsyncs it and renames it
+// into place, so the key either holds the full content or nothing.
+func (l *Local) Put(ctx context.Context, key string, r io.Reader) (err error) {
+	if isTemp(key) {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, TempPrefix+filepath.Base(p)+"-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = io.Copy(tmp, r); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), p); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes the rename itself durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (l *Local) Get(ctx context.Context, key string) (io.ReadSeekCloser, Info, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, Info{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, Info{}, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, Info{}, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, Info{}, ErrNotFound
+	}
+	return f, Info{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (Info, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return Info{}, err
+	}
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) || (err == nil && fi.IsDir()) {
+		return Info{}, ErrNotFound
+	}
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (l *Local) List(ctx context.Context, prefix string) ([]Info, error) {
+	var infos []Info
+	err := filepath.WalkDir(l.Dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), TempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(l.Dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) || isTemp(key) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		infos = append(infos, Info{Key: key, Size: fi.Size(), ModTime: fi.ModTime()})
+		return nil
+	})
+	return infos, err
+}
+
+// isTemp reports whether any part of key has TempPrefix.
+func isTemp(key string) bool {
+	for _, part := range strings.Split(key, "/") {
+		if strings.HasPrefix(part, TempPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanTemp removes leftovers of interrupted Put calls.
+func (l *Local) CleanTemp() ([]string, error) {
+	var removed []string
+	err := filepath.WalkDir(l.Dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasPrefix(d.Name(), TempPrefix) {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		removed = append(removed, p)
+		return nil
+	})
+	return removed, err
+}
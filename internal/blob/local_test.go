@@ -0,0 +1,50 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A Put in progress, or one a crash interrupted, leaves a temp file next to
+// its key; it must never be served as a blob.
+func TestLocalTempFilesAreNotAddressable(t *testing.T) {
+	ctx := context.Background()
+	l, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Put(ctx, "ab/photo.jpg", strings.NewReader("whole")); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{TempPrefix + "photo.jpg-123", "ab/" + TempPrefix + "photo.jpg-123", TempPrefix + "dir/photo.jpg"} {
+		p := filepath.Join(l.Dir, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("half"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := l.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%q) = %v, want ErrNotFound", key, err)
+		}
+		if _, err := l.Stat(ctx, key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Stat(%q) = %v, want ErrNotFound", key, err)
+		}
+		if err := l.Put(ctx, key, strings.NewReader("x")); err == nil {
+			t.Errorf("Put(%q) succeeded", key)
+		}
+	}
+
+	infos, err := l.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Key != "ab/photo.jpg" {
+		t.Errorf("List = %v, want only ab/photo.jpg", infos)
+	}
+}
@@ -0,0 +1,440 @@
+package blob
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config points at an S3-compatible bucket (AWS, MinIO, R2, ...).
+type S3Config struct {
+	Endpoint  string // e.g. https://s3.eu-west-1.amazonaws.com or http://localhost:9000
+	Region    string // defaults to us-east-1, which MinIO accepts
+	Bucket    string
+	Prefix    string // optional key prefix inside the bucket, e.g. "m365/"
+	AccessKey string
+	SecretKey string
+}
+
+// S3 talks to the bucket with path-style requests signed with AWS SigV4.
+type S3 struct {
+	cfg    S3Config
+	base   *url.URL
+	client *http.Client
+}
+
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("s3: S3_ENDPOINT and S3_BUCKET are required")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, errors.New("s3: S3_ACCESS_KEY and S3_SECRET_KEY are required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	base, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("s3: bad endpoint: %w", err)
+	}
+	return &S3{cfg: cfg, base: base, client: &http.Client{Transport: s3Transport}}, nil
+}
+
+// s3Transport bounds each stage of a request so a stalled endpoint can't
+// hang a caller. Bodies aren't bounded (they stream videos to browsers);
+// requests that don't stream one get a deadline from withTimeout instead.
+var s3Transport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 30 * time.Second,
+	ExpectContinueTimeout: time.Second,
+	IdleConnTimeout:       90 * time.Second,
+	MaxIdleConnsPerHost:   16,
+}
+
+// s3Timeout caps requests whose whole exchange is small: HEAD, DELETE and
+// each page of a listing.
+const s3Timeout = time.Minute
+
+func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, s3Timeout)
+}
+
+func (s *S3) objectPath(key string) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return "/" + s.cfg.Bucket + "/" + s.cfg.Prefix + key, nil
+}
+
+func (s *S3) newRequest(ctx context.Context, method, objPath string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := *s.base
+	u.Path = u.Path + objPath
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	return http.NewRequestWithContext(ctx, method, u.String(), body)
+}
+
+func (s *S3) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	s.sign(req, payloadHash, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	// Without s3:ListBucket, S3 answers 403 rather than 404 for a missing
+	// key, and a HEAD response has no body saying which it is
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden && req.Method == http.MethodHead {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader) error {
+	p, err := s.objectPath(key)
+	if err != nil {
+		return err
+	}
+
+	// SigV4 signs the payload hash and S3 wants a Content-Length, so the
+	// body is hashed up front (spooled to a temp file if it can't seek).
+	body, size, sum, cleanup, err := spool(r)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	var reqBody io.Reader = http.NoBody
+	if size > 0 {
+		reqBody = io.NopCloser(body)
+	}
+	req, err := s.newRequest(ctx, http.MethodPut, p, nil, reqBody)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := s.do(req, sum)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// spool returns a reader positioned at the start of r's content together with
+// its size and hex SHA-256.
+func spool(r io.Reader) (io.Reader, int64, string, func(), error) {
+	h := sha256.New()
+	if rs, ok := r.(io.ReadSeeker); ok {
+		start, err := rs.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, 0, "", nil, err
+		}
+		n, err := io.Copy(h, rs)
+		if err != nil {
+			return nil, 0, "", nil, err
+		}
+		if _, err := rs.Seek(start, io.SeekStart); err != nil {
+			return nil, 0, "", nil, err
+		}
+		return rs, n, hex.EncodeToString(h.Sum(nil)), func() {}, nil
+	}
+
+	tmp, err := os.CreateTemp("", "blob-s3-*")
+	if err != nil {
+		return nil, 0, "", nil, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	n, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, 0, "", nil, err
+	}
+	return tmp, n, hex.EncodeToString(h.Sum(nil)), cleanup, nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadSeekCloser, Info, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	return &s3Reader{s: s, ctx: ctx, key: key, size: info.Size}, info, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	p, err := s.objectPath(key)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	req, err := s.newRequest(ctx, http.MethodDelete, p, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, emptySHA256)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (Info, error) {
+	p, err := s.objectPath(key)
+	if err != nil {
+		return Info{}, err
+	}
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	req, err := s.newRequest(ctx, http.MethodHead, p, nil, nil)
+	if err != nil {
+		return Info{}, err
+	}
+	resp, err := s.do(req, emptySHA256)
+	if err != nil {
+		return Info{}, err
+	}
+	resp.Body.Close()
+	mod, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return Info{Key: key, Size: resp.ContentLength, ModTime: mod}, nil
+}
+
+type listResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]Info, error) {
+	var infos []Info
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s.cfg.Prefix + prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		res, err := s.listPage(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range res.Contents {
+			infos = append(infos, Info{
+				Key:     strings.TrimPrefix(c.Key, s.cfg.Prefix),
+				Size:    c.Size,
+				ModTime: c.LastModified,
+			})
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return infos, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+func (s *S3) listPage(ctx context.Context, q url.Values) (*listResult, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	req, err := s.newRequest(ctx, http.MethodGet, "/"+s.cfg.Bucket, q, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, emptySHA256)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var res listResult
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("s3 list: %w", err)
+	}
+	return &res, nil
+}
+
+// s3Reader lazily issues ranged GETs so Seek is cheap and Range requests
+// only transfer the bytes asked for.
+type s3Reader struct {
+	s    *S3
+	ctx  context.Context
+	key  string
+	size int64
+	off  int64
+	body io.ReadCloser
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		objPath, err := r.s.objectPath(r.key)
+		if err != nil {
+			return 0, err
+		}
+		req, err := r.s.newRequest(r.ctx, http.MethodGet, objPath, nil, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(r.off, 10)+"-")
+		resp, err := r.s.do(req, emptySHA256)
+		if err != nil {
+			return 0, err
+		}
+		r.body = resp.Body
+	}
+	n, err := r.body.Read(p)
+	r.off += int64(n)
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.off + offset
+	case io.SeekEnd:
+		abs = r.size + offset
+	default:
+		return 0, errors.New("s3: invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("s3: negative position")
+	}
+	if abs != r.off && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.off = abs
+	return abs, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
+
+// --- SigV4 ---
+
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	// Headers are signed in sorted order; Range only when the request has one
+	signedHeaders := "host"
+	canonicalHeaders := "host:" + req.URL.Host + "\n"
+	if rng := req.Header.Get("Range"); rng != "" {
+		signedHeaders += ";range"
+		canonicalHeaders += "range:" + strings.TrimSpace(rng) + "\n"
+	}
+	signedHeaders += ";x-amz-content-sha256;x-amz-date"
+	canonicalHeaders += "x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	digest := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.cfg.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// s3Escape percent-encodes everything except unreserved characters (and '/'
+// unless encodeSlash), as SigV4 requires.
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(q url.Values) string {
+	if len(q) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
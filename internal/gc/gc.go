@@ -0,0 +1,109 @@
+// Package gc deletes stored media that no photo row references.
+package gc
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"m365/internal/blob"
+	"m365/internal/store"
+)
+
+// DefaultGrace protects blobs written moments before their row is saved.
+const DefaultGrace = 24 * time.Hour
+
+type Collector struct {
+	Blobs  blob.Store
+	Photos *store.PhotoStore
+	Usage  *store.UsageStore
+	Runs   *store.GCStore
+	// Grace is how old an unreferenced blob must be before it is deleted.
+	Grace time.Duration
+}
+
+// Report is the outcome of one pass; Orphans lists what was (or, on a dry
+// run, would be) deleted.
+type Report struct {
+	store.GCRun
+	Orphans []blob.Info
+}
+
+// Run finds unreferenced blobs older than the grace period and deletes them
+// unless dryRun is set. Each pass is recorded in gc_runs.
+func (c *Collector) Run(ctx context.Context, dryRun bool) (*Report, error) {
+	rep := &Report{GCRun: store.GCRun{StartedAt: time.Now(), DryRun: dryRun}}
+
+	// Listing first: an upload of bytes already stored writes no new blob,
+	// so an old one can gain a row at any moment. Rows read after the
+	// listing cover every upload saved before it.
+	infos, err := c.Blobs.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	urls, err := c.Photos.MediaURLs()
+	if err != nil {
+		return nil, err
+	}
+	referenced := make(map[string]bool, len(urls))
+	for _, u := range urls {
+		referenced[blob.KeyFromURL(u)] = true
+	}
+
+	cutoff := rep.StartedAt.Add(-c.Grace)
+	for _, info := range infos {
+		rep.Scanned++
+		if referenced[info.Key] || info.ModTime.After(cutoff) {
+			continue
+		}
+		if dryRun {
+			rep.Orphans = append(rep.Orphans, info)
+			rep.ReclaimedBytes += info.Size
+			continue
+		}
+		// ... and this catches those saved since
+		if used, err := c.Photos.References(blob.URL(info.Key)); err != nil || used {
+			if err != nil {
+				log.Printf("gc: %s: %v", info.Key, err)
+				rep.Errors++
+			}
+			continue
+		}
+		rep.Orphans = append(rep.Orphans, info)
+		if err := c.Blobs.Delete(ctx, info.Key); err != nil {
+			log.Printf("gc: delete %s: %v", info.Key, err)
+			rep.Errors++
+			continue
+		}
+		if err := c.Usage.ForgetKey(info.Key); err != nil {
+			log.Printf("gc: usage %s: %v", info.Key, err)
+		}
+		rep.Deleted++
+		rep.ReclaimedBytes += info.Size
+	}
+
+	if err := c.Runs.Record(rep.GCRun); err != nil {
+		return rep, err
+	}
+	return rep, nil
+}
+
+// Schedule runs the collector every interval until ctx is done.
+func (c *Collector) Schedule(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			rep, err := c.Run(ctx, false)
+			if err != nil {
+				log.Printf("gc: %v", err)
+				continue
+			}
+			log.Printf("gc: scanned %d, deleted %d, reclaimed %d bytes, %d errors",
+				rep.Scanned, rep.Deleted, rep.ReclaimedBytes, rep.Errors)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package gc
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"m365/internal/blob"
+	"m365/internal/store"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// memStore is a blob.Store in memory whose List and Delete can run a hook,
+// to interleave an upload with a collection.
+type memStore struct {
+	objects  map[string]blob.Info
+	onList   func()
+	onDelete func(key string)
+}
+
+func (m *memStore) Put(ctx context.Context, key string, r io.Reader) error {
+	n, err := io.Copy(io.Discard, r)
+	m.objects[key] = blob.Info{Key: key, Size: n, ModTime: time.Now()}
+	return err
+}
+
+func (m *memStore) Get(ctx context.Context, key string) (io.ReadSeekCloser, blob.Info, error) {
+	info, ok := m.objects[key]
+	if !ok {
+		return nil, blob.Info{}, blob.ErrNotFound
+	}
+	return nopCloser{bytes.NewReader(nil)}, info, nil
+}
+
+func (m *memStore) Delete(ctx context.Context, key string) error {
+	if m.onDelete != nil {
+		m.onDelete(key)
+	}
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *memStore) Stat(ctx context.Context, key string) (blob.Info, error) {
+	info, ok := m.objects[key]
+	if !ok {
+		return blob.Info{}, blob.ErrNotFound
+	}
+	return info, nil
+}
+
+func (m *memStore) List(ctx context.Context, prefix string) ([]blob.Info, error) {
+	var infos []blob.Info
+	for k, info := range m.objects {
+		if strings.HasPrefix(k, prefix) {
+			infos = append(infos, info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	if m.onList != nil {
+		m.onList()
+	}
+	return infos, nil
+}
+
+type nopCloser struct{ *bytes.Reader }
+
+func (nopCloser) Close() error { return nil }
+
+func newCollector(t *testing.T, keys ...string) (*Collector, *memStore, *sql.DB) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1) // each connection would get its own empty database
+	t.Cleanup(func() { db.Close() })
+	if err := store.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	blobs := &memStore{objects: map[string]blob.Info{}}
+	for _, k := range keys {
+		blobs.objects[k] = blob.Info{Key: k, Size: 10, ModTime: old}
+	}
+	return &Collector{
+		Blobs:  blobs,
+		Photos: store.NewPhotoStore(db),
+		Usage:  store.NewUsageStore(db),
+		Runs:   store.NewGCStore(db),
+		Grace:  DefaultGrace,
+	}, blobs, db
+}
+
+// uploadDuplicate saves a row for bytes already stored, as an upload does
+// when the content-addressed original exists: no blob is written.
+func uploadDuplicate(t *testing.T, c *Collector, day, key string) {
+	t.Helper()
+	p := &store.Photo{Day: day, ID: "photo-" + day, Filepath: blob.URL(key), CreatedAt: time.Now()}
+	if err := c.Photos.Save(p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunKeepsBlobsReferencedDuringTheRun(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, c *Collector, blobs *memStore)
+	}{
+		{
+			name: "row saved while listing",
+			setup: func(t *testing.T, c *Collector, blobs *memStore) {
+				blobs.onList = func() { uploadDuplicate(t, c, "2024-01-02", "shared.jpg") }
+			},
+		},
+		{
+			name: "row saved while deleting other orphans",
+			setup: func(t *testing.T, c *Collector, blobs *memStore) {
+				blobs.onDelete = func(key string) {
+					if key == "orphan.jpg" {
+						uploadDuplicate(t, c, "2024-01-02", "shared.jpg")
+					}
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, blobs, _ := newCollector(t, "kept.jpg", "orphan.jpg", "shared.jpg")
+			uploadDuplicate(t, c, "2024-01-01", "kept.jpg")
+			tt.setup(t, c, blobs)
+
+			rep, err := c.Run(context.Background(), false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := blobs.objects["shared.jpg"]; !ok {
+				t.Error("shared.jpg was deleted though a photo now uses it")
+			}
+			if _, ok := blobs.objects["kept.jpg"]; !ok {
+				t.Error("kept.jpg was deleted")
+			}
+			if _, ok := blobs.objects["orphan.jpg"]; ok {
+				t.Error("orphan.jpg was kept")
+			}
+			if rep.Deleted != 1 || len(rep.Orphans) != 1 {
+				t.Errorf("deleted %d, orphans %v; want just orphan.jpg", rep.Deleted, rep.Orphans)
+			}
+		})
+	}
+}
+
+func TestRunKeepsRecentBlobs(t *testing.T) {
+	c, blobs, _ := newCollector(t)
+	blobs.objects["new.jpg"] = blob.Info{Key: "new.jpg", ModTime: time.Now()}
+
+	rep, err := c.Run(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := blobs.objects["new.jpg"]; !ok || rep.Deleted != 0 {
+		t.Errorf("a blob inside the grace period was deleted")
+	}
+}
+
+// The re-check counts the same URLs as the listing: every format of a
+// rendition, and only while its photo exists.
+func TestRunRechecksRenditionFormats(t *testing.T) {
+	c, blobs, db := newCollector(t, "p1_1080.jpg", "p1_1080.webp", "p1_1080.avif", "gone_1080.jpg")
+	renditions := store.NewRenditionStore(db)
+	blobs.onList = func() {
+		uploadDuplicate(t, c, "2024-01-01", "orig.jpg")
+		for _, rd := range []store.Rendition{
+			{PhotoID: "photo-2024-01-01", Name: "1080", URL: blob.URL("p1_1080.jpg"), Formats: []string{"webp"}},
+			{PhotoID: "deleted", Name: "1080", URL: blob.URL("gone_1080.jpg")},
+		} {
+			if err := renditions.Save(&rd); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if _, err := c.Run(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{"p1_1080.jpg": true, "p1_1080.webp": true, "p1_1080.avif": false, "gone_1080.jpg": false} {
+		if _, ok := blobs.objects[key]; ok != want {
+			t.Errorf("%s kept = %v, want %v", key, ok, want)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+// Package jobs runs background work from the SQLite jobs table with a pool
+// of workers, retrying failures with exponential backoff.
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"m365/internal/store"
+)
+
+// Handler does one job. Returning an error schedules a retry until the job
+// runs out of attempts; wrap it with Permanent to give up immediately.
+type Handler func(ctx context.Context, job *store.Job) error
+
+// OnFailure is told when a job has failed for good.
+type OnFailure func(job *store.Job, err error)
+
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks an error that retrying won't fix, like an undecodable file.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+type Queue struct {
+	Store       *store.JobStore
+	Workers     int
+	MaxAttempts int
+	// Backoff before retry n (1-based) is BaseBackoff * 2^(n-1), capped at MaxBackoff.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// Poll is how often idle workers look for due jobs (retries, other processes).
+	Poll time.Duration
+	// Lease is how long a claimed job stays claimed without its worker
+	// renewing it; the worker renews it every Lease/3 while the job runs.
+	// Running jobs past their lease are requeued.
+	Lease time.Duration
+	// KeepDone is how long finished jobs stay in the table; 0 keeps them.
+	KeepDone time.Duration
+
+	handlers  map[string]Handler
+	onFailure map[string]OnFailure
+	wake      chan struct{}
+}
+
+func NewQueue(s *store.JobStore) *Queue {
+	return &Queue{
+		Store:       s,
+		Workers:     2,
+		MaxAttempts: 5,
+		BaseBackoff: 10 * time.Second,
+		MaxBackoff:  time.Hour,
+		Poll:        5 * time.Second,
+		Lease:       time.Minute,
+		KeepDone:    7 * 24 * time.Hour,
+		handlers:    map[string]Handler{},
+		onFailure:   map[string]OnFailure{},
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Handle registers the handler for a job kind, and optionally what to do
+// when one of its jobs fails for good.
+func (q *Queue) Handle(kind string, h Handler, onFailure OnFailure) {
+	q.handlers[kind] = h
+	if onFailure != nil {
+		q.onFailure[kind] = onFailure
+	}
+}
+
+// Enqueue adds a job and wakes an idle worker.
+func (q *Queue) Enqueue(kind, photoID string) error {
+	if _, err := q.Store.Enqueue(kind, photoID, q.MaxAttempts); err != nil {
+		return err
+	}
+	q.Notify()
+	return nil
+}
+
+// Notify wakes an idle worker without blocking.
+func (q *Queue) Notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run works the queue until ctx is done. Alongside the workers it requeues
+// jobs whose lease ran out and prunes old finished ones.
+func (q *Queue) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		q.maintain(ctx)
+	}()
+	for i := 0; i < max(q.Workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// maintain requeues jobs with an expired lease every Lease, and prunes
+// finished jobs hourly.
+func (q *Queue) maintain(ctx context.Context) {
+	t := time.NewTicker(q.Lease)
+	defer t.Stop()
+	var pruned time.Time
+	for {
+		if n, err := q.Store.Requeue(time.Now()); err != nil {
+			log.Printf("jobs: requeue: %v", err)
+		} else if n > 0 {
+			log.Printf("jobs: requeued %d interrupted job(s)", n)
+			q.Notify()
+		}
+		if q.KeepDone > 0 && time.Since(pruned) >= time.Hour {
+			if err := q.Store.PruneDone(time.Now().Add(-q.KeepDone)); err != nil {
+				log.Printf("jobs: prune: %v", err)
+			}
+			pruned = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (q *Queue) work(ctx context.Context) {
+	t := time.NewTicker(q.Poll)
+	defer t.Stop()
+	for {
+		// Drain everything due before sleeping
+		for ctx.Err() == nil {
+			ran, err := q.RunOne(ctx)
+			if err != nil {
+				log.Printf("jobs: %v", err)
+				break
+			}
+			if !ran {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-t.C:
+		}
+	}
+}
+
+// RunOne claims and runs one due job, reporting whether there was one.
+func (q *Queue) RunOne(ctx context.Context) (bool, error) {
+	job, err := q.Store.Claim(time.Now(), q.Lease)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	h, ok := q.handlers[job.Kind]
+	if !ok {
+		return true, q.Store.Fail(job.ID, fmt.Sprintf("no handler for %q", job.Kind))
+	}
+	err = q.call(ctx, h, job)
+	if err == nil {
+		return true, q.Store.Complete(job.ID)
+	}
+
+	var perm permanentError
+	if errors.As(err, &perm) || job.Attempts >= job.MaxAttempts {
+		log.Printf("jobs: %s %s failed after %d attempt(s): %v", job.Kind, job.PhotoID, job.Attempts, err)
+		if f := q.onFailure[job.Kind]; f != nil {
+			f(job, err)
+		}
+		return true, q.Store.Fail(job.ID, err.Error())
+	}
+	delay := q.backoff(job.Attempts)
+	log.Printf("jobs: %s %s attempt %d failed, retrying in %s: %v", job.Kind, job.PhotoID, job.Attempts, delay, err)
+	return true, q.Store.Retry(job.ID, err.Error(), time.Now().Add(delay))
+}
+
+// call runs h, renewing the job's lease until it returns and turning a
+// panic into an error so one bad file can't stop a worker.
+func (q *Queue) call(ctx context.Context, h Handler, job *store.Job) (err error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		t := time.NewTicker(q.Lease / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if err := q.Store.Renew(job.ID, time.Now().Add(q.Lease)); err != nil {
+					log.Printf("jobs: renew %d: %v", job.ID, err)
+				}
+			}
+		}
+	}()
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return h(ctx, job)
+}
+
+func (q *Queue) backoff(attempt int) time.Duration {
+	d := q.BaseBackoff
+	for i := 1; i < attempt && d < q.MaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, q.MaxBackoff)
+}
@@ -0,0 +1,79 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"m365/internal/store"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newStore(t *testing.T) *store.JobStore {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1) // each connection would get its own empty database
+	t.Cleanup(func() { db.Close() })
+	if err := store.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	return store.NewJobStore(db)
+}
+
+// A second process starting up must not take over a job the first is
+// still running, only one whose worker stopped renewing it.
+func TestRequeueOnlyExpiredLeases(t *testing.T) {
+	s := newStore(t)
+	if _, err := s.Enqueue("process", "p1", 5); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	job, err := s.Claim(now, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := s.Requeue(now.Add(30 * time.Second)); err != nil || n != 0 {
+		t.Fatalf("Requeue within the lease = %d, %v; want 0", n, err)
+	}
+	if err := s.Renew(job.ID, now.Add(90*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.Requeue(now.Add(80 * time.Second)); err != nil || n != 0 {
+		t.Fatalf("Requeue within the renewed lease = %d, %v; want 0", n, err)
+	}
+	if n, err := s.Requeue(now.Add(2 * time.Minute)); err != nil || n != 1 {
+		t.Fatalf("Requeue after the lease = %d, %v; want 1", n, err)
+	}
+	if _, err := s.Claim(now.Add(2*time.Minute), time.Minute); err != nil {
+		t.Errorf("requeued job can't be claimed: %v", err)
+	}
+}
+
+// A job that outlives its first lease keeps it while the handler runs.
+func TestRunOneRenewsLease(t *testing.T) {
+	s := newStore(t)
+	q := NewQueue(s)
+	q.Lease = 60 * time.Millisecond
+	q.Handle("slow", func(ctx context.Context, job *store.Job) error {
+		time.Sleep(4 * q.Lease)
+		if n, err := s.Requeue(time.Now()); err != nil || n != 0 {
+			t.Errorf("Requeue while running = %d, %v; want 0", n, err)
+		}
+		return nil
+	}, nil)
+	if err := q.Enqueue("slow", "p1"); err != nil {
+		t.Fatal(err)
+	}
+	if ran, err := q.RunOne(context.Background()); !ran || err != nil {
+		t.Fatalf("RunOne = %v, %v", ran, err)
+	}
+	if counts, _ := s.Counts(); counts[store.JobDone] != 1 {
+		t.Errorf("counts = %v, want one done", counts)
+	}
+}
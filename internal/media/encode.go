@@ -0,0 +1,110 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// FormatAVIF is only produced for renditions; AVIF uploads aren't accepted.
+const FormatAVIF Format = "avif"
+
+// EncodeTimeout bounds one run of an external encoder. avifenc takes a few
+// seconds on a 2048px rendition; a tool still going after this is stuck.
+const EncodeTimeout = 2 * time.Minute
+
+// Encoder writes images in one output format.
+type Encoder struct {
+	Format      Format
+	ContentType string
+	Encode      func(ctx context.Context, w io.Writer, img image.Image) error
+}
+
+// JPEGEncoder is always available and is what every client can fall back to.
+var JPEGEncoder = Encoder{
+	Format:      FormatJPEG,
+	ContentType: "image/jpeg",
+	Encode: func(ctx context.Context, w io.Writer, img image.Image) error {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	},
+}
+
+// ContentType returns the MIME type of an output format.
+func (f Format) ContentType() string {
+	return "image/" + string(f)
+}
+
+// ExtraEncoder returns an encoder for an optional rendition format. WebP is
+// encoded in-process; there is no pure-Go AVIF encoder, so AVIF shells out to
+// avifenc (libavif) and an error means the tool isn't installed.
+func ExtraEncoder(f Format) (Encoder, error) {
+	switch f {
+	case FormatWebP:
+		return WebPEncoder, nil
+	case FormatAVIF:
+		return commandEncoder(f, "avifenc", "--speed", "6", "-q", "60", "{in}", "{out}")
+	}
+	return Encoder{}, fmt.Errorf("no encoder for %q", f)
+}
+
+// commandEncoder runs tool with {in} and {out} replaced by a PNG of the image
+// and the file the tool should write. The tool is killed when ctx ends or
+// after EncodeTimeout.
+func commandEncoder(f Format, tool string, args ...string) (Encoder, error) {
+	bin, err := exec.LookPath(tool)
+	if err != nil {
+		return Encoder{}, fmt.Errorf("%s encoder: %w", f, err)
+	}
+	encode := func(ctx context.Context, w io.Writer, img image.Image) error {
+		dir, err := MkdirScratch("encode-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		in, out := filepath.Join(dir, "in.png"), filepath.Join(dir, "out."+string(f))
+		var buf bytes.Buffer
+		if err := (&png.Encoder{CompressionLevel: png.BestSpeed}).Encode(&buf, img); err != nil {
+			return err
+		}
+		if err := os.WriteFile(in, buf.Bytes(), 0600); err != nil {
+			return err
+		}
+
+		argv := make([]string, len(args))
+		for i, a := range args {
+			switch a {
+			case "{in}":
+				argv[i] = in
+			case "{out}":
+				argv[i] = out
+			default:
+				argv[i] = a
+			}
+		}
+		ctx, cancel := context.WithTimeout(ctx, EncodeTimeout)
+		defer cancel()
+		if msg, err := exec.CommandContext(ctx, bin, argv...).CombinedOutput(); err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("%s: %w", tool, ctx.Err())
+			}
+			return fmt.Errorf("%s: %v: %s", tool, err, bytes.TrimSpace(msg))
+		}
+		encoded, err := os.Open(out)
+		if err != nil {
+			return err
+		}
+		defer encoded.Close()
+		_, err = io.Copy(w, encoded)
+		return err
+	}
+	return Encoder{Format: f, ContentType: f.ContentType(), Encode: encode}, nil
+}
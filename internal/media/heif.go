@@ -0,0 +1,487 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"mime"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// FormatHEIC covers HEIC/HEIF stills as written by iPhones.
+const FormatHEIC Format = "heic"
+
+// ErrNoHEIFDecoder means a HEIC upload arrived but no converter is installed.
+var ErrNoHEIFDecoder = errors.New("HEIC decoding needs heif-convert (libheif) on PATH")
+
+// heifBrands are ftyp major brands of HEIF stills (not AVIF or video).
+var heifBrands = map[string]bool{
+	"heic": true, "heix": true, "heim": true, "heis": true,
+	"hevc": true, "hevx": true, "mif1": true, "msf1": true,
+}
+
+// avifBrands mark AVIF, which shares the HEIF container and often its mif1
+// or msf1 major brand; heif-convert would decode it, but AVIF isn't accepted.
+var avifBrands = map[string]bool{"avif": true, "avis": true}
+
+// isHEIF reads the major brand and the compatible brands that fit in head.
+func isHEIF(head []byte) bool {
+	if len(head) < 12 || string(head[4:8]) != "ftyp" {
+		return false
+	}
+	end := min(int(binary.BigEndian.Uint32(head)), len(head))
+	for i := 16; i+4 <= end; i += 4 {
+		if avifBrands[string(head[i:i+4])] {
+			return false
+		}
+	}
+	return heifBrands[string(head[8:12])]
+}
+
+func init() {
+	// Registering with image lets DecodeConfig and imaging.Decode handle HEIC
+	// like any other upload.
+	for brand := range heifBrands {
+		image.RegisterFormat(string(FormatHEIC), "????ftyp"+brand, func(r io.Reader) (image.Image, error) {
+			return decodeHEIF(context.Background(), r)
+		}, decodeHEIFConfig)
+	}
+	mime.AddExtensionType(".heic", "image/heic")
+}
+
+// HEIFInfo is what the pipeline needs from a HEIF container without decoding
+// any HEVC: the displayed size of the primary image and its Exif block.
+type HEIFInfo struct {
+	Width, Height int
+	// Exif is a TIFF-headed Exif block, or nil when the file has none.
+	Exif []byte
+}
+
+// maxHEIFMeta bounds the meta box we read into memory; real files use a few KB.
+const maxHEIFMeta = 16 << 20
+
+// ParseHEIF reads the meta box of a HEIF file.
+func ParseHEIF(r io.ReadSeeker) (*HEIFInfo, error) {
+	meta, err := findBox(r, "meta")
+	if err != nil {
+		return nil, err
+	}
+	if len(meta) < 4 {
+		return nil, errors.New("heif: short meta box")
+	}
+	boxes, err := childBoxes(meta[4:]) // meta is a full box
+	if err != nil {
+		return nil, err
+	}
+
+	primary, err := parsePitm(boxes["pitm"])
+	if err != nil {
+		return nil, err
+	}
+	info := &HEIFInfo{}
+
+	// Size comes from the primary item's ispe; irot by 90/270 swaps it.
+	rotated := false
+	if iprp, ok := boxes["iprp"]; ok {
+		props, err := childBoxes(iprp)
+		if err != nil {
+			return nil, err
+		}
+		ipco, err := orderedBoxes(props["ipco"])
+		if err != nil {
+			return nil, err
+		}
+		for _, idx := range parseIpma(props["ipma"], primary) {
+			if idx < 1 || idx > len(ipco) {
+				continue
+			}
+			p := ipco[idx-1]
+			switch {
+			case p.typ == "ispe" && len(p.data) >= 12:
+				info.Width = int(binary.BigEndian.Uint32(p.data[4:]))
+				info.Height = int(binary.BigEndian.Uint32(p.data[8:]))
+			case p.typ == "irot" && len(p.data) >= 1 && p.data[0]&1 == 1:
+				rotated = true
+			}
+		}
+	}
+	if rotated {
+		info.Width, info.Height = info.Height, info.Width
+	}
+
+	// A missing or unreadable Exif item leaves Exif nil; the image itself is fine
+	if exifID, ok := findExifItem(boxes["iinf"]); ok {
+		data, _ := readItem(r, boxes["iloc"], exifID)
+		// Payload starts with the offset of the TIFF header past itself
+		if len(data) >= 4 {
+			off := 4 + int(binary.BigEndian.Uint32(data))
+			if off < len(data) {
+				info.Exif = data[off:]
+			}
+		}
+	}
+	return info, nil
+}
+
+type box struct {
+	typ  string
+	data []byte
+}
+
+// findBox scans top-level boxes for typ and returns its payload.
+func findBox(r io.ReadSeeker, typ string) ([]byte, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, hdr[:8]); err != nil {
+			return nil, fmt.Errorf("heif: no %s box", typ)
+		}
+		size := int64(binary.BigEndian.Uint32(hdr))
+		name := string(hdr[4:8])
+		headerLen := int64(8)
+		if size == 1 {
+			if _, err := io.ReadFull(r, hdr[8:16]); err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(hdr[8:]))
+			headerLen = 16
+		}
+		if size == 0 {
+			// Runs to the end of the file; fine for mdat, never for metadata
+			if name == typ {
+				return nil, fmt.Errorf("heif: %s box too large", typ)
+			}
+			return nil, fmt.Errorf("heif: no %s box", typ)
+		}
+		if size < headerLen {
+			return nil, errors.New("heif: bad box size")
+		}
+		if name == typ {
+			if size-headerLen > maxHEIFMeta {
+				return nil, fmt.Errorf("heif: %s box too large", typ)
+			}
+			buf := make([]byte, size-headerLen)
+			_, err := io.ReadFull(r, buf)
+			return buf, err
+		}
+		if _, err := r.Seek(size-headerLen, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func orderedBoxes(b []byte) ([]box, error) {
+	var out []box
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return nil, errors.New("heif: truncated box")
+		}
+		size := int(binary.BigEndian.Uint32(b))
+		headerLen := 8
+		if size == 1 {
+			if len(b) < 16 {
+				return nil, errors.New("heif: truncated box")
+			}
+			size = int(binary.BigEndian.Uint64(b[8:]))
+			headerLen = 16
+		} else if size == 0 {
+			size = len(b)
+		}
+		if size < headerLen || size > len(b) {
+			return nil, errors.New("heif: bad box size")
+		}
+		out = append(out, box{typ: string(b[4:8]), data: b[headerLen:size]})
+		b = b[size:]
+	}
+	return out, nil
+}
+
+// childBoxes indexes boxes by type, keeping the first of each.
+func childBoxes(b []byte) (map[string][]byte, error) {
+	list, err := orderedBoxes(b)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string][]byte, len(list))
+	for _, c := range list {
+		if _, ok := m[c.typ]; !ok {
+			m[c.typ] = c.data
+		}
+	}
+	return m, nil
+}
+
+// reader walks a box payload; reads past the end yield zero and set err.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) uint(n int) uint64 {
+	if n == 0 {
+		return 0
+	}
+	if r.err != nil || len(r.b) < n {
+		r.err = errors.New("heif: truncated box")
+		return 0
+	}
+	var v uint64
+	for _, c := range r.b[:n] {
+		v = v<<8 | uint64(c)
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func parsePitm(b []byte) (uint32, error) {
+	if b == nil {
+		return 0, errors.New("heif: no primary item")
+	}
+	r := &reader{b: b}
+	version := r.uint(1)
+	r.uint(3)
+	n := 2
+	if version > 0 {
+		n = 4
+	}
+	id := uint32(r.uint(n))
+	return id, r.err
+}
+
+// parseIpma returns the 1-based ipco indexes associated with item.
+func parseIpma(b []byte, item uint32) []int {
+	r := &reader{b: b}
+	version := r.uint(1)
+	flags := r.uint(3)
+	count := r.uint(4)
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		idLen := 2
+		if version >= 1 {
+			idLen = 4
+		}
+		id := uint32(r.uint(idLen))
+		n := r.uint(1)
+		var idx []int
+		for j := uint64(0); j < n; j++ {
+			if flags&1 == 1 {
+				idx = append(idx, int(r.uint(2)&0x7fff))
+			} else {
+				idx = append(idx, int(r.uint(1)&0x7f))
+			}
+		}
+		if id == item {
+			return idx
+		}
+	}
+	return nil
+}
+
+func findExifItem(b []byte) (uint32, bool) {
+	if b == nil {
+		return 0, false
+	}
+	r := &reader{b: b}
+	version := r.uint(1)
+	r.uint(3)
+	if version == 0 {
+		r.uint(2)
+	} else {
+		r.uint(4)
+	}
+	if r.err != nil {
+		return 0, false
+	}
+	entries, err := orderedBoxes(r.b)
+	if err != nil {
+		return 0, false
+	}
+	for _, e := range entries {
+		if e.typ != "infe" {
+			continue
+		}
+		er := &reader{b: e.data}
+		v := er.uint(1)
+		er.uint(3)
+		if v < 2 {
+			continue
+		}
+		idLen := 2
+		if v == 3 {
+			idLen = 4
+		}
+		id := uint32(er.uint(idLen))
+		er.uint(2) // protection index
+		typ := er.uint(4)
+		if er.err == nil && typ == uint64(binary.BigEndian.Uint32([]byte("Exif"))) {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// readItem concatenates the file extents of item as listed in iloc.
+func readItem(rs io.ReadSeeker, iloc []byte, item uint32) ([]byte, error) {
+	r := &reader{b: iloc}
+	version := r.uint(1)
+	r.uint(3)
+	sizes := r.uint(2)
+	offsetSize, lengthSize := int(sizes>>12&0xf), int(sizes>>8&0xf)
+	baseSize, indexSize := int(sizes>>4&0xf), 0
+	if version == 1 || version == 2 {
+		indexSize = int(sizes & 0xf)
+	}
+	var count uint64
+	if version < 2 {
+		count = r.uint(2)
+	} else {
+		count = r.uint(4)
+	}
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		var id uint32
+		if version < 2 {
+			id = uint32(r.uint(2))
+		} else {
+			id = uint32(r.uint(4))
+		}
+		method := uint64(0)
+		if version == 1 || version == 2 {
+			method = r.uint(2) & 0xf
+		}
+		r.uint(2) // data reference index
+		base := r.uint(baseSize)
+		extents := r.uint(2)
+		var data []byte
+		for j := uint64(0); j < extents; j++ {
+			r.uint(indexSize)
+			off, length := r.uint(offsetSize), r.uint(lengthSize)
+			if id != item {
+				continue
+			}
+			if method != 0 {
+				return nil, errors.New("unsupported item construction method")
+			}
+			if length > maxHEIFMeta || uint64(len(data))+length > maxHEIFMeta {
+				return nil, errors.New("item too large")
+			}
+			if _, err := rs.Seek(int64(base+off), io.SeekStart); err != nil {
+				return nil, err
+			}
+			chunk := make([]byte, length)
+			if _, err := io.ReadFull(rs, chunk); err != nil {
+				return nil, err
+			}
+			data = append(data, chunk...)
+		}
+		if id == item {
+			return data, r.err
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return nil, fmt.Errorf("item %d not in iloc", item)
+}
+
+func decodeHEIFConfig(r io.Reader) (image.Config, error) {
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		b, err := io.ReadAll(io.LimitReader(r, maxHEIFMeta))
+		if err != nil {
+			return image.Config{}, err
+		}
+		rs = bytes.NewReader(b)
+	}
+	info, err := ParseHEIF(rs)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{Width: info.Width, Height: info.Height}, nil
+}
+
+// HEIFDecoderAvailable reports whether HEIC uploads can be decoded here.
+func HEIFDecoderAvailable() bool {
+	_, err := exec.LookPath("heif-convert")
+	return err == nil
+}
+
+// HEIFTimeout bounds one heif-convert run; a 48MP HEIC takes a second or two.
+const HEIFTimeout = time.Minute
+
+// decodeHEIF converts through heif-convert, which also applies the
+// container's rotation and mirroring, so the result is already upright.
+// The converter is killed when ctx ends or after HEIFTimeout.
+func decodeHEIF(ctx context.Context, r io.Reader) (image.Image, error) {
+	bin, err := exec.LookPath("heif-convert")
+	if err != nil {
+		return nil, ErrNoHEIFDecoder
+	}
+	dir, err := MkdirScratch("heif-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	in, out := filepath.Join(dir, "in.heic"), filepath.Join(dir, "out.png")
+	f, err := os.Create(in)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, HEIFTimeout)
+	defer cancel()
+	if msg, err := exec.CommandContext(ctx, bin, in, out).CombinedOutput(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("heif-convert: %w", ctx.Err())
+		}
+		return nil, fmt.Errorf("heif-convert: %v: %s", err, bytes.TrimSpace(msg))
+	}
+	pf, err := os.Open(out)
+	if err != nil {
+		return nil, err
+	}
+	defer pf.Close()
+	return png.Decode(pf)
+}
+
+// ExifReader returns the Exif block of r for goexif: the file itself for
+// JPEG and TIFF-based RAW, or the block lifted out of the HEIC or CR3 container.
+func ExifReader(format Format, r io.ReadSeeker) (io.Reader, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	switch {
+	case format == FormatCR3:
+		b, err := cr3Exif(r)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(b), nil
+	case format != FormatHEIC:
+		// JPEG, and TIFF-based RAW which goexif reads directly
+		return r, nil
+	}
+	info, err := ParseHEIF(r)
+	if err != nil {
+		return nil, err
+	}
+	if info.Exif == nil {
+		return nil, errors.New("no exif")
+	}
+	return bytes.NewReader(info.Exif), nil
+}
@@ -0,0 +1,80 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// boxHeader is a box header declaring size; a 64-bit size follows a size of 1.
+func boxHeader(typ string, size uint32, large uint64) []byte {
+	b := binary.BigEndian.AppendUint32(nil, size)
+	b = append(b, typ...)
+	if size == 1 {
+		b = binary.BigEndian.AppendUint64(b, large)
+	}
+	return b
+}
+
+// Sizes smaller than the box's own header used to reach make with a
+// negative length and panic.
+func TestFindBoxBadSize(t *testing.T) {
+	ftyp := append(boxHeader("ftyp", 16, 0), "heic\x00\x00\x00\x00"...)
+	tests := []struct {
+		name string
+		file []byte
+	}{
+		{"target under 8", append(ftyp, boxHeader("meta", 4, 0)...)},
+		{"target 64-bit under 16", append(ftyp, boxHeader("meta", 1, 8)...)},
+		{"target 64-bit zero", append(ftyp, boxHeader("meta", 1, 0)...)},
+		{"skipped under 8", append(append(ftyp, boxHeader("free", 7, 0)...), boxHeader("meta", 8, 0)...)},
+		{"skipped 64-bit under 16", append(append(ftyp, boxHeader("free", 1, 15)...), boxHeader("meta", 8, 0)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := findBox(bytes.NewReader(tt.file), "meta"); err == nil {
+				t.Error("findBox: no error")
+			}
+			if _, err := ParseHEIF(bytes.NewReader(tt.file)); err == nil {
+				t.Error("ParseHEIF: no error")
+			}
+		})
+	}
+
+	mp4 := append(boxHeader("ftyp", 16, 0), "isom\x00\x00\x00\x00"...)
+	for _, moov := range [][]byte{boxHeader("moov", 3, 0), boxHeader("moov", 1, 12)} {
+		if _, err := ParseVideo(bytes.NewReader(append(mp4, moov...))); err == nil {
+			t.Errorf("ParseVideo with moov header % x: no error", moov)
+		}
+	}
+}
+
+func TestSniffAVIFIsNotHEIC(t *testing.T) {
+	ftyp := func(major string, compatible ...string) []byte {
+		b := boxHeader("ftyp", uint32(16+4*len(compatible)), 0)
+		b = append(b, major+"\x00\x00\x00\x00"...)
+		for _, c := range compatible {
+			b = append(b, c...)
+		}
+		return b
+	}
+	tests := []struct {
+		name string
+		head []byte
+		heic bool
+	}{
+		{"iPhone HEIC", ftyp("heic", "mif1", "MiHE", "miaf", "heic"), true},
+		{"generic HEIF", ftyp("mif1", "mif1", "heic"), true},
+		{"AVIF", ftyp("avif", "avif", "mif1", "miaf"), false},
+		{"AVIF with mif1 major brand", ftyp("mif1", "mif1", "avif", "miaf"), false},
+		{"AVIF sequence", ftyp("msf1", "msf1", "avis"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := Sniff(tt.head)
+			if got := f == FormatHEIC; got != tt.heic {
+				t.Errorf("Sniff = %q, %v; HEIC %v, want %v", f, err, got, tt.heic)
+			}
+		})
+	}
+}
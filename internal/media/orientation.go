@@ -0,0 +1,81 @@
+package media
+
+import (
+	"context"
+	"image"
+	"io"
+
+	"github.com/disintegration/imaging"
+	goexif "github.com/rwcarlsen/goexif/exif"
+)
+
+// Orientation returns the EXIF orientation of r, or 1 when it has none or
+// the value is out of range.
+func Orientation(r io.Reader) int {
+	x, err := goexif.Decode(r)
+	if err != nil {
+		return 1
+	}
+	o, err := x.Get(goexif.Orientation)
+	if err != nil {
+		return 1
+	}
+	val, err := o.Int(0)
+	if err != nil || val < 1 || val > 8 {
+		return 1
+	}
+	return val
+}
+
+// ReadOrientation returns the EXIF orientation of an upload of the given format.
+func ReadOrientation(format Format, r io.ReadSeeker) int {
+	er, err := ExifReader(format, r)
+	if err != nil {
+		return 1
+	}
+	return Orientation(er)
+}
+
+// ApplyOrientation transforms img so it displays upright for the given EXIF
+// orientation. Row 0 / column 0 below is where the tag says the stored
+// image's first row and column belong.
+func ApplyOrientation(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2: // top, right: mirrored
+		return imaging.FlipH(img)
+	case 3: // bottom, right: upside down
+		return imaging.Rotate180(img)
+	case 4: // bottom, left: mirrored upside down
+		return imaging.FlipV(img)
+	case 5: // left, top: mirrored along the main diagonal
+		return imaging.Transpose(img)
+	case 6: // right, top: camera rotated 90 CCW, needs 90 CW
+		return imaging.Rotate270(img)
+	case 7: // right, bottom: mirrored along the anti-diagonal
+		return imaging.Transverse(img)
+	case 8: // left, bottom: camera rotated 90 CW, needs 90 CCW
+		return imaging.Rotate90(img)
+	}
+	return img
+}
+
+// Normalize makes a decoded upload upright. HEIC is left alone: its decoder
+// already applies the container's rotation and mirroring, and the EXIF tag
+// only repeats it.
+func Normalize(img image.Image, format Format, orientation int) image.Image {
+	if format == FormatHEIC {
+		return img
+	}
+	return ApplyOrientation(img, orientation)
+}
+
+// DecodeUpright decodes an upload and normalizes its orientation. Every
+// rendition is made from this, so none of them carry an orientation tag.
+func DecodeUpright(ctx context.Context, format Format, r io.ReadSeeker) (image.Image, int, error) {
+	orientation := ReadOrientation(format, r)
+	img, err := Decode(ctx, format, r)
+	if err != nil {
+		return nil, orientation, err
+	}
+	return Normalize(img, format, orientation), orientation, nil
+}
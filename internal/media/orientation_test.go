@@ -0,0 +1,106 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"strconv"
+	"testing"
+)
+
+// Quadrant colors of the upright test picture, which is portrait so a
+// missed or extra quarter turn shows in the size too.
+var (
+	uprightW, uprightH = 32, 48
+	quadrants          = [2][2]color.RGBA{ // [top, bottom][left, right]
+		{{255, 0, 0, 255}, {0, 255, 0, 255}},
+		{{0, 0, 255, 255}, {255, 255, 255, 255}},
+	}
+)
+
+func uprightAt(u, v int) color.RGBA {
+	return quadrants[v*2/uprightH][u*2/uprightW]
+}
+
+// storedPixel maps a pixel of the stored image to the upright pixel it
+// shows, straight from the meaning of each value in the EXIF spec: where
+// the stored 0th row and 0th column belong in the upright picture.
+var storedPixel = map[int]func(x, y int) (u, v int){
+	1: func(x, y int) (int, int) { return x, y },                               // top, left
+	2: func(x, y int) (int, int) { return uprightW - 1 - x, y },                // top, right
+	3: func(x, y int) (int, int) { return uprightW - 1 - x, uprightH - 1 - y }, // bottom, right
+	4: func(x, y int) (int, int) { return x, uprightH - 1 - y },                // bottom, left
+	5: func(x, y int) (int, int) { return y, x },                               // left, top
+	6: func(x, y int) (int, int) { return uprightW - 1 - y, x },                // right, top
+	7: func(x, y int) (int, int) { return uprightW - 1 - y, uprightH - 1 - x }, // right, bottom
+	8: func(x, y int) (int, int) { return y, uprightH - 1 - x },                // left, bottom
+}
+
+// sampleJPEG is the test picture stored as a camera with the given
+// orientation would write it, tagged with that orientation.
+func sampleJPEG(t *testing.T, orientation int) []byte {
+	t.Helper()
+	w, h := uprightW, uprightH
+	if orientation >= 5 {
+		w, h = h, w
+	}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			img.SetRGBA(x, y, uprightAt(storedPixel[orientation](x, y)))
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+
+	// APP1 Exif with a big-endian TIFF header and a one-entry IFD0
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, 0x0112) // Orientation
+	tiff = binary.BigEndian.AppendUint16(tiff, 3)      // SHORT
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, uint16(orientation))
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0) // padding, no next IFD
+	app1 := append([]byte("Exif\x00\x00"), tiff...)
+
+	out := []byte{0xFF, 0xD8, 0xFF, 0xE1}
+	out = binary.BigEndian.AppendUint16(out, uint16(2+len(app1)))
+	out = append(out, app1...)
+	return append(out, buf.Bytes()[2:]...)
+}
+
+func TestDecodeUprightOrientations(t *testing.T) {
+	for orientation := 1; orientation <= 8; orientation++ {
+		t.Run(strconv.Itoa(orientation), func(t *testing.T) {
+			img, got, err := DecodeUpright(context.Background(), FormatJPEG, bytes.NewReader(sampleJPEG(t, orientation)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != orientation {
+				t.Errorf("orientation = %d, want %d", got, orientation)
+			}
+			b := img.Bounds()
+			if b.Dx() != uprightW || b.Dy() != uprightH {
+				t.Fatalf("size = %dx%d, want %dx%d", b.Dx(), b.Dy(), uprightW, uprightH)
+			}
+			// Quadrant centers, away from JPEG's blurring at the edges
+			for _, p := range []image.Point{{8, 12}, {24, 12}, {8, 36}, {24, 36}} {
+				want := uprightAt(p.X, p.Y)
+				r, g, bl, _ := img.At(b.Min.X+p.X, b.Min.Y+p.Y).RGBA()
+				if !near(r>>8, want.R) || !near(g>>8, want.G) || !near(bl>>8, want.B) {
+					t.Errorf("pixel %v = %d,%d,%d, want %v", p, r>>8, g>>8, bl>>8, want)
+				}
+			}
+		})
+	}
+}
+
+func near(got uint32, want uint8) bool {
+	d := int(got) - int(want)
+	return d > -24 && d < 24
+}
@@ -0,0 +1,188 @@
+package media
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// DefaultPaletteSize is how many colors Palette keeps per photo.
+const DefaultPaletteSize = 5
+
+// paletteSample is the long edge images are reduced to before clustering.
+const paletteSample = 64
+
+// PaletteColor is one cluster of a photo's palette. L, A and B are the
+// cluster center in CIELAB, where Euclidean distance tracks perceived difference.
+type PaletteColor struct {
+	Color   string  // "#rrggbb"
+	Weight  float64 // share of pixels, 0-1
+	L, A, B float64
+}
+
+// Palette clusters the colors of img with k-means in CIELAB space and returns
+// up to k colors, most common first. The result is deterministic.
+func Palette(img image.Image, k int) []PaletteColor {
+	small := imaging.Fit(img, paletteSample, paletteSample, imaging.Box)
+	var px [][3]float64
+	for i := 0; i+3 < len(small.Pix); i += 4 {
+		if small.Pix[i+3] < 128 {
+			continue // transparent PNG/WebP areas aren't part of the picture
+		}
+		l, a, b := rgbToLab(small.Pix[i], small.Pix[i+1], small.Pix[i+2])
+		px = append(px, [3]float64{l, a, b})
+	}
+	if len(px) == 0 || k <= 0 {
+		return nil
+	}
+
+	// Farthest-point seeding from the mean: spreads centers without randomness
+	centers := [][3]float64{mean(px)}
+	for len(centers) < k {
+		best, bestD := -1, 0.0
+		for i, p := range px {
+			d := math.Inf(1)
+			for _, c := range centers {
+				d = math.Min(d, dist2(p, c))
+			}
+			if d > bestD {
+				best, bestD = i, d
+			}
+		}
+		if best < 0 {
+			break // fewer distinct colors than k
+		}
+		centers = append(centers, px[best])
+	}
+
+	assign := make([]int, len(px))
+	for i := range assign {
+		assign[i] = -1
+	}
+	for iter := 0; iter < 12; iter++ {
+		changed := false
+		for i, p := range px {
+			nearest, nd := 0, math.Inf(1)
+			for c, center := range centers {
+				if d := dist2(p, center); d < nd {
+					nearest, nd = c, d
+				}
+			}
+			if assign[i] != nearest {
+				assign[i] = nearest
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+		sums := make([][3]float64, len(centers))
+		counts := make([]int, len(centers))
+		for i, p := range px {
+			c := assign[i]
+			counts[c]++
+			for j := range 3 {
+				sums[c][j] += p[j]
+			}
+		}
+		for c := range centers {
+			if counts[c] > 0 {
+				for j := range 3 {
+					centers[c][j] = sums[c][j] / float64(counts[c])
+				}
+			}
+		}
+	}
+
+	counts := make([]int, len(centers))
+	for _, c := range assign {
+		counts[c]++
+	}
+	var out []PaletteColor
+	for c, center := range centers {
+		if counts[c] == 0 {
+			continue
+		}
+		r, g, b := labToRGB(center[0], center[1], center[2])
+		out = append(out, PaletteColor{
+			Color:  fmt.Sprintf("#%02x%02x%02x", r, g, b),
+			Weight: float64(counts[c]) / float64(len(px)),
+			L:      center[0], A: center[1], B: center[2],
+		})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Weight > out[j].Weight })
+	return out
+}
+
+// ParseHexColor reads "#rrggbb", "rrggbb" or "#rgb" into CIELAB.
+func ParseHexColor(hex string) (l, a, b float64, err error) {
+	s := strings.TrimPrefix(strings.TrimSpace(hex), "#")
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	v, perr := strconv.ParseUint(s, 16, 32)
+	if len(s) != 6 || perr != nil {
+		return 0, 0, 0, fmt.Errorf("invalid color %q: want #rrggbb", hex)
+	}
+	l, a, b = rgbToLab(uint8(v>>16), uint8(v>>8), uint8(v))
+	return l, a, b, nil
+}
+
+func mean(px [][3]float64) [3]float64 {
+	var m [3]float64
+	for _, p := range px {
+		for j := range 3 {
+			m[j] += p[j]
+		}
+	}
+	for j := range 3 {
+		m[j] /= float64(len(px))
+	}
+	return m
+}
+
+func dist2(p, q [3]float64) float64 {
+	dl, da, db := p[0]-q[0], p[1]-q[1], p[2]-q[2]
+	return dl*dl + da*da + db*db
+}
+
+// D65 reference white
+const labXn, labYn, labZn = 0.95047, 1.0, 1.08883
+
+func rgbToLab(r, g, b uint8) (float64, float64, float64) {
+	lr, lg, lb := srgbToLinear(r), srgbToLinear(g), srgbToLinear(b)
+	x := (0.4124*lr + 0.3576*lg + 0.1805*lb) / labXn
+	y := (0.2126*lr + 0.7152*lg + 0.0722*lb) / labYn
+	z := (0.0193*lr + 0.1192*lg + 0.9505*lb) / labZn
+	fx, fy, fz := labF(x), labF(y), labF(z)
+	return 116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+}
+
+func labToRGB(l, a, b float64) (uint8, uint8, uint8) {
+	fy := (l + 16) / 116
+	fx, fz := fy+a/500, fy-b/200
+	x, y, z := labFInv(fx)*labXn, labFInv(fy)*labYn, labFInv(fz)*labZn
+	lr := 3.2406*x - 1.5372*y - 0.4986*z
+	lg := -0.9689*x + 1.8758*y + 0.0415*z
+	lb := 0.0557*x - 0.2040*y + 1.0570*z
+	return uint8(linearToSRGB(lr)), uint8(linearToSRGB(lg)), uint8(linearToSRGB(lb))
+}
+
+func labF(t float64) float64 {
+	if t > 216.0/24389 {
+		return math.Cbrt(t)
+	}
+	return (24389.0/27*t + 16) / 116
+}
+
+func labFInv(t float64) float64 {
+	if t3 := t * t * t; t3 > 216.0/24389 {
+		return t3
+	}
+	return (116*t - 16) * 27 / 24389
+}
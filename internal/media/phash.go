@@ -0,0 +1,45 @@
+package media
+
+import (
+	"fmt"
+	"image"
+	"math/bits"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+// DHash computes a 64-bit difference hash of an upright image: each bit
+// records whether a pixel of a 9x8 grayscale downscale is brighter than its
+// right-hand neighbour. Re-encodes and light edits keep most bits.
+func DHash(img image.Image) uint64 {
+	small := imaging.Grayscale(imaging.Resize(img, 9, 8, imaging.Box))
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := small.Pix[small.PixOffset(x, y)]
+			right := small.Pix[small.PixOffset(x+1, y)]
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// FormatHash renders a hash as 16 hex digits for storage.
+func FormatHash(h uint64) string {
+	return fmt.Sprintf("%016x", h)
+}
+
+// ParseHash is the inverse of FormatHash.
+func ParseHash(s string) (uint64, error) {
+	return strconv.ParseUint(s, 16, 64)
+}
+
+// HashDistance is the number of differing bits; 0 means visually identical,
+// up to ~10 is usually the same shot.
+func HashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
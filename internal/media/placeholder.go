@@ -0,0 +1,161 @@
+package media
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Placeholder is what a client needs to draw a photo before it loads: the
+// upright size for the aspect ratio, a BlurHash and a dominant color.
+type Placeholder struct {
+	Width, Height int
+	BlurHash      string
+	Color         string // "#rrggbb"
+}
+
+// placeholderSample is the long edge images are reduced to before hashing;
+// a BlurHash only keeps a handful of cosine components anyway.
+const placeholderSample = 32
+
+// NewPlaceholder computes the placeholder of an upright image.
+func NewPlaceholder(img image.Image) Placeholder {
+	b := img.Bounds()
+	small := imaging.Fit(img, placeholderSample, placeholderSample, imaging.Box)
+	xc, yc := 4, 3
+	if b.Dy() > b.Dx() {
+		xc, yc = 3, 4
+	}
+	return Placeholder{
+		Width:    b.Dx(),
+		Height:   b.Dy(),
+		BlurHash: BlurHash(small, xc, yc),
+		Color:    DominantColor(small),
+	}
+}
+
+// BlurHash encodes img with xComp x yComp components (1-9 each), following
+// the reference algorithm at https://blurha.sh.
+func BlurHash(img image.Image, xComp, yComp int) string {
+	nrgba := imaging.Clone(img)
+	w, h := nrgba.Bounds().Dx(), nrgba.Bounds().Dy()
+	if w == 0 || h == 0 {
+		return ""
+	}
+
+	factors := make([][3]float64, 0, xComp*yComp)
+	for j := 0; j < yComp; j++ {
+		for i := 0; i < xComp; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				cy := math.Cos(math.Pi * float64(j) * float64(y) / float64(h))
+				for x := 0; x < w; x++ {
+					basis := norm * math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) * cy
+					p := nrgba.Pix[y*nrgba.Stride+x*4:]
+					f[0] += basis * srgbToLinear(p[0])
+					f[1] += basis * srgbToLinear(p[1])
+					f[2] += basis * srgbToLinear(p[2])
+				}
+			}
+			scale := 1 / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(base83(xComp-1+(yComp-1)*9, 1))
+
+	maxValue := 1.0
+	if ac := factors[1:]; len(ac) > 0 {
+		actual := 0.0
+		for _, f := range ac {
+			actual = math.Max(actual, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		q := clampInt(int(math.Floor(actual*166-0.5)), 0, 82)
+		maxValue = float64(q+1) / 166
+		sb.WriteString(base83(q, 1))
+	} else {
+		sb.WriteString(base83(0, 1))
+	}
+
+	dc := factors[0]
+	sb.WriteString(base83(linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4))
+	for _, f := range factors[1:] {
+		q := func(v float64) int {
+			return clampInt(int(math.Floor(signPow(v/maxValue, 0.5)*9+9.5)), 0, 18)
+		}
+		sb.WriteString(base83(q(f[0])*19*19+q(f[1])*19+q(f[2]), 2))
+	}
+	return sb.String()
+}
+
+// DominantColor returns the average of the most populated color bucket, so a
+// red flower on a green lawn comes out green rather than muddy brown.
+func DominantColor(img image.Image) string {
+	nrgba := imaging.Clone(img)
+	type bucket struct{ n, r, g, b int }
+	buckets := map[int]*bucket{}
+	var best *bucket
+	for i := 0; i+3 < len(nrgba.Pix); i += 4 {
+		r, g, b := int(nrgba.Pix[i]), int(nrgba.Pix[i+1]), int(nrgba.Pix[i+2])
+		k := r>>5<<6 | g>>5<<3 | b>>5
+		bk := buckets[k]
+		if bk == nil {
+			bk = &bucket{}
+			buckets[k] = bk
+		}
+		bk.n++
+		bk.r += r
+		bk.g += g
+		bk.b += b
+		if best == nil || bk.n > best.n {
+			best = bk
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.n, best.g/best.n, best.b/best.n)
+}
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func base83(v, length int) string {
+	out := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		out[i] = base83Chars[v%83]
+		v /= 83
+	}
+	return string(out)
+}
+
+func srgbToLinear(c uint8) float64 {
+	v := float64(c) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+func clampInt(v, lo, hi int) int {
+	return max(lo, min(hi, v))
+}
@@ -0,0 +1,401 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"strings"
+)
+
+// Camera RAW formats. The RAW is kept as the original; renditions come from
+// the full-size JPEG preview cameras embed next to the sensor data.
+const (
+	FormatDNG Format = "dng"
+	FormatCR2 Format = "cr2"
+	FormatCR3 Format = "cr3"
+	FormatNEF Format = "nef"
+	FormatARW Format = "arw"
+	FormatPEF Format = "pef"
+
+	// formatTIFF is a TIFF header whose camera isn't known until IFD0 is read.
+	formatTIFF Format = "tiff"
+)
+
+// IsRaw reports whether f is a camera RAW format.
+func (f Format) IsRaw() bool {
+	switch f {
+	case FormatDNG, FormatCR2, FormatCR3, FormatNEF, FormatARW, FormatPEF:
+		return true
+	}
+	return false
+}
+
+var ErrNoPreview = errors.New("RAW file has no usable embedded JPEG preview")
+
+// maxPreview bounds an embedded preview read into memory.
+const maxPreview = 64 << 20
+
+func sniffRaw(head []byte) Format {
+	switch {
+	case len(head) >= 12 && string(head[4:12]) == "ftypcrx ":
+		return FormatCR3
+	case len(head) >= 10 && string(head[:4]) == "II*\x00" && string(head[8:10]) == "CR":
+		return FormatCR2
+	case len(head) >= 4 && (string(head[:4]) == "II*\x00" || string(head[:4]) == "MM\x00*"):
+		return formatTIFF
+	}
+	return ""
+}
+
+// identifyTIFF names the RAW format of a TIFF-structured file from IFD0.
+func identifyTIFF(r io.ReadSeeker) (Format, error) {
+	t, err := openTIFF(r)
+	if err != nil {
+		return "", err
+	}
+	ifd, _, err := t.ifd(t.first)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := ifd[0xC612]; ok { // DNGVersion
+		return FormatDNG, nil
+	}
+	camera, _ := t.ascii(ifd[0x010F])
+	switch m := strings.ToUpper(camera); {
+	case strings.HasPrefix(m, "NIKON"):
+		return FormatNEF, nil
+	case strings.HasPrefix(m, "SONY"):
+		return FormatARW, nil
+	case strings.HasPrefix(m, "PENTAX"), strings.HasPrefix(m, "RICOH"):
+		return FormatPEF, nil
+	}
+	// Plain TIFF images aren't accepted
+	return "", ErrUnsupportedFormat
+}
+
+// RawPreview returns the largest decodable JPEG embedded in a RAW file.
+func RawPreview(format Format, r io.ReadSeeker) ([]byte, error) {
+	var candidates []extent
+	var err error
+	if format == FormatCR3 {
+		candidates, err = cr3Previews(r)
+	} else {
+		candidates, err = tiffPreviews(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var best []byte
+	bestPixels := 0
+	for _, c := range candidates {
+		if c.length < 2 || c.length > maxPreview {
+			continue
+		}
+		if _, err := r.Seek(c.offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, c.length)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			continue
+		}
+		if buf[0] != 0xFF || buf[1] != 0xD8 {
+			continue
+		}
+		// Lossless JPEG sensor data fails here, which is what we want
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(buf))
+		if err != nil {
+			continue
+		}
+		if px := cfg.Width * cfg.Height; px > bestPixels {
+			best, bestPixels = buf, px
+		}
+	}
+	if best == nil {
+		return nil, ErrNoPreview
+	}
+	return best, nil
+}
+
+type extent struct {
+	offset, length int64
+}
+
+// tiffPreviews lists JPEG candidates in every IFD, SubIFD and the IFD chain.
+func tiffPreviews(r io.ReadSeeker) ([]extent, error) {
+	t, err := openTIFF(r)
+	if err != nil {
+		return nil, err
+	}
+	var out []extent
+	seen := map[int64]bool{}
+	queue := []int64{t.first}
+	for len(queue) > 0 && len(seen) < 32 {
+		off := queue[0]
+		queue = queue[1:]
+		if off == 0 || seen[off] {
+			continue
+		}
+		seen[off] = true
+		ifd, next, err := t.ifd(off)
+		if err != nil {
+			continue
+		}
+		queue = append(queue, next)
+		if subs, err := t.uints(ifd[0x014A]); err == nil {
+			for _, s := range subs {
+				queue = append(queue, int64(s))
+			}
+		}
+		// JPEGInterchangeFormat / Length
+		if o, err := t.uints(ifd[0x0201]); err == nil && len(o) == 1 {
+			if l, err := t.uints(ifd[0x0202]); err == nil && len(l) == 1 {
+				out = append(out, extent{int64(o[0]), int64(l[0])})
+			}
+		}
+		// A single JPEG-compressed strip (CR2 and DNG previews)
+		if c, err := t.uints(ifd[0x0103]); err == nil && len(c) == 1 && (c[0] == 6 || c[0] == 7) {
+			o, err1 := t.uints(ifd[0x0111])
+			l, err2 := t.uints(ifd[0x0117])
+			if err1 == nil && err2 == nil && len(o) == 1 && len(l) == 1 {
+				out = append(out, extent{int64(o[0]), int64(l[0])})
+			}
+		}
+	}
+	return out, nil
+}
+
+type tiffFile struct {
+	r     io.ReadSeeker
+	order binary.ByteOrder
+	first int64
+}
+
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	value []byte // inline value bytes, or the 4-byte offset
+}
+
+func openTIFF(r io.ReadSeeker) (*tiffFile, error) {
+	hdr := make([]byte, 8)
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	t := &tiffFile{r: r}
+	switch string(hdr[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, errors.New("tiff: bad byte order")
+	}
+	t.first = int64(t.order.Uint32(hdr[4:]))
+	return t, nil
+}
+
+func (t *tiffFile) ifd(off int64) (map[uint16]tiffEntry, int64, error) {
+	if _, err := t.r.Seek(off, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	var n uint16
+	if err := binary.Read(t.r, t.order, &n); err != nil {
+		return nil, 0, err
+	}
+	buf := make([]byte, int(n)*12+4)
+	if _, err := io.ReadFull(t.r, buf); err != nil {
+		return nil, 0, err
+	}
+	entries := make(map[uint16]tiffEntry, n)
+	for i := 0; i < int(n); i++ {
+		e := buf[i*12:]
+		entries[t.order.Uint16(e)] = tiffEntry{
+			typ:   t.order.Uint16(e[2:]),
+			count: t.order.Uint32(e[4:]),
+			value: e[8:12],
+		}
+	}
+	return entries, int64(t.order.Uint32(buf[n*12:])), nil
+}
+
+// data returns an entry's value bytes, following the offset when they don't fit inline.
+func (t *tiffFile) data(e tiffEntry, size int) ([]byte, error) {
+	total := int64(size) * int64(e.count)
+	if total <= 4 {
+		return e.value[:total], nil
+	}
+	if total > 1<<20 {
+		return nil, errors.New("tiff: value too large")
+	}
+	if _, err := t.r.Seek(int64(t.order.Uint32(e.value)), io.SeekStart); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, total)
+	_, err := io.ReadFull(t.r, buf)
+	return buf, err
+}
+
+// uints reads SHORT, LONG or IFD values.
+func (t *tiffFile) uints(e tiffEntry) ([]uint32, error) {
+	var size int
+	switch e.typ {
+	case 3: // SHORT
+		size = 2
+	case 4, 13: // LONG, IFD
+		size = 4
+	default:
+		return nil, fmt.Errorf("tiff: type %d is not an integer", e.typ)
+	}
+	b, err := t.data(e, size)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]uint32, e.count)
+	for i := range out {
+		if size == 2 {
+			out[i] = uint32(t.order.Uint16(b[i*2:]))
+		} else {
+			out[i] = t.order.Uint32(b[i*4:])
+		}
+	}
+	return out, nil
+}
+
+func (t *tiffFile) ascii(e tiffEntry) (string, error) {
+	if e.typ != 2 {
+		return "", errors.New("tiff: not ASCII")
+	}
+	b, err := t.data(e, 1)
+	return strings.TrimRight(string(b), "\x00 "), err
+}
+
+// cr3Previews returns the first sample of the first track, which Canon uses
+// for the full-size JPEG.
+func cr3Previews(r io.ReadSeeker) ([]extent, error) {
+	moov, err := findBox(r, "moov")
+	if err != nil {
+		return nil, err
+	}
+	boxes, err := orderedBoxes(moov)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range boxes {
+		if b.typ != "trak" {
+			continue
+		}
+		stbl, err := boxPath(b.data, "mdia", "minf", "stbl")
+		if err != nil {
+			return nil, err
+		}
+		children, err := childBoxes(stbl)
+		if err != nil {
+			return nil, err
+		}
+		size, err := firstSampleSize(children["stsz"])
+		if err != nil {
+			return nil, err
+		}
+		off, err := firstChunkOffset(children)
+		if err != nil {
+			return nil, err
+		}
+		return []extent{{off, size}}, nil
+	}
+	return nil, ErrNoPreview
+}
+
+func boxPath(b []byte, path ...string) ([]byte, error) {
+	for _, name := range path {
+		children, err := childBoxes(b)
+		if err != nil {
+			return nil, err
+		}
+		next, ok := children[name]
+		if !ok {
+			return nil, fmt.Errorf("cr3: no %s box", name)
+		}
+		b = next
+	}
+	return b, nil
+}
+
+func firstSampleSize(stsz []byte) (int64, error) {
+	r := &reader{b: stsz}
+	r.uint(4) // version, flags
+	size := r.uint(4)
+	count := r.uint(4)
+	if size == 0 && count > 0 {
+		size = r.uint(4)
+	}
+	return int64(size), r.err
+}
+
+func firstChunkOffset(stbl map[string][]byte) (int64, error) {
+	if co64, ok := stbl["co64"]; ok {
+		r := &reader{b: co64}
+		r.uint(8) // version, flags, entry count
+		return int64(r.uint(8)), r.err
+	}
+	r := &reader{b: stbl["stco"]}
+	r.uint(8)
+	return int64(r.uint(4)), r.err
+}
+
+// cr3Meta is the uuid box holding Canon's CMT metadata boxes.
+var cr3Meta = []byte{0x85, 0xc0, 0xb6, 0x87, 0x82, 0x0f, 0x11, 0xe0, 0x81, 0x11, 0xf4, 0xce, 0x46, 0x2b, 0x6a, 0x48}
+
+// cr3Exif returns the CMT1 box, a TIFF holding IFD0 (camera, date, orientation).
+func cr3Exif(r io.ReadSeeker) ([]byte, error) {
+	moov, err := findBox(r, "moov")
+	if err != nil {
+		return nil, err
+	}
+	boxes, err := orderedBoxes(moov)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range boxes {
+		if b.typ != "uuid" || len(b.data) < 16 || !bytes.Equal(b.data[:16], cr3Meta) {
+			continue
+		}
+		children, err := childBoxes(b.data[16:])
+		if err != nil {
+			return nil, err
+		}
+		if cmt1, ok := children["CMT1"]; ok {
+			return cmt1, nil
+		}
+	}
+	return nil, errors.New("no exif")
+}
+
+// Decode decodes an upload of the given format, using the embedded preview
+// for RAW files. ctx bounds the external HEIC converter.
+func Decode(ctx context.Context, format Format, r io.ReadSeeker) (image.Image, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if format == FormatHEIC {
+		return decodeHEIF(ctx, r)
+	}
+	if format.IsRaw() {
+		preview, err := RawPreview(format, r)
+		if err != nil {
+			return nil, err
+		}
+		img, err := jpeg.Decode(bytes.NewReader(preview))
+		return img, err
+	}
+	img, _, err := image.Decode(r)
+	return img, err
+}
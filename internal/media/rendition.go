@@ -0,0 +1,118 @@
+package media
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// RenditionSpec describes one derived image generated at upload.
+type RenditionSpec struct {
+	Name string // key suffix, e.g. "thumb" or "1080"
+	Size int    // square edge, or the long edge for display sizes
+	// Square center-crops to Size x Size; otherwise the image is scaled to
+	// fit within Size on its long edge and never enlarged.
+	Square bool
+}
+
+// ThumbnailSize is the edge of the default square grid thumbnail.
+const ThumbnailSize = 400
+
+// DefaultRenditions is a square grid thumbnail plus two display sizes.
+var DefaultRenditions = []RenditionSpec{
+	{Name: "thumb", Size: ThumbnailSize, Square: true},
+	{Name: "1080", Size: 1080},
+	{Name: "2048", Size: 2048},
+}
+
+// RenditionName is the blob key of a photo's rendition.
+func RenditionName(id, name string) string {
+	return id + "_" + name + ".jpg"
+}
+
+// ThumbnailSpec is the grid thumbnail among specs: the first square one.
+// Without one the thumbnail is just the first rendition and keeps its shape.
+func ThumbnailSpec(specs []RenditionSpec) RenditionSpec {
+	for _, spec := range specs {
+		if spec.Square {
+			return spec
+		}
+	}
+	if len(specs) > 0 {
+		return RenditionSpec{Name: specs[0].Name}
+	}
+	return RenditionSpec{}
+}
+
+// Render produces the rendition of an upright image.
+func Render(img image.Image, spec RenditionSpec) image.Image {
+	if spec.Square {
+		return imaging.Fill(img, spec.Size, spec.Size, imaging.Center, imaging.Lanczos)
+	}
+	b := img.Bounds()
+	if b.Dx() <= spec.Size && b.Dy() <= spec.Size {
+		return img
+	}
+	return imaging.Fit(img, spec.Size, spec.Size, imaging.Lanczos)
+}
+
+// UprightName names the baked rendition of UprightRendition. RENDITIONS
+// can't use it, so the two never share a key.
+const UprightName = "upright"
+
+// UprightRendition is a full-size copy of an upright image, for originals
+// whose EXIF orientation browsers that ignore it would get wrong.
+func UprightRendition(img image.Image) RenditionSpec {
+	b := img.Bounds()
+	return RenditionSpec{Name: UprightName, Size: max(b.Dx(), b.Dy())}
+}
+
+// ParseRenditions reads a comma-separated list like "thumb:400:square,1080,2048".
+// Each entry is name[:size][:square]; a bare number is both name and size.
+// The first square entry becomes the photo's grid thumbnail. UprightName is
+// reserved.
+func ParseRenditions(s string) ([]RenditionSpec, error) {
+	var specs []RenditionSpec
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		spec := RenditionSpec{Name: parts[0]}
+		sizeStr := parts[0]
+		if len(parts) > 1 {
+			sizeStr = parts[1]
+		}
+		if len(parts) > 2 {
+			if parts[2] != "square" {
+				return nil, fmt.Errorf("rendition %q: unknown option %q", entry, parts[2])
+			}
+			spec.Square = true
+		}
+		size, err := strconv.Atoi(sizeStr)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("rendition %q: invalid size", entry)
+		}
+		spec.Size = size
+		if len(parts) > 3 || spec.Name == "" || strings.ContainsAny(spec.Name, "/_.") {
+			return nil, fmt.Errorf("invalid rendition %q", entry)
+		}
+		if spec.Name == UprightName {
+			return nil, fmt.Errorf("rendition name %q is reserved", spec.Name)
+		}
+		if seen[spec.Name] {
+			return nil, fmt.Errorf("duplicate rendition %q", spec.Name)
+		}
+		seen[spec.Name] = true
+		specs = append(specs, spec)
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no renditions in %q", s)
+	}
+	return specs, nil
+}
@@ -0,0 +1,41 @@
+package media
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRenditions(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []RenditionSpec
+		wantErr bool
+	}{
+		{in: "thumb:400:square,1080,2048", want: DefaultRenditions},
+		{in: " 640 , big:3000", want: []RenditionSpec{{Name: "640", Size: 640}, {Name: "big", Size: 3000}}},
+		{in: "", wantErr: true},
+		{in: "1080,1080", wantErr: true},
+		{in: "thumb:0:square", wantErr: true},
+		{in: "thumb:400:round", wantErr: true},
+		{in: "a_b:400", wantErr: true},
+		// The baked upright copy would overwrite it, or it the copy
+		{in: "thumb:400:square," + UprightName + ":4000", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseRenditions(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseRenditions(%q) = %v, want an error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseRenditions(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package media
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ScratchDir holds the files external tools (heif-convert, ffmpeg, avifenc)
+// read and write, and originals too big to decode in memory. They are
+// plaintext even with encryption at rest, so the server keeps them in a
+// directory only it can read and empties it on start. Empty means
+// os.TempDir, for tools and tests.
+var ScratchDir string
+
+// UseScratchDir makes dir the ScratchDir, creating it if need be and
+// restricting it to the server's user.
+func UseScratchDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// MkdirAll leaves an existing directory's mode alone
+	if err := os.Chmod(dir, 0700); err != nil {
+		return err
+	}
+	ScratchDir = dir
+	return nil
+}
+
+// CleanScratch removes what runs killed mid-decode left in ScratchDir. Call
+// it before starting workers.
+func CleanScratch() ([]string, error) {
+	if ScratchDir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(ScratchDir)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, e := range entries {
+		p := filepath.Join(ScratchDir, e.Name())
+		if err := os.RemoveAll(p); err != nil {
+			return removed, fmt.Errorf("clean scratch: %w", err)
+		}
+		removed = append(removed, p)
+	}
+	return removed, nil
+}
+
+// MkdirScratch creates a new directory in ScratchDir, like os.MkdirTemp.
+func MkdirScratch(pattern string) (string, error) {
+	return os.MkdirTemp(ScratchDir, "m365-"+pattern)
+}
+
+// CreateScratch creates a new file in ScratchDir, like os.CreateTemp.
+func CreateScratch(pattern string) (*os.File, error) {
+	return os.CreateTemp(ScratchDir, "m365-"+pattern)
+}
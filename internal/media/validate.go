@@ -0,0 +1,133 @@
+// Package media inspects and transforms uploaded image and video files.
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+)
+
+// Format is a sniffed container/codec name.
+type Format string
+
+const (
+	FormatJPEG Format = "jpeg"
+	FormatPNG  Format = "png"
+	FormatGIF  Format = "gif"
+	FormatWebP Format = "webp"
+)
+
+// Ext returns the file extension used when storing an original of this format.
+func (f Format) Ext() string {
+	switch f {
+	case FormatJPEG:
+		return ".jpg"
+	default:
+		return "." + string(f)
+	}
+}
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported file format")
+	ErrTooManyPixels     = errors.New("image dimensions exceed limit")
+	ErrCorrupt           = errors.New("image could not be decoded")
+)
+
+// DefaultMaxPixels caps width*height before a full decode (~80MP).
+const DefaultMaxPixels = 80 * 1000 * 1000
+
+// SniffLen is how many leading bytes Sniff needs: enough of an ftyp box for
+// the compatible brands that tell AVIF from HEIC.
+const SniffLen = 64
+
+type signature struct {
+	offset int
+	magic  []byte
+	format Format
+}
+
+var signatures = []signature{
+	{0, []byte{0xFF, 0xD8, 0xFF}, FormatJPEG},
+	{0, []byte("\x89PNG\r\n\x1a\n"), FormatPNG},
+	{0, []byte("GIF87a"), FormatGIF},
+	{0, []byte("GIF89a"), FormatGIF},
+	{8, []byte("WEBP"), FormatWebP}, // RIFF....WEBP
+}
+
+// Sniff identifies the format from magic bytes, ignoring the client's filename.
+func Sniff(head []byte) (Format, error) {
+	if isHEIF(head) {
+		return FormatHEIC, nil
+	}
+	if f := sniffRaw(head); f != "" {
+		return f, nil
+	}
+	if f := sniffVideo(head); f != "" {
+		return f, nil
+	}
+	for _, s := range signatures {
+		end := s.offset + len(s.magic)
+		if len(head) >= end && bytes.Equal(head[s.offset:end], s.magic) {
+			if s.format == FormatWebP && !bytes.HasPrefix(head, []byte("RIFF")) {
+				continue
+			}
+			return s.format, nil
+		}
+	}
+	return "", ErrUnsupportedFormat
+}
+
+// CheckImage sniffs r and reads only the image header to enforce maxPixels
+// before anything is fully decoded; for video, the frame size from the
+// container. r is left at an undefined offset.
+func CheckImage(r io.ReadSeeker, maxPixels int) (Format, image.Config, error) {
+	head := make([]byte, SniffLen)
+	n, _ := io.ReadFull(r, head)
+	format, err := Sniff(head[:n])
+	if err != nil {
+		return "", image.Config{}, err
+	}
+
+	if format == formatTIFF {
+		if format, err = identifyTIFF(r); err != nil {
+			return "", image.Config{}, err
+		}
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", image.Config{}, err
+	}
+	var cfg image.Config
+	if format.IsVideo() {
+		var info *VideoInfo
+		if info, err = ParseVideo(r); err == nil {
+			cfg = image.Config{Width: info.Width, Height: info.Height}
+		}
+	} else if format.IsRaw() {
+		// Limits apply to the preview, which is all we ever decode
+		var preview []byte
+		if preview, err = RawPreview(format, r); err != nil {
+			return format, cfg, err
+		}
+		cfg, err = jpeg.DecodeConfig(bytes.NewReader(preview))
+	} else {
+		cfg, _, err = image.DecodeConfig(r)
+	}
+	if err != nil {
+		return format, cfg, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return format, cfg, ErrCorrupt
+	}
+	if maxPixels > 0 && int64(cfg.Width)*int64(cfg.Height) > int64(maxPixels) {
+		return format, cfg, fmt.Errorf("%w: %dx%d is over %d pixels", ErrTooManyPixels, cfg.Width, cfg.Height, maxPixels)
+	}
+	return format, cfg, nil
+}
@@ -0,0 +1,369 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"math"
+	"mime"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Video formats. Clips are kept and served as uploaded; only their container
+// metadata is read, and a poster frame stands in for them wherever a still is
+// needed (thumbnails, placeholders, palettes).
+const (
+	FormatMP4 Format = "mp4"
+	FormatMOV Format = "mov"
+)
+
+// IsVideo reports whether f is a video format.
+func (f Format) IsVideo() bool {
+	return f == FormatMP4 || f == FormatMOV
+}
+
+// ErrNoPoster means a clip has no embedded cover and ffmpeg isn't installed
+// to pull a frame out of it.
+var ErrNoPoster = errors.New("video has no poster frame (ffmpeg is needed to extract one)")
+
+// mp4Brands are ftyp major brands of ISO/MP4 video.
+var mp4Brands = map[string]bool{
+	"isom": true, "iso2": true, "iso4": true, "iso5": true, "iso6": true,
+	"mp41": true, "mp42": true, "avc1": true, "M4V ": true, "M4VH": true, "M4VP": true,
+	"3gp4": true, "3gp5": true, "3gp6": true, "3g2a": true, "mmp4": true, "XAVC": true,
+}
+
+func sniffVideo(head []byte) Format {
+	if len(head) < 12 {
+		return ""
+	}
+	switch typ, brand := string(head[4:8]), string(head[8:12]); {
+	case typ == "ftyp" && brand == "qt  ":
+		return FormatMOV
+	case typ == "ftyp" && mp4Brands[brand]:
+		return FormatMP4
+	case typ == "moov" || typ == "mdat" || typ == "wide":
+		return FormatMOV // QuickTime files from before ftyp
+	}
+	return ""
+}
+
+func init() {
+	mime.AddExtensionType(".mp4", "video/mp4")
+	mime.AddExtensionType(".mov", "video/quicktime")
+}
+
+// VideoInfo is what a clip's container says about it; no frames are decoded.
+type VideoInfo struct {
+	Width, Height int // displayed size, after the track's rotation
+	Rotation      int // degrees clockwise players turn the frames
+	Duration      time.Duration
+	// CreatedAt is the movie header's creation time, UTC by the spec (some
+	// cameras write local time anyway); zero when unset.
+	CreatedAt time.Time
+	// Meta holds QuickTime metadata ("com.apple.quicktime.make", ...) and
+	// udta text atoms ("©xyz", "©day", ...).
+	Meta map[string]string
+	// Cover is embedded cover art (JPEG or PNG), nil when there is none.
+	Cover []byte
+}
+
+// quicktimeEpoch is when QuickTime and MP4 timestamps count from.
+var quicktimeEpoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ParseVideo reads the moov box of an MP4 or QuickTime file.
+func ParseVideo(r io.ReadSeeker) (*VideoInfo, error) {
+	moov, err := findBox(r, "moov")
+	if err != nil {
+		return nil, err
+	}
+	boxes, err := orderedBoxes(moov)
+	if err != nil {
+		return nil, err
+	}
+	info := &VideoInfo{Meta: map[string]string{}}
+	for _, b := range boxes {
+		switch b.typ {
+		case "mvhd":
+			parseMvhd(b.data, info)
+		case "trak":
+			if info.Width == 0 {
+				parseVideoTrak(b.data, info)
+			}
+		case "meta":
+			parseMeta(b.data, info)
+		case "udta":
+			parseUdta(b.data, info)
+		}
+	}
+	if info.Width <= 0 || info.Height <= 0 {
+		return nil, errors.New("video: no video track")
+	}
+	return info, nil
+}
+
+func parseMvhd(b []byte, info *VideoInfo) {
+	r := &reader{b: b}
+	var created, timescale, duration uint64
+	if r.uint(1) == 1 {
+		r.uint(3)
+		created = r.uint(8)
+		r.uint(8) // modified
+		timescale = r.uint(4)
+		duration = r.uint(8)
+	} else {
+		r.uint(3)
+		created = r.uint(4)
+		r.uint(4)
+		timescale = r.uint(4)
+		duration = r.uint(4)
+	}
+	if r.err != nil {
+		return
+	}
+	if created > 0 {
+		info.CreatedAt = quicktimeEpoch.Add(time.Duration(created) * time.Second)
+	}
+	if timescale > 0 && duration != math.MaxUint32 && duration != math.MaxUint64 {
+		info.Duration = time.Duration(float64(duration) / float64(timescale) * float64(time.Second))
+	}
+}
+
+// parseVideoTrak fills the size and rotation from a track whose handler is "vide".
+func parseVideoTrak(b []byte, info *VideoInfo) {
+	hdlr, err := boxPath(b, "mdia", "hdlr")
+	if err != nil || len(hdlr) < 12 || string(hdlr[8:12]) != "vide" {
+		return
+	}
+	children, err := childBoxes(b)
+	if err != nil {
+		return
+	}
+	r := &reader{b: children["tkhd"]}
+	if r.uint(1) == 1 {
+		r.uint(3 + 8 + 8 + 4 + 4 + 8)
+	} else {
+		r.uint(3 + 4 + 4 + 4 + 4 + 4)
+	}
+	r.uint(8 + 2 + 2 + 2 + 2) // reserved, layer, alternate group, volume, reserved
+	var m [9]int32
+	for i := range m {
+		m[i] = int32(r.uint(4))
+	}
+	w, h := int(r.uint(4)>>16), int(r.uint(4)>>16)
+	if r.err != nil {
+		return
+	}
+	// The matrix is [a b u; c d v; x y w] in 16.16; only right angles occur in practice
+	const one = 1 << 16
+	switch a, bb, c, d := m[0], m[1], m[3], m[4]; {
+	case a == 0 && bb == one && c == -one && d == 0:
+		info.Rotation = 90
+	case a == -one && d == -one:
+		info.Rotation = 180
+	case a == 0 && bb == -one && c == one && d == 0:
+		info.Rotation = 270
+	}
+	if info.Rotation == 90 || info.Rotation == 270 {
+		w, h = h, w
+	}
+	info.Width, info.Height = w, h
+}
+
+// parseMeta reads a meta box: QuickTime's (keys + ilst indexed by key) or
+// iTunes-style (ilst of named atoms, where cover art lives).
+func parseMeta(b []byte, info *VideoInfo) {
+	// ISO meta is a full box; QuickTime's isn't
+	if len(b) >= 8 && binary.BigEndian.Uint32(b) == 0 && string(b[4:8]) != "hdlr" {
+		b = b[4:]
+	}
+	children, err := childBoxes(b)
+	if err != nil {
+		return
+	}
+	var keys []string
+	if k := children["keys"]; k != nil {
+		r := &reader{b: k}
+		r.uint(4) // version, flags
+		for n := r.uint(4); n > 0 && r.err == nil; n-- {
+			size := int(r.uint(4))
+			r.uint(4) // namespace, "mdta"
+			if size < 8 || size-8 > len(r.b) {
+				break
+			}
+			keys = append(keys, string(r.b[:size-8]))
+			r.b = r.b[size-8:]
+		}
+	}
+	items, err := orderedBoxes(children["ilst"])
+	if err != nil {
+		return
+	}
+	for _, item := range items {
+		name := atomName(item.typ)
+		if i := int(binary.BigEndian.Uint32([]byte(item.typ))); i >= 1 && i <= len(keys) {
+			name = keys[i-1]
+		}
+		data, err := boxPath(item.data, "data")
+		if err != nil || len(data) < 8 {
+			continue
+		}
+		switch kind := binary.BigEndian.Uint32(data); {
+		case kind == 1: // UTF-8
+			info.Meta[name] = string(data[8:])
+		case name == "covr" && (kind == 13 || kind == 14): // JPEG, PNG
+			info.Cover = data[8:]
+		}
+	}
+}
+
+// parseUdta reads udta text atoms (©xyz, ©day, ...), each a 16-bit length
+// and language followed by the text, and any iTunes-style meta inside.
+func parseUdta(b []byte, info *VideoInfo) {
+	boxes, err := orderedBoxes(b)
+	if err != nil {
+		return
+	}
+	for _, c := range boxes {
+		if c.typ == "meta" {
+			parseMeta(c.data, info)
+			continue
+		}
+		if c.typ[0] != 0xA9 || len(c.data) < 4 {
+			continue
+		}
+		n := int(binary.BigEndian.Uint16(c.data))
+		if 4+n <= len(c.data) {
+			info.Meta[atomName(c.typ)] = string(c.data[4 : 4+n])
+		}
+	}
+}
+
+// atomName spells atoms starting with the © byte (0xA9) as valid UTF-8.
+func atomName(typ string) string {
+	if typ != "" && typ[0] == 0xA9 {
+		return "©" + typ[1:]
+	}
+	return typ
+}
+
+// LocalTime is the capture time with the offset it was recorded in, from
+// Apple's creationdate or the ©day atom; ok is false when neither has one.
+func (v *VideoInfo) LocalTime() (time.Time, bool) {
+	for _, k := range []string{"com.apple.quicktime.creationdate", "©day"} {
+		for _, layout := range []string{"2006-01-02T15:04:05-0700", time.RFC3339} {
+			if t, err := time.Parse(layout, v.Meta[k]); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+var iso6709 = regexp.MustCompile(`^([+-]\d+(?:\.\d*)?)([+-]\d+(?:\.\d*)?)([+-]\d+(?:\.\d*)?)?/?$`)
+
+// Location is where the clip was shot, from Apple's ISO 6709 key or ©xyz.
+func (v *VideoInfo) Location() (lat, lon float64, ok bool) {
+	for _, k := range []string{"com.apple.quicktime.location.ISO6709", "©xyz"} {
+		m := iso6709.FindStringSubmatch(v.Meta[k])
+		if m == nil {
+			continue
+		}
+		lat, err1 := strconv.ParseFloat(m[1], 64)
+		lon, err2 := strconv.ParseFloat(m[2], 64)
+		if err1 == nil && err2 == nil && math.Abs(lat) <= 90 && math.Abs(lon) <= 180 {
+			return lat, lon, true
+		}
+	}
+	return 0, 0, false
+}
+
+// VideoPosterAvailable reports whether frames can be extracted from clips here.
+func VideoPosterAvailable() bool {
+	_, err := exec.LookPath("ffmpeg")
+	return err == nil
+}
+
+// PosterTimeout bounds one ffmpeg run. Seeking to a frame takes well under a
+// second even in 4K; a run still going after this is stuck on a bad file.
+const PosterTimeout = time.Minute
+
+// VideoPoster returns an upright frame to stand for the clip: one pulled out
+// by ffmpeg when it is on PATH, else the embedded cover art. ffmpeg is
+// killed when ctx ends or after PosterTimeout.
+func VideoPoster(ctx context.Context, r io.ReadSeeker, info *VideoInfo) (image.Image, error) {
+	if bin, err := exec.LookPath("ffmpeg"); err == nil {
+		img, err := ffmpegFrame(ctx, bin, r, info.Duration)
+		if ctx.Err() != nil {
+			return nil, ctx.Err() // no fallback for a cancelled job
+		}
+		if err == nil || info.Cover == nil {
+			return img, err
+		}
+	}
+	if info.Cover != nil {
+		img, _, err := image.Decode(bytes.NewReader(info.Cover))
+		return img, err
+	}
+	return nil, ErrNoPoster
+}
+
+// ffmpegFrame grabs a frame a little into the clip, past fade-ins and black
+// first frames. ffmpeg applies the track rotation itself.
+func ffmpegFrame(ctx context.Context, bin string, r io.ReadSeeker, duration time.Duration) (image.Image, error) {
+	dir, err := MkdirScratch("poster-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	// Spooled originals are already files; anything else is copied out, as
+	// ffmpeg can't seek in a pipe and MP4s often keep their index at the end
+	in := ""
+	if f, ok := r.(*os.File); ok {
+		in = f.Name()
+	} else {
+		in = filepath.Join(dir, "in")
+		f, err := os.Create(in)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = r.Seek(0, io.SeekStart); err == nil {
+			_, err = io.Copy(f, r)
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	at := min(time.Second, duration/2)
+	out := filepath.Join(dir, "poster.png")
+	ctx, cancel := context.WithTimeout(ctx, PosterTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, bin, "-v", "error", "-ss", fmt.Sprintf("%.3f", at.Seconds()), "-i", in, "-frames:v", "1", out)
+	if msg, err := cmd.CombinedOutput(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("ffmpeg: %w", ctx.Err())
+		}
+		return nil, fmt.Errorf("ffmpeg: %v: %s", err, bytes.TrimSpace(msg))
+	}
+	pf, err := os.Open(out)
+	if err != nil {
+		return nil, err
+	}
+	defer pf.Close()
+	return png.Decode(pf)
+}
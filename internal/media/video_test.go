@@ -0,0 +1,194 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// mkbox builds an MP4 box from its payload parts.
+func mkbox(typ string, parts ...[]byte) []byte {
+	payload := bytes.Join(parts, nil)
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(payload)))
+	return append(append(b, typ...), payload...)
+}
+
+// fullBox adds the version and flags of a full box.
+func fullBox(typ string, version byte, parts ...[]byte) []byte {
+	return mkbox(typ, append([][]byte{{version, 0, 0, 0}}, parts...)...)
+}
+
+func u32s(vs ...uint32) []byte {
+	var b []byte
+	for _, v := range vs {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+// Transformation matrices, [a b u; c d v; x y w] in 16.16 (2.30 for u, v, w)
+const fixed1 = 1 << 16
+
+var (
+	matrixNone = []int32{fixed1, 0, 0, 0, fixed1, 0, 0, 0, 1 << 30}
+	matrix90   = []int32{0, fixed1, 0, -fixed1, 0, 0, 0, 0, 1 << 30}
+	matrix180  = []int32{-fixed1, 0, 0, 0, -fixed1, 0, 0, 0, 1 << 30}
+	matrix270  = []int32{0, -fixed1, 0, fixed1, 0, 0, 0, 0, 1 << 30}
+)
+
+// videoTrak is a video track of the stored frame size w x h.
+func videoTrak(w, h int, matrix []int32) []byte {
+	var m []byte
+	for _, v := range matrix {
+		m = binary.BigEndian.AppendUint32(m, uint32(v))
+	}
+	tkhd := fullBox("tkhd", 0, u32s(0, 0, 1, 0, 4200), make([]byte, 8+8), m, u32s(uint32(w)<<16, uint32(h)<<16))
+	hdlr := fullBox("hdlr", 0, u32s(0), []byte("vide"), make([]byte, 12), []byte("v\x00"))
+	return mkbox("trak", tkhd, mkbox("mdia", hdlr))
+}
+
+func soundTrak() []byte {
+	hdlr := fullBox("hdlr", 0, u32s(0), []byte("soun"), make([]byte, 12), []byte("s\x00"))
+	return mkbox("trak", fullBox("tkhd", 0, make([]byte, 80)), mkbox("mdia", hdlr))
+}
+
+// mvhd for a 7s movie created at created (seconds since 1904).
+func mvhd(created uint32) []byte {
+	return fullBox("mvhd", 0, u32s(created, created, 600, 600*7), make([]byte, 80))
+}
+
+// quicktimeMeta is Apple's keys + ilst metadata.
+func quicktimeMeta(kv ...string) []byte {
+	var keys, items []byte
+	for i := 0; i < len(kv); i += 2 {
+		keys = append(keys, mkbox("mdta", []byte(kv[i]))...)
+		items = append(items, mkbox(string(u32s(uint32(i/2+1))), mkbox("data", u32s(1, 0), []byte(kv[i+1])))...)
+	}
+	hdlr := fullBox("hdlr", 0, u32s(0), []byte("mdta"), make([]byte, 12), []byte{0})
+	return mkbox("meta", hdlr, fullBox("keys", 0, u32s(uint32(len(kv)/2)), keys), mkbox("ilst", items))
+}
+
+// udtaText is a udta text atom like ©xyz: length, language, text.
+func udtaText(typ, text string) []byte {
+	return mkbox(typ, binary.BigEndian.AppendUint16(nil, uint16(len(text))), []byte{0x15, 0xC7}, []byte(text))
+}
+
+func clip(ftyp string, moov ...[]byte) []byte {
+	return bytes.Join([][]byte{
+		mkbox("ftyp", []byte(ftyp)),
+		mkbox("moov", moov...),
+		mkbox("mdat", make([]byte, 64)),
+	}, nil)
+}
+
+const (
+	ftypMP4 = "isom\x00\x00\x02\x00isomiso2mp41"
+	ftypMOV = "qt  \x00\x00\x00\x00qt  "
+)
+
+func TestParseVideo(t *testing.T) {
+	created := uint32(time.Date(2024, 3, 11, 2, 30, 0, 0, time.UTC).Sub(quicktimeEpoch) / time.Second)
+	tests := []struct {
+		name     string
+		file     []byte
+		w, h     int
+		rotation int
+		lat, lon float64 // 0, 0 for none
+		local    string  // LocalTime in RFC 3339, "" for none
+		meta     map[string]string
+	}{
+		{
+			name: "plain mp4",
+			file: clip(ftypMP4, mvhd(created), videoTrak(1920, 1080, matrixNone)),
+			w:    1920, h: 1080,
+		},
+		{
+			name: "portrait iPhone clip rotated 90",
+			file: clip(ftypMOV, mvhd(created), soundTrak(), videoTrak(1920, 1080, matrix90)),
+			w:    1080, h: 1920, rotation: 90,
+		},
+		{
+			name: "upside down",
+			file: clip(ftypMOV, mvhd(created), videoTrak(1920, 1080, matrix180)),
+			w:    1920, h: 1080, rotation: 180,
+		},
+		{
+			name: "rotated 270",
+			file: clip(ftypMOV, mvhd(created), videoTrak(1280, 720, matrix270)),
+			w:    720, h: 1280, rotation: 270,
+		},
+		{
+			name: "QuickTime keys and ilst",
+			file: clip(ftypMOV, mvhd(created), videoTrak(1920, 1080, matrix90), quicktimeMeta(
+				"com.apple.quicktime.make", "Apple",
+				"com.apple.quicktime.model", "iPhone 15",
+				"com.apple.quicktime.creationdate", "2024-03-10T21:30:00-0500",
+				"com.apple.quicktime.location.ISO6709", "+40.7128-074.0060+010.000/",
+			)),
+			w: 1080, h: 1920, rotation: 90,
+			lat: 40.7128, lon: -74.006,
+			local: "2024-03-10T21:30:00-05:00",
+			meta:  map[string]string{"com.apple.quicktime.make": "Apple", "com.apple.quicktime.model": "iPhone 15"},
+		},
+		{
+			name: "udta ©xyz and ©day",
+			file: clip(ftypMP4, mvhd(created), videoTrak(3840, 2160, matrixNone), mkbox("udta",
+				udtaText("\xa9xyz", "-33.8688+151.2093/"),
+				udtaText("\xa9day", "2024-03-11T13:30:00+11:00"),
+			)),
+			w: 3840, h: 2160,
+			lat: -33.8688, lon: 151.2093,
+			local: "2024-03-11T13:30:00+11:00",
+		},
+		{
+			name: "keys win over ©xyz",
+			file: clip(ftypMOV, mvhd(created), videoTrak(1920, 1080, matrixNone),
+				quicktimeMeta("com.apple.quicktime.location.ISO6709", "+48.8584+002.2945/"),
+				mkbox("udta", udtaText("\xa9xyz", "+51.5007-000.1246/"))),
+			w: 1920, h: 1080,
+			lat: 48.8584, lon: 2.2945,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := ParseVideo(bytes.NewReader(tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Width != tt.w || info.Height != tt.h || info.Rotation != tt.rotation {
+				t.Errorf("size %dx%d rotation %d, want %dx%d rotation %d",
+					info.Width, info.Height, info.Rotation, tt.w, tt.h, tt.rotation)
+			}
+			if info.Duration != 7*time.Second {
+				t.Errorf("duration %s, want 7s", info.Duration)
+			}
+			if want := quicktimeEpoch.Add(time.Duration(created) * time.Second); !info.CreatedAt.Equal(want) {
+				t.Errorf("created %s, want %s", info.CreatedAt, want)
+			}
+
+			lat, lon, ok := info.Location()
+			if ok != (tt.lat != 0 || tt.lon != 0) || lat != tt.lat || lon != tt.lon {
+				t.Errorf("location %v, %v, %v; want %v, %v", lat, lon, ok, tt.lat, tt.lon)
+			}
+			got := ""
+			if local, ok := info.LocalTime(); ok {
+				got = local.Format(time.RFC3339)
+			}
+			if got != tt.local {
+				t.Errorf("local time %q, want %q", got, tt.local)
+			}
+			for k, v := range tt.meta {
+				if info.Meta[k] != v {
+					t.Errorf("Meta[%q] = %q, want %q", k, info.Meta[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestParseVideoWithoutVideoTrack(t *testing.T) {
+	if _, err := ParseVideo(bytes.NewReader(clip(ftypMP4, mvhd(1), soundTrak()))); err == nil {
+		t.Error("audio-only file parsed as video")
+	}
+}
@@ -0,0 +1,807 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+)
+
+// WebPQuality is the quality WebP renditions are encoded at, from 1 to 100.
+const WebPQuality = 80
+
+// WebPEncoder writes lossy WebP in pure Go, so WebP renditions need nothing
+// installed.
+var WebPEncoder = Encoder{
+	Format:      FormatWebP,
+	ContentType: "image/webp",
+	Encode: func(ctx context.Context, w io.Writer, img image.Image) error {
+		return EncodeWebP(ctx, w, img, WebPQuality)
+	},
+}
+
+// EncodeWebP writes img as a lossy WebP: a single VP8 key frame (RFC 6386).
+// The encoder is deliberately simple: whole-macroblock prediction only (no
+// 4x4 modes), one quantizer and the default token probabilities. Files come
+// out somewhat larger than cwebp's at the same quality, and still smaller
+// than JPEG. Alpha is dropped.
+func EncodeWebP(ctx context.Context, w io.Writer, img image.Image, quality int) error {
+	b := img.Bounds()
+	if b.Empty() || b.Dx() > 16383 || b.Dy() > 16383 {
+		return fmt.Errorf("webp: cannot encode a %dx%d image", b.Dx(), b.Dy())
+	}
+	e := newVP8Encoder(img, quality)
+	frame, err := e.encode(ctx)
+	if err != nil {
+		return err
+	}
+
+	var hdr [20]byte
+	size := len(frame) + len(frame)&1
+	copy(hdr[0:], "RIFF")
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(12+size))
+	copy(hdr[8:], "WEBPVP8 ")
+	binary.LittleEndian.PutUint32(hdr[16:], uint32(len(frame)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if len(frame)&1 == 1 {
+		frame = append(frame, 0)
+	}
+	_, err = w.Write(frame)
+	return err
+}
+
+// VP8 token planes (section 13.3). Luma always goes through Y2 here, so
+// vp8PlaneYWithDC is never coded.
+const (
+	vp8PlaneYNoDC = iota
+	vp8PlaneY2
+	vp8PlaneUV
+	vp8PlaneYWithDC
+	vp8Planes
+)
+
+// Prediction modes of a 16x16 luma or 8x8 chroma block (section 12.2).
+const (
+	vp8PredDC = iota
+	vp8PredV
+	vp8PredH
+	vp8PredTM
+)
+
+var (
+	vp8Bands  = [17]uint8{0, 1, 2, 3, 6, 4, 5, 6, 6, 6, 6, 6, 6, 6, 6, 7, 0}
+	vp8Zigzag = [16]uint8{0, 1, 4, 8, 5, 2, 3, 6, 9, 12, 13, 10, 7, 11, 14, 15}
+	// Extra-bit probabilities of DCT_CAT3 to DCT_CAT6 (section 13.2)
+	vp8CatProbs = [4][]uint8{
+		{173, 148, 140},
+		{176, 155, 140, 135},
+		{180, 157, 141, 134, 130},
+		{254, 254, 243, 230, 196, 177, 153, 140, 133, 130, 129},
+	}
+)
+
+// vp8Nz records which 4x4 blocks along a macroblock's bottom or right edge
+// had coefficients: the context for coding its neighbours' tokens.
+type vp8Nz struct {
+	y    [4]uint8
+	u, v [2]uint8
+	y2   uint8
+}
+
+type vp8Encoder struct {
+	w, h     int
+	mbw, mbh int
+	// Source and reconstruction planes (Y, U, V), padded to whole
+	// macroblocks. Prediction works from the reconstruction, as a decoder's does.
+	src, rec [3][]uint8
+	stride   [3]int
+
+	qi                     int
+	y1Step, y2Step, uvStep [2]int32 // DC, AC
+	filterLevel            int
+	tokens                 boolEncoder
+	modes                  []uint8 // per macroblock: luma mode, chroma mode<<2, skipped<<4
+	topNz                  []vp8Nz
+	leftNz                 vp8Nz
+}
+
+func newVP8Encoder(img image.Image, quality int) *vp8Encoder {
+	b := img.Bounds()
+	e := &vp8Encoder{w: b.Dx(), h: b.Dy()}
+	e.mbw, e.mbh = (e.w+15)/16, (e.h+15)/16
+	e.stride = [3]int{16 * e.mbw, 8 * e.mbw, 8 * e.mbw}
+	for p := range e.src {
+		n := e.stride[p] * e.mbh * 16
+		if p > 0 {
+			n /= 2
+		}
+		e.src[p] = make([]uint8, n)
+		e.rec[p] = make([]uint8, n)
+	}
+	e.modes = make([]uint8, e.mbw*e.mbh)
+	e.topNz = make([]vp8Nz, e.mbw)
+
+	// Quality 100 is the finest quantizer index, 1 the coarsest
+	quality = min(max(quality, 1), 100)
+	e.qi = (100 - quality) * 127 / 99
+	e.y1Step = [2]int32{int32(vp8DCSteps[e.qi]), int32(vp8ACSteps[e.qi])}
+	e.y2Step = [2]int32{int32(vp8DCSteps[e.qi]) * 2, max(int32(vp8ACSteps[e.qi])*155/100, 8)}
+	e.uvStep = [2]int32{int32(vp8DCSteps[min(e.qi, 117)]), int32(vp8ACSteps[e.qi])}
+	// Smooth block edges in proportion to how coarse the quantizer is
+	e.filterLevel = min(e.qi*3/8+4, 63)
+
+	e.load(img)
+	return e
+}
+
+// load converts img to limited-range BT.601 YUV 4:2:0, the way libwebp
+// does, repeating the last row and column to fill the padding.
+func (e *vp8Encoder) load(img image.Image) {
+	b := img.Bounds()
+	rgb := rgbReader(img)
+	at := func(x, y int) (int32, int32, int32) {
+		return rgb(b.Min.X+min(x, e.w-1), b.Min.Y+min(y, e.h-1))
+	}
+	for y := 0; y < 16*e.mbh; y++ {
+		for x := 0; x < 16*e.mbw; x++ {
+			r, g, bl := at(x, y)
+			e.src[0][y*e.stride[0]+x] = clipYUV((16839*r + 33059*g + 6420*bl + 16<<16 + 1<<15) >> 16)
+		}
+	}
+	for y := 0; y < 8*e.mbh; y++ {
+		for x := 0; x < 8*e.mbw; x++ {
+			var r, g, bl int32
+			for _, d := range [4][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				r1, g1, b1 := at(2*x+d[0], 2*y+d[1])
+				r, g, bl = r+r1, g+g1, bl+b1
+			}
+			e.src[1][y*e.stride[1]+x] = clipYUV((-9719*r - 19081*g + 28800*bl + 128<<18 + 1<<17) >> 18)
+			e.src[2][y*e.stride[2]+x] = clipYUV((28800*r - 24116*g - 4684*bl + 128<<18 + 1<<17) >> 18)
+		}
+	}
+}
+
+// rgbReader returns a function reading 8-bit RGB, with fast paths for the
+// image types renditions are made of.
+func rgbReader(img image.Image) func(x, y int) (r, g, b int32) {
+	switch m := img.(type) {
+	case *image.NRGBA:
+		return func(x, y int) (int32, int32, int32) {
+			i := m.PixOffset(x, y)
+			return int32(m.Pix[i]), int32(m.Pix[i+1]), int32(m.Pix[i+2])
+		}
+	case *image.RGBA:
+		return func(x, y int) (int32, int32, int32) {
+			i := m.PixOffset(x, y)
+			return int32(m.Pix[i]), int32(m.Pix[i+1]), int32(m.Pix[i+2])
+		}
+	case *image.YCbCr:
+		return func(x, y int) (int32, int32, int32) {
+			yi, ci := m.YOffset(x, y), m.COffset(x, y)
+			r, g, b := color.YCbCrToRGB(m.Y[yi], m.Cb[ci], m.Cr[ci])
+			return int32(r), int32(g), int32(b)
+		}
+	}
+	return func(x, y int) (int32, int32, int32) {
+		c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+		return int32(c.R), int32(c.G), int32(c.B)
+	}
+}
+
+func clipYUV(v int32) uint8 {
+	return uint8(min(max(v, 0), 255))
+}
+
+// encode returns the VP8 frame: frame tag, key frame header, the first
+// partition (headers and modes) and a single token partition.
+func (e *vp8Encoder) encode(ctx context.Context) ([]byte, error) {
+	skipped := 0
+	for mby := 0; mby < e.mbh; mby++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		e.leftNz = vp8Nz{}
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			m := e.macroblock(mbx, mby)
+			e.modes[mby*e.mbw+mbx] = m
+			if m&0x10 != 0 {
+				skipped++
+			}
+		}
+	}
+	tokens := e.tokens.flush()
+
+	var hdr boolEncoder
+	hdr.putLiteral(0, 2) // color space, clamping
+	hdr.putFlag(false)   // segmentation
+	hdr.putFlag(false)   // normal loop filter
+	hdr.putLiteral(e.filterLevel, 6)
+	hdr.putLiteral(0, 3) // sharpness
+	hdr.putFlag(false)   // loop filter deltas
+	hdr.putLiteral(0, 2) // one token partition
+	hdr.putLiteral(e.qi, 7)
+	for i := 0; i < 5; i++ {
+		hdr.putFlag(false) // no per-plane quantizer deltas
+	}
+	hdr.putFlag(false) // refresh_entropy_probs
+	for i := range vp8UpdateProbs {
+		for j := range vp8UpdateProbs[i] {
+			for k := range vp8UpdateProbs[i][j] {
+				for _, p := range vp8UpdateProbs[i][j][k] {
+					hdr.putBit(false, p)
+				}
+			}
+		}
+	}
+	total := e.mbw * e.mbh
+	skipProb := uint8(min(max((total-skipped)*255/total, 1), 255))
+	hdr.putFlag(true)
+	hdr.putLiteral(int(skipProb), 8)
+	for _, m := range e.modes {
+		hdr.putBit(m&0x10 != 0, skipProb)
+		hdr.putBit(true, 145) // 16x16 luma prediction
+		switch m & 3 {
+		case vp8PredDC:
+			hdr.putBit(false, 156)
+			hdr.putBit(false, 163)
+		case vp8PredV:
+			hdr.putBit(false, 156)
+			hdr.putBit(true, 163)
+		case vp8PredH:
+			hdr.putBit(true, 156)
+			hdr.putBit(false, 128)
+		case vp8PredTM:
+			hdr.putBit(true, 156)
+			hdr.putBit(true, 128)
+		}
+		uv := m >> 2 & 3
+		hdr.putBit(uv != vp8PredDC, 142)
+		if uv != vp8PredDC {
+			hdr.putBit(uv != vp8PredV, 114)
+			if uv != vp8PredV {
+				hdr.putBit(uv == vp8PredTM, 183)
+			}
+		}
+	}
+	first := hdr.flush()
+	if len(first) >= 1<<19 {
+		return nil, fmt.Errorf("webp: %dx%d image is too large for one frame", e.w, e.h)
+	}
+
+	var buf bytes.Buffer
+	tag := uint32(len(first))<<5 | 1<<4 // key frame, version 0, shown
+	buf.Write([]byte{byte(tag), byte(tag >> 8), byte(tag >> 16), 0x9d, 0x01, 0x2a})
+	binary.Write(&buf, binary.LittleEndian, [2]uint16{uint16(e.w), uint16(e.h)})
+	buf.Write(first)
+	buf.Write(tokens)
+	return buf.Bytes(), nil
+}
+
+// macroblock predicts, transforms and quantizes one macroblock, writes its
+// tokens and reconstructs it. It returns its modes and whether it has no
+// coefficients at all.
+func (e *vp8Encoder) macroblock(mbx, mby int) uint8 {
+	var ypred [256]uint8
+	ymode := e.bestMode(0, 16, mbx, mby, ypred[:])
+
+	// Luma: the 16 DC coefficients go through the second-order transform
+	var ylv [16][16]int32
+	var dcs, y2, y2lv [16]int32
+	var coeffs [16][16]int32
+	for n := 0; n < 16; n++ {
+		var res [16]int32
+		e.residual(0, mbx*16+n%4*4, mby*16+n/4*4, ypred[:], 16, n%4*4, n/4*4, &res)
+		vp8FDCT(&res, &coeffs[n])
+		dcs[n] = coeffs[n][0]
+		for i := 1; i < 16; i++ {
+			ylv[n][i] = quantize(coeffs[n][i], e.y1Step[1], false)
+		}
+	}
+	vp8FWHT(&dcs, &y2)
+	for i := range y2 {
+		y2lv[i] = quantize(y2[i], e.y2Step[min(i, 1)], true)
+	}
+
+	// Chroma: one mode for both planes
+	var upred, vpred [64]uint8
+	uvmode := e.bestChromaMode(mbx, mby, upred[:], vpred[:])
+	var ulv, vlv [4][16]int32
+	for p, lv := range [2]*[4][16]int32{&ulv, &vlv} {
+		pred := [2][]uint8{upred[:], vpred[:]}[p]
+		for n := 0; n < 4; n++ {
+			var res, c [16]int32
+			e.residual(p+1, mbx*8+n%2*4, mby*8+n/2*4, pred, 8, n%2*4, n/2*4, &res)
+			vp8FDCT(&res, &c)
+			for i := range c {
+				lv[n][i] = quantize(c[i], e.uvStep[min(i, 1)], i == 0)
+			}
+		}
+	}
+
+	skip := allZero(y2lv[:])
+	for n := 0; n < 16 && skip; n++ {
+		skip = allZero(ylv[n][:])
+	}
+	for n := 0; n < 4 && skip; n++ {
+		skip = allZero(ulv[n][:]) && allZero(vlv[n][:])
+	}
+	top, left := &e.topNz[mbx], &e.leftNz
+	if skip {
+		*top, *left = vp8Nz{}, vp8Nz{}
+	} else {
+		nz := e.putBlock(vp8PlaneY2, left.y2+top.y2, &y2lv, 0)
+		left.y2, top.y2 = nz, nz
+		for n := 0; n < 16; n++ {
+			x, y := n%4, n/4
+			nz := e.putBlock(vp8PlaneYNoDC, left.y[y]+top.y[x], &ylv[n], 1)
+			left.y[y], top.y[x] = nz, nz
+		}
+		for p, lv := range [2]*[4][16]int32{&ulv, &vlv} {
+			l, t := &left.u, &top.u
+			if p == 1 {
+				l, t = &left.v, &top.v
+			}
+			for n := 0; n < 4; n++ {
+				x, y := n%2, n/2
+				nz := e.putBlock(vp8PlaneUV, l[y]+t[x], &lv[n], 0)
+				l[y], t[x] = nz, nz
+			}
+		}
+	}
+
+	// Reconstruct exactly as a decoder will
+	var y2dq, dcrec [16]int32
+	for i := range y2lv {
+		y2dq[i] = y2lv[i] * e.y2Step[min(i, 1)]
+	}
+	vp8IWHT(&y2dq, &dcrec)
+	e.putPred(0, mbx*16, mby*16, ypred[:], 16)
+	for n := 0; n < 16; n++ {
+		var dq [16]int32
+		dq[0] = dcrec[n]
+		for i := 1; i < 16; i++ {
+			dq[i] = ylv[n][i] * e.y1Step[1]
+		}
+		e.addIDCT(0, mbx*16+n%4*4, mby*16+n/4*4, &dq)
+	}
+	for p, lv := range [2]*[4][16]int32{&ulv, &vlv} {
+		e.putPred(p+1, mbx*8, mby*8, [2][]uint8{upred[:], vpred[:]}[p], 8)
+		for n := 0; n < 4; n++ {
+			var dq [16]int32
+			for i := range dq {
+				dq[i] = lv[n][i] * e.uvStep[min(i, 1)]
+			}
+			e.addIDCT(p+1, mbx*8+n%2*4, mby*8+n/2*4, &dq)
+		}
+	}
+
+	m := ymode | uvmode<<2
+	if skip {
+		m |= 0x10
+	}
+	return m
+}
+
+// modes lists the prediction modes whose neighbours exist.
+func modes(mbx, mby int) []uint8 {
+	switch {
+	case mbx > 0 && mby > 0:
+		return []uint8{vp8PredDC, vp8PredV, vp8PredH, vp8PredTM}
+	case mby > 0:
+		return []uint8{vp8PredDC, vp8PredV}
+	case mbx > 0:
+		return []uint8{vp8PredDC, vp8PredH}
+	}
+	return []uint8{vp8PredDC}
+}
+
+// bestMode leaves in pred the prediction of plane p's size x size block with
+// the least squared error, and returns its mode.
+func (e *vp8Encoder) bestMode(p, size, mbx, mby int, pred []uint8) uint8 {
+	best, bestErr := uint8(0), int64(-1)
+	tmp := make([]uint8, size*size)
+	for _, mode := range modes(mbx, mby) {
+		e.predict(p, size, mbx, mby, mode, tmp)
+		if err := e.sse(p, size, mbx, mby, tmp); bestErr < 0 || err < bestErr {
+			best, bestErr = mode, err
+			copy(pred, tmp)
+		}
+	}
+	return best
+}
+
+func (e *vp8Encoder) bestChromaMode(mbx, mby int, upred, vpred []uint8) uint8 {
+	best, bestErr := uint8(0), int64(-1)
+	var u, v [64]uint8
+	for _, mode := range modes(mbx, mby) {
+		e.predict(1, 8, mbx, mby, mode, u[:])
+		e.predict(2, 8, mbx, mby, mode, v[:])
+		if err := e.sse(1, 8, mbx, mby, u[:]) + e.sse(2, 8, mbx, mby, v[:]); bestErr < 0 || err < bestErr {
+			best, bestErr = mode, err
+			copy(upred, u[:])
+			copy(vpred, v[:])
+		}
+	}
+	return best
+}
+
+// predict fills pred with a prediction of plane p's block from the
+// reconstructed row above and column left of it (section 12.2).
+func (e *vp8Encoder) predict(p, size, mbx, mby int, mode uint8, pred []uint8) {
+	rec, stride := e.rec[p], e.stride[p]
+	x0, y0 := mbx*size, mby*size
+	top := func(i int) int32 { return int32(rec[(y0-1)*stride+x0+i]) }
+	left := func(j int) int32 { return int32(rec[(y0+j)*stride+x0-1]) }
+	for j := 0; j < size; j++ {
+		for i := 0; i < size; i++ {
+			var v int32
+			switch mode {
+			case vp8PredV:
+				v = top(i)
+			case vp8PredH:
+				v = left(j)
+			case vp8PredTM:
+				v = min(max(left(j)+top(i)-int32(rec[(y0-1)*stride+x0-1]), 0), 255)
+			}
+			pred[j*size+i] = uint8(v)
+		}
+	}
+	if mode != vp8PredDC {
+		return
+	}
+	// Without neighbours on one side DC averages the other, without both it is 128
+	sum, n := int32(0), int32(0)
+	for i := 0; i < size; i++ {
+		if mby > 0 {
+			sum += top(i)
+			n++
+		}
+		if mbx > 0 {
+			sum += left(i)
+			n++
+		}
+	}
+	dc := uint8(128)
+	if n > 0 {
+		dc = uint8((sum + n/2) / n)
+	}
+	for i := range pred[:size*size] {
+		pred[i] = dc
+	}
+}
+
+func (e *vp8Encoder) sse(p, size, mbx, mby int, pred []uint8) int64 {
+	src, stride := e.src[p], e.stride[p]
+	var sum int64
+	for j := 0; j < size; j++ {
+		row := src[(mby*size+j)*stride+mbx*size:]
+		for i := 0; i < size; i++ {
+			d := int64(row[i]) - int64(pred[j*size+i])
+			sum += d * d
+		}
+	}
+	return sum
+}
+
+// residual is the source minus the prediction over the 4x4 block at (x, y)
+// of plane p, which is at (px, py) in pred.
+func (e *vp8Encoder) residual(p, x, y int, pred []uint8, predStride, px, py int, res *[16]int32) {
+	src, stride := e.src[p], e.stride[p]
+	for j := 0; j < 4; j++ {
+		for i := 0; i < 4; i++ {
+			res[j*4+i] = int32(src[(y+j)*stride+x+i]) - int32(pred[(py+j)*predStride+px+i])
+		}
+	}
+}
+
+func (e *vp8Encoder) putPred(p, x, y int, pred []uint8, size int) {
+	for j := 0; j < size; j++ {
+		copy(e.rec[p][(y+j)*e.stride[p]+x:], pred[j*size:(j+1)*size])
+	}
+}
+
+func quantize(c, step int32, dc bool) int32 {
+	// A dead zone for AC: small coefficients cost more bits than they're worth
+	bias := step * 3 / 8
+	if dc {
+		bias = step / 2
+	}
+	neg := c < 0
+	if neg {
+		c = -c
+	}
+	lv := min((c+bias)/step, 2048)
+	if neg {
+		return -lv
+	}
+	return lv
+}
+
+func allZero(lv []int32) bool {
+	for _, v := range lv {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// putBlock writes one block's coefficient tokens (section 13) from index
+// first on and returns whether there were any.
+func (e *vp8Encoder) putBlock(plane int, ctx uint8, lv *[16]int32, first int) uint8 {
+	var zz [16]int32
+	last := -1
+	for n := first; n < 16; n++ {
+		if zz[n] = lv[vp8Zigzag[n]]; zz[n] != 0 {
+			last = n
+		}
+	}
+	probs, t := &vp8DefaultProbs[plane], &e.tokens
+	n := first
+	p := &probs[vp8Bands[n]][ctx]
+	if last < 0 {
+		t.putBit(false, p[0]) // end of block
+		return 0
+	}
+	t.putBit(true, p[0])
+	for {
+		v := zz[n]
+		n++
+		neg := v < 0
+		if neg {
+			v = -v
+		}
+		if v == 0 {
+			// A zero is never followed by the end of the block
+			t.putBit(false, p[1])
+			p = &probs[vp8Bands[n]][0]
+			continue
+		}
+		t.putBit(true, p[1])
+		if v == 1 {
+			t.putBit(false, p[2])
+			p = &probs[vp8Bands[n]][1]
+		} else {
+			t.putBit(true, p[2])
+			putLevel(t, p, v)
+			p = &probs[vp8Bands[n]][2]
+		}
+		t.putFlag(neg)
+		if n == 16 {
+			return 1
+		}
+		if n > last {
+			t.putBit(false, p[0])
+			return 1
+		}
+		t.putBit(true, p[0])
+	}
+}
+
+// putLevel writes a coefficient magnitude of 2 or more.
+func putLevel(t *boolEncoder, p *[11]uint8, v int32) {
+	switch {
+	case v <= 4:
+		t.putBit(false, p[3])
+		t.putBit(v != 2, p[4])
+		if v != 2 {
+			t.putBit(v == 4, p[5])
+		}
+	case v <= 10:
+		t.putBit(true, p[3])
+		t.putBit(false, p[6])
+		if v <= 6 {
+			t.putBit(false, p[7])
+			t.putBit(v == 6, 159)
+		} else {
+			t.putBit(true, p[7])
+			t.putBit((v-7)&2 != 0, 165)
+			t.putBit((v-7)&1 != 0, 145)
+		}
+	default:
+		t.putBit(true, p[3])
+		t.putBit(true, p[6])
+		cat := 0
+		for cat < 3 && v >= 3+8<<(cat+1) {
+			cat++
+		}
+		t.putBit(cat >= 2, p[8])
+		t.putBit(cat&1 == 1, p[9+cat>>1])
+		v -= 3 + 8<<cat
+		probs := vp8CatProbs[cat]
+		for i, prob := range probs {
+			t.putBit(v>>(len(probs)-1-i)&1 == 1, prob)
+		}
+	}
+}
+
+// addIDCT adds the inverse transform of coefficients c to the predicted
+// 4x4 block at (x, y) of plane p, bit-exactly as libwebp decodes it.
+func (e *vp8Encoder) addIDCT(p, x, y int, c *[16]int32) {
+	const (
+		c1 = 85627 // 65536 * cos(pi/8) * sqrt(2)
+		c2 = 35468 // 65536 * sin(pi/8) * sqrt(2)
+	)
+	var m [4][4]int32
+	for i := 0; i < 4; i++ {
+		a := c[i] + c[8+i]
+		b := c[i] - c[8+i]
+		cc := (c[4+i]*c2)>>16 - (c[12+i]*c1)>>16
+		d := (c[4+i]*c1)>>16 + (c[12+i]*c2)>>16
+		m[i] = [4]int32{a + d, b + cc, b - cc, a - d}
+	}
+	rec, stride := e.rec[p], e.stride[p]
+	for j := 0; j < 4; j++ {
+		dc := m[0][j] + 4
+		a := dc + m[2][j]
+		b := dc - m[2][j]
+		cc := (m[1][j]*c2)>>16 - (m[3][j]*c1)>>16
+		d := (m[1][j]*c1)>>16 + (m[3][j]*c2)>>16
+		row := rec[(y+j)*stride+x:]
+		for i, v := range [4]int32{a + d, b + cc, b - cc, a - d} {
+			row[i] = clipYUV(int32(row[i]) + v>>3)
+		}
+	}
+}
+
+// vp8FDCT is libvpx's forward 4x4 DCT, the inverse of addIDCT.
+func vp8FDCT(in, out *[16]int32) {
+	var t [16]int32
+	for i := 0; i < 4; i++ {
+		r := in[i*4 : i*4+4]
+		a := (r[0] + r[3]) * 8
+		b := (r[1] + r[2]) * 8
+		c := (r[1] - r[2]) * 8
+		d := (r[0] - r[3]) * 8
+		t[i*4+0] = a + b
+		t[i*4+2] = a - b
+		t[i*4+1] = (c*2217 + d*5352 + 14500) >> 12
+		t[i*4+3] = (d*2217 - c*5352 + 7500) >> 12
+	}
+	for i := 0; i < 4; i++ {
+		a := t[i] + t[12+i]
+		b := t[4+i] + t[8+i]
+		c := t[4+i] - t[8+i]
+		d := t[i] - t[12+i]
+		out[i] = (a + b + 7) >> 4
+		out[8+i] = (a - b + 7) >> 4
+		out[4+i] = (c*2217+d*5352+12000)>>16 + b2i(d != 0)
+		out[12+i] = (d*2217 - c*5352 + 51000) >> 16
+	}
+}
+
+// vp8FWHT is libvpx's forward Walsh-Hadamard transform of the 16 luma DCs.
+func vp8FWHT(in, out *[16]int32) {
+	var t [16]int32
+	for i := 0; i < 4; i++ {
+		r := in[i*4 : i*4+4]
+		a := (r[0] + r[2]) * 4
+		d := (r[1] + r[3]) * 4
+		c := (r[1] - r[3]) * 4
+		b := (r[0] - r[2]) * 4
+		t[i*4+0] = a + d + b2i(a != 0)
+		t[i*4+1] = b + c
+		t[i*4+2] = b - c
+		t[i*4+3] = a - d
+	}
+	for i := 0; i < 4; i++ {
+		a := t[i] + t[8+i]
+		d := t[4+i] + t[12+i]
+		c := t[4+i] - t[12+i]
+		b := t[i] - t[8+i]
+		for k, v := range [4]int32{a + d, b + c, b - c, a - d} {
+			v += b2i(v < 0)
+			out[4*k+i] = (v + 3) >> 3
+		}
+	}
+}
+
+// vp8IWHT is the decoder's inverse WHT: the DC of each luma block.
+func vp8IWHT(in, out *[16]int32) {
+	var m [16]int32
+	for i := 0; i < 4; i++ {
+		a0 := in[i] + in[12+i]
+		a1 := in[4+i] + in[8+i]
+		a2 := in[4+i] - in[8+i]
+		a3 := in[i] - in[12+i]
+		m[i] = a0 + a1
+		m[8+i] = a0 - a1
+		m[4+i] = a3 + a2
+		m[12+i] = a3 - a2
+	}
+	for i := 0; i < 4; i++ {
+		dc := m[i*4] + 3
+		a0 := dc + m[i*4+3]
+		a1 := m[i*4+1] + m[i*4+2]
+		a2 := m[i*4+1] - m[i*4+2]
+		a3 := dc - m[i*4+3]
+		out[i*4+0] = (a0 + a1) >> 3
+		out[i*4+1] = (a3 + a2) >> 3
+		out[i*4+2] = (a0 - a1) >> 3
+		out[i*4+3] = (a3 - a2) >> 3
+	}
+}
+
+func b2i(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// boolEncoder is VP8's boolean entropy encoder (section 7.3).
+type boolEncoder struct {
+	buf      []byte
+	rng      uint32
+	bottom   uint32
+	bitCount int
+}
+
+// putBit writes bit, which is false with probability prob/256.
+func (e *boolEncoder) putBit(bit bool, prob uint8) {
+	if e.rng == 0 {
+		e.rng, e.bitCount = 255, 24
+	}
+	split := 1 + (e.rng-1)*uint32(prob)>>8
+	if bit {
+		e.bottom += split
+		e.rng -= split
+	} else {
+		e.rng = split
+	}
+	for e.rng < 128 {
+		e.rng <<= 1
+		if e.bottom&(1<<31) != 0 {
+			e.carry()
+		}
+		e.bottom <<= 1
+		if e.bitCount--; e.bitCount == 0 {
+			e.buf = append(e.buf, byte(e.bottom>>24))
+			e.bottom &= 1<<24 - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+func (e *boolEncoder) putFlag(bit bool) {
+	e.putBit(bit, 128)
+}
+
+// putLiteral writes the low n bits of v, most significant first.
+func (e *boolEncoder) putLiteral(v, n int) {
+	for n--; n >= 0; n-- {
+		e.putFlag(v>>n&1 == 1)
+	}
+}
+
+func (e *boolEncoder) carry() {
+	i := len(e.buf) - 1
+	for ; e.buf[i] == 255; i-- {
+		e.buf[i] = 0
+	}
+	e.buf[i]++
+}
+
+func (e *boolEncoder) flush() []byte {
+	if e.rng == 0 {
+		e.rng, e.bitCount = 255, 24
+	}
+	c, v := e.bitCount, e.bottom
+	if v&(1<<(32-c)) != 0 {
+		e.carry()
+	}
+	v <<= c & 7
+	for c >>= 3; c > 0; c-- {
+		v <<= 8
+	}
+	for i := 0; i < 4; i++ {
+		e.buf = append(e.buf, byte(v>>24))
+		v <<= 8
+	}
+	return e.buf
+}
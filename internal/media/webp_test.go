@@ -0,0 +1,120 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func TestVP8Transforms(t *testing.T) {
+	// The decoder's inverse transforms must undo the forward ones
+	for seed := int32(0); seed < 20; seed++ {
+		var res, c [16]int32
+		for i := range res {
+			res[i] = (seed*37+int32(i)*53)%255 - 127
+		}
+		vp8FDCT(&res, &c)
+		e := &vp8Encoder{rec: [3][]uint8{make([]uint8, 16)}, stride: [3]int{4}}
+		for i := range e.rec[0] {
+			e.rec[0][i] = 128
+		}
+		e.addIDCT(0, 0, 0, &c)
+		for i, v := range e.rec[0] {
+			if d := int32(v) - 128 - res[i]; d < -1 || d > 1 {
+				t.Fatalf("seed %d: DCT round trip of %v gave %v", seed, res, e.rec[0])
+			}
+		}
+
+		var dcs, y2, back [16]int32
+		for i := range dcs {
+			dcs[i] = (seed*101+int32(i)*211)%4000 - 2000
+		}
+		vp8FWHT(&dcs, &y2)
+		vp8IWHT(&y2, &back)
+		for i := range dcs {
+			if d := back[i] - dcs[i]; d < -1 || d > 1 {
+				t.Fatalf("seed %d: WHT round trip of %v gave %v", seed, dcs, back)
+			}
+		}
+	}
+}
+
+func TestEncodeWebP(t *testing.T) {
+	tests := []struct {
+		w, h    int
+		quality int
+		minPSNR float64
+	}{
+		{w: 1, h: 1, quality: 80, minPSNR: 30},
+		{w: 16, h: 16, quality: 80, minPSNR: 30},
+		{w: 67, h: 33, quality: 80, minPSNR: 30},
+		{w: 300, h: 200, quality: 80, minPSNR: 30},
+		{w: 300, h: 200, quality: 100, minPSNR: 40},
+		{w: 123, h: 77, quality: 1, minPSNR: 18},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%dx%d_q%d", tt.w, tt.h, tt.quality), func(t *testing.T) {
+			src := testPattern(tt.w, tt.h)
+			var buf bytes.Buffer
+			if err := EncodeWebP(context.Background(), &buf, src, tt.quality); err != nil {
+				t.Fatal(err)
+			}
+			got, err := webp.Decode(&buf)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if got.Bounds() != src.Bounds() {
+				t.Fatalf("decoded bounds %v, want %v", got.Bounds(), src.Bounds())
+			}
+			if psnr := lumaPSNR(newVP8Encoder(src, tt.quality), got.(*image.YCbCr)); psnr < tt.minPSNR {
+				t.Errorf("luma PSNR %.1f dB, want at least %.0f", psnr, tt.minPSNR)
+			}
+		})
+	}
+}
+
+func TestEncodeWebPCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var buf bytes.Buffer
+	if err := EncodeWebP(ctx, &buf, testPattern(64, 64), 80); err == nil {
+		t.Error("EncodeWebP with a cancelled context succeeded")
+	}
+}
+
+// testPattern is smooth gradients with a few hard edges, like a photo.
+func testPattern(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA{uint8(x * 255 / w), uint8(y * 255 / h), uint8((x + y) % 64 * 4), 255}
+			if (x/40+y/40)%2 == 1 {
+				c.R, c.G = 255-c.R, c.G/2
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// lumaPSNR compares the decoded luma with the encoder's input; comparing
+// RGB would measure the decoder's full-range YCbCr conversion as well.
+func lumaPSNR(e *vp8Encoder, got *image.YCbCr) float64 {
+	var sse float64
+	for y := 0; y < e.h; y++ {
+		for x := 0; x < e.w; x++ {
+			d := float64(e.src[0][y*e.stride[0]+x]) - float64(got.Y[got.YOffset(x, y)])
+			sse += d * d
+		}
+	}
+	if sse == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255*float64(e.w*e.h)/sse)
+}
@@ -0,0 +1,99 @@
+package process
+
+import (
+	"math"
+	"time"
+
+	"m365/internal/tz"
+
+	goexif "github.com/rwcarlsen/goexif/exif"
+)
+
+// exifClock reads an EXIF date field ("2006:01:02 15:04:05"), as the camera's
+// clock showed it, and the matching offset tag if the camera wrote one.
+type exifClock struct {
+	at, offset goexif.FieldName
+}
+
+// captureClocks are tried in order: when the shutter fired, when the image
+// was digitized, when the file was last written.
+var captureClocks = []exifClock{
+	{goexif.DateTimeOriginal, OffsetTimeOriginal},
+	{goexif.DateTimeDigitized, OffsetTimeDigitized},
+	{goexif.DateTime, OffsetTime},
+}
+
+// read returns the wall-clock time (in UTC, standing for an unknown zone)
+// and the offset string, "" when the camera didn't record one.
+func (c exifClock) read(x *goexif.Exif) (time.Time, string, bool) {
+	s := exifString(x, c.at)
+	if len(s) < 19 {
+		return time.Time{}, "", false
+	}
+	t, err := time.Parse("2006:01:02 15:04:05", s[:19])
+	if err != nil {
+		return time.Time{}, "", false // blank "    :  :     :  :  " and similar
+	}
+	off := exifString(x, c.offset)
+	if !isOffset(off) {
+		off = ""
+	}
+	return t, off, true
+}
+
+// CaptureDay works out the local calendar day a photo was taken on:
+//
+//  1. a capture time with an EXIF offset tag is local time, so its date is the day;
+//  2. otherwise the GPS timestamp (UTC) in the time zone at the GPS position;
+//  3. otherwise the capture time as written, which cameras keep in local time.
+//
+// ok is false when the EXIF doesn't say; callers fall back to the uploader's
+// time zone.
+func CaptureDay(x *goexif.Exif) (day string, ok bool) {
+	if x == nil {
+		return "", false
+	}
+	var wall time.Time
+	for _, c := range captureClocks {
+		t, off, ok := c.read(x)
+		if !ok {
+			continue
+		}
+		if off != "" {
+			return t.Format("2006-01-02"), true
+		}
+		if wall.IsZero() {
+			wall = t
+		}
+	}
+	if t, ok := gpsTime(x); ok {
+		if lat, lon, err := x.LatLong(); err == nil && !math.IsNaN(lat) && !math.IsNaN(lon) {
+			return t.In(tz.Lookup(lat, lon)).Format("2006-01-02"), true
+		}
+	}
+	if !wall.IsZero() {
+		return wall.Format("2006-01-02"), true
+	}
+	return "", false
+}
+
+// gpsTime reads GPSDateStamp and GPSTimeStamp, which are always UTC.
+func gpsTime(x *goexif.Exif) (time.Time, bool) {
+	d, err := time.Parse("2006:01:02", exifString(x, goexif.GPSDateStamp))
+	if err != nil {
+		return time.Time{}, false
+	}
+	tag, err := x.Get(goexif.GPSTimeStamp)
+	if err != nil || tag.Count < 3 {
+		return time.Time{}, false
+	}
+	var secs float64
+	for i, unit := range []float64{3600, 60, 1} {
+		num, den, err := tag.Rat2(i)
+		if err != nil || den == 0 {
+			return time.Time{}, false
+		}
+		secs += float64(num) / float64(den) * unit
+	}
+	return d.Add(time.Duration(secs * float64(time.Second))), true
+}
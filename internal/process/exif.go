@@ -0,0 +1,196 @@
+package process
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"m365/internal/media"
+	"m365/internal/store"
+
+	goexif "github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// EXIF 2.31 offset tags; goexif predates them and drops them otherwise.
+const (
+	OffsetTime          goexif.FieldName = "OffsetTime"
+	OffsetTimeOriginal  goexif.FieldName = "OffsetTimeOriginal"
+	OffsetTimeDigitized goexif.FieldName = "OffsetTimeDigitized"
+)
+
+var offsetFields = map[uint16]goexif.FieldName{
+	0x9010: OffsetTime,
+	0x9011: OffsetTimeOriginal,
+	0x9012: OffsetTimeDigitized,
+}
+
+// offsetParser loads the offset tags from the EXIF sub-IFD.
+type offsetParser struct{}
+
+func (offsetParser) Parse(x *goexif.Exif) error {
+	ptr, err := x.Get(goexif.ExifIFDPointer)
+	if err != nil {
+		return nil
+	}
+	offset, err := ptr.Int64(0)
+	if err != nil {
+		return nil
+	}
+	r := bytes.NewReader(x.Raw)
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return nil
+	}
+	dir, _, err := tiff.DecodeDir(r, x.Tiff.Order)
+	if err != nil {
+		return nil // the built-in parser already reported it
+	}
+	x.LoadTags(dir, offsetFields, false)
+	return nil
+}
+
+func init() {
+	goexif.RegisterParsers(offsetParser{})
+}
+
+// Metadata is what the EXIF block of an original tells us.
+type Metadata struct {
+	Lat, Lon    float64
+	Orientation int
+	Exif        store.Exif
+	ExifJSON    string
+}
+
+// DecodeExif parses an original's EXIF, wherever its format keeps it.
+func DecodeExif(format media.Format, r io.ReadSeeker) (*goexif.Exif, error) {
+	er, err := media.ExifReader(format, r)
+	if err != nil {
+		return nil, err
+	}
+	return goexif.Decode(er)
+}
+
+// ReadMetadata extracts location, orientation, the typed camera fields and a
+// dump of every tag. Files without EXIF yield zero Metadata.
+func ReadMetadata(format media.Format, r io.ReadSeeker) Metadata {
+	var m Metadata
+	x, err := DecodeExif(format, r)
+	if err != nil {
+		return m
+	}
+	if lat, lon, err := x.LatLong(); err == nil {
+		m.Lat, m.Lon = lat, lon
+	}
+	if o, err := x.Get(goexif.Orientation); err == nil {
+		if val, err := o.Int(0); err == nil {
+			m.Orientation = val
+		}
+	}
+	m.Exif = ParseExif(x)
+	ew := &exifWalker{exifMap: make(map[string]string)}
+	x.Walk(ew)
+	b, _ := json.Marshal(ew.exifMap)
+	m.ExifJSON = string(b)
+	return m
+}
+
+// ParseExif converts the tags we show into usable units. Missing or
+// malformed tags are left zero.
+func ParseExif(x *goexif.Exif) store.Exif {
+	e := store.Exif{
+		Make:  exifString(x, goexif.Make),
+		Model: exifString(x, goexif.Model),
+		Lens:  exifString(x, goexif.LensModel),
+	}
+	e.FocalLength, _ = exifRat(x, goexif.FocalLength)
+	e.FocalLength35, _ = exifInt(x, goexif.FocalLengthIn35mmFilm)
+	e.Aperture, _ = exifRat(x, goexif.FNumber)
+	e.ExposureTime, _ = exifRat(x, goexif.ExposureTime)
+	e.ISO, _ = exifInt(x, goexif.ISOSpeedRatings)
+	if v, ok := exifRat(x, goexif.ExposureBiasValue); ok {
+		e.ExposureBias = &v
+	}
+	if v, ok := exifInt(x, goexif.Flash); ok {
+		fired := v&1 == 1
+		e.Flash = &fired
+	}
+	e.TakenAt = takenAt(x)
+	if v, ok := exifRat(x, goexif.GPSAltitude); ok {
+		if ref, _ := exifInt(x, goexif.GPSAltitudeRef); ref == 1 {
+			v = -v // below sea level
+		}
+		e.GPSAltitude = &v
+	}
+	if v, ok := exifRat(x, goexif.GPSImgDirection); ok {
+		e.GPSDirection = &v
+	}
+	return e
+}
+
+// takenAt formats the original capture time as ISO 8601, with its UTC
+// offset when the camera recorded one. The time itself is kept as the
+// camera's local clock showed it.
+func takenAt(x *goexif.Exif) string {
+	for _, c := range captureClocks {
+		if t, off, ok := c.read(x); ok {
+			return t.Format("2006-01-02T15:04:05") + off
+		}
+	}
+	return ""
+}
+
+// isOffset reports whether s looks like "+hh:mm" or "-hh:mm".
+func isOffset(s string) bool {
+	if len(s) != 6 || (s[0] != '+' && s[0] != '-') || s[3] != ':' {
+		return false
+	}
+	for _, i := range []int{1, 2, 4, 5} {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func exifString(x *goexif.Exif, name goexif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+func exifInt(x *goexif.Exif, name goexif.FieldName) (int, bool) {
+	tag, err := x.Get(name)
+	if err != nil || tag.Count == 0 {
+		return 0, false
+	}
+	v, err := tag.Int(0)
+	return v, err == nil
+}
+
+func exifRat(x *goexif.Exif, name goexif.FieldName) (float64, bool) {
+	tag, err := x.Get(name)
+	if err != nil || tag.Count == 0 {
+		return 0, false
+	}
+	num, den, err := tag.Rat2(0)
+	if err != nil || den == 0 {
+		return 0, false
+	}
+	return float64(num) / float64(den), true
+}
+
+type exifWalker struct {
+	exifMap map[string]string
+}
+
+func (w *exifWalker) Walk(name goexif.FieldName, tag *tiff.Tag) error {
+	w.exifMap[string(name)] = tag.String()
+	return nil
+}
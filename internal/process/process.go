@@ -0,0 +1,419 @@
+// Package process turns a stored original into renditions and metadata.
+// Uploads enqueue it as a job so the request returns once the original is
+// safely stored.
+package process
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"m365/internal/blob"
+	"m365/internal/jobs"
+	"m365/internal/media"
+	"m365/internal/store"
+)
+
+// Kind is the job kind for processing one photo.
+const Kind = "process"
+
+type Processor struct {
+	Blobs      blob.Store
+	Photos     *store.PhotoStore
+	Renditions *store.RenditionStore
+	Usage      *store.UsageStore
+	Palettes   *store.PaletteStore
+	Exif       *store.ExifStore
+	// Specs are generated for every photo; the first square one is the grid thumbnail
+	Specs []media.RenditionSpec
+	// Encoders add formats (WebP, AVIF) stored beside each JPEG rendition
+	Encoders []media.Encoder
+	// BakeOrientation adds a full-size upright rendition for rotated or
+	// mirrored originals, for clients that would show the original sideways
+	BakeOrientation bool
+}
+
+func New(db *sql.DB, blobs blob.Store) *Processor {
+	return &Processor{
+		Blobs:      blobs,
+		Photos:     store.NewPhotoStore(db),
+		Renditions: store.NewRenditionStore(db),
+		Usage:      store.NewUsageStore(db),
+		Palettes:   store.NewPaletteStore(db),
+		Exif:       store.NewExifStore(db),
+		Specs:      media.DefaultRenditions,
+	}
+}
+
+// FromEnv returns a Processor configured like the server: RENDITIONS,
+// BAKE_ORIENTATION, RENDITION_FORMATS and SCRATCH_DIR. A listed format that
+// can't be encoded, such as AVIF without avifenc installed, is an error
+// rather than renditions silently going without it.
+func FromEnv(db *sql.DB, blobs blob.Store) (*Processor, error) {
+	p := New(db, blobs)
+	if v := os.Getenv("RENDITIONS"); v != "" {
+		specs, err := media.ParseRenditions(v)
+		if err != nil {
+			return nil, fmt.Errorf("RENDITIONS: %w", err)
+		}
+		p.Specs = specs
+	}
+	if v := os.Getenv("BAKE_ORIENTATION"); v != "" {
+		p.BakeOrientation, _ = strconv.ParseBool(v)
+	}
+	scratch := "scratch"
+	if v := os.Getenv("SCRATCH_DIR"); v != "" {
+		scratch = v
+	}
+	if err := media.UseScratchDir(scratch); err != nil {
+		return nil, fmt.Errorf("SCRATCH_DIR: %w", err)
+	}
+	formats := string(media.FormatWebP)
+	if v, ok := os.LookupEnv("RENDITION_FORMATS"); ok {
+		formats = v
+	}
+	for _, f := range strings.Split(formats, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		enc, err := media.ExtraEncoder(media.Format(f))
+		if err != nil {
+			return nil, fmt.Errorf("RENDITION_FORMATS: %w", err)
+		}
+		p.Encoders = append(p.Encoders, enc)
+	}
+	return p, nil
+}
+
+// Handle is the jobs.Handler for Kind.
+func (p *Processor) Handle(ctx context.Context, job *store.Job) error {
+	return p.Process(ctx, job.PhotoID)
+}
+
+// Failed marks the photo once its job has given up.
+func (p *Processor) Failed(job *store.Job, err error) {
+	if err := p.Photos.SetStatus(job.PhotoID, store.StatusFailed); err != nil {
+		log.Printf("process %s: %v", job.PhotoID, err)
+	}
+}
+
+// Process (re)generates a photo's renditions and metadata from its original.
+// A photo deleted or replaced in the meantime is not an error.
+func (p *Processor) Process(ctx context.Context, photoID string) error {
+	photo, err := p.Photos.GetByID(photoID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	f, release, err := p.original(ctx, blob.KeyFromURL(photo.Filepath))
+	if errors.Is(err, blob.ErrNotFound) {
+		return jobs.Permanent(err)
+	}
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	format, _, err := media.CheckImage(f, 0)
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+	var meta Metadata
+	var img image.Image
+	if format.IsVideo() {
+		if meta, img, err = p.readVideo(ctx, f, photo); err != nil {
+			return err
+		}
+	} else {
+		meta = ReadMetadata(format, f)
+		img, err = media.Decode(ctx, format, f)
+		if errors.Is(err, media.ErrNoHEIFDecoder) {
+			return err // may be installed before the next attempt
+		}
+		if err != nil {
+			return jobs.Permanent(fmt.Errorf("%w: %v", media.ErrCorrupt, err))
+		}
+		img = media.Normalize(img, format, meta.Orientation)
+	}
+
+	old, err := p.Renditions.ForPhoto(photo.ID)
+	if err != nil {
+		return err
+	}
+	// Clips without a poster get no renditions; the client shows them as video
+	var renditions []store.Rendition
+	var sizes map[string]int64
+	if img != nil {
+		specs := p.Specs
+		if p.BakeOrientation && meta.Orientation > 1 {
+			specs = append(specs[:len(specs):len(specs)], media.UprightRendition(img))
+		}
+		if renditions, sizes, err = p.writeRenditions(ctx, photo.ID, img, specs, old); err != nil {
+			return err
+		}
+		// Rows saved for a photo deleted while we rendered would keep its
+		// media from ever being collected
+		if _, err := p.Photos.GetByID(photo.ID); errors.Is(err, sql.ErrNoRows) {
+			p.discard(ctx, photo.ID, renditions)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for i := range renditions {
+			if err := p.Renditions.Save(&renditions[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	photo.ThumbnailPath = ThumbnailURL(renditions, media.ThumbnailSpec(p.Specs).Name)
+	photo.Lat, photo.Lon = meta.Lat, meta.Lon
+	photo.ExifData = meta.ExifJSON
+	photo.PHash, photo.BlurHash, photo.Color = "", "", ""
+	var palette []store.PaletteColor
+	if img != nil {
+		photo.PHash = media.FormatHash(media.DHash(img))
+		ph := media.NewPlaceholder(img)
+		if !format.IsVideo() { // a clip's size comes from its track, not the poster
+			photo.Width, photo.Height = ph.Width, ph.Height
+		}
+		photo.BlurHash, photo.Color = ph.BlurHash, ph.Color
+		for _, c := range media.Palette(img, media.DefaultPaletteSize) {
+			palette = append(palette, store.PaletteColor{Color: c.Color, Weight: c.Weight, L: c.L, A: c.A, B: c.B})
+		}
+	}
+	if err := p.Palettes.Save(photo.ID, palette); err != nil {
+		return err
+	}
+	if err := p.Exif.Save(photo.ID, &meta.Exif); err != nil {
+		return err
+	}
+	photo.Status = store.StatusReady
+	if err := p.Photos.SaveProcessed(photo); errors.Is(err, sql.ErrNoRows) {
+		// Deleted after the check above; its cleanup may have missed our rows
+		p.discard(ctx, photo.ID, renditions)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, rd := range renditions {
+		kind := store.KindRendition
+		if rd.URL == photo.ThumbnailPath {
+			kind = store.KindThumbnail
+		}
+		for _, u := range rd.URLs() {
+			if err := p.Usage.Record(photo.UserID, blob.KeyFromURL(u), kind, sizes[u]); err != nil {
+				log.Printf("usage: %v", err)
+			}
+		}
+	}
+	p.dropStale(ctx, photo.ID, old, renditions)
+	return nil
+}
+
+// readVideo reads a clip's container metadata and, where it can, a poster
+// frame; img is nil when there is none. The clip's own size and duration
+// are kept on photo.
+func (p *Processor) readVideo(ctx context.Context, f io.ReadSeeker, photo *store.Photo) (Metadata, image.Image, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return Metadata{}, nil, err
+	}
+	info, err := media.ParseVideo(f)
+	if err != nil {
+		return Metadata{}, nil, jobs.Permanent(fmt.Errorf("%w: %v", media.ErrCorrupt, err))
+	}
+	photo.Width, photo.Height = info.Width, info.Height
+	photo.Duration = info.Duration.Seconds()
+	img, err := media.VideoPoster(ctx, f, info)
+	if ctx.Err() != nil {
+		return Metadata{}, nil, ctx.Err() // retried, rather than saved without a poster
+	}
+	if err != nil {
+		if !errors.Is(err, media.ErrNoPoster) {
+			log.Printf("poster %s: %v", photo.ID, err)
+		}
+		img = nil
+	}
+	return VideoMetadata(info), img, nil
+}
+
+// MaxInMemory is the largest original decoded from memory. Larger ones,
+// which are mostly video, are spooled to media.ScratchDir.
+const MaxInMemory = 64 << 20
+
+// original reads an original for decoding, which seeks around a lot: cheap
+// in memory and slow against S3 or encrypted storage. release frees it.
+func (p *Processor) original(ctx context.Context, key string) (r io.ReadSeeker, release func(), err error) {
+	obj, info, err := p.Blobs.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer obj.Close()
+	if info.Size <= MaxInMemory {
+		buf := bytes.NewBuffer(make([]byte, 0, info.Size))
+		if _, err := buf.ReadFrom(obj); err != nil {
+			return nil, nil, err
+		}
+		return bytes.NewReader(buf.Bytes()), func() {}, nil
+	}
+
+	f, err := media.CreateScratch("original-")
+	if err != nil {
+		return nil, nil, err
+	}
+	release = func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	if _, err = io.Copy(f, obj); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return f, release, nil
+}
+
+// writeRenditions encodes and stores each rendition of img in specs, as JPEG
+// plus every extra encoder's format; sizes maps each stored URL to its byte
+// count. On failure it removes what it wrote, except keys the photo already
+// had (those are still in use until the new set is saved).
+func (p *Processor) writeRenditions(ctx context.Context, id string, img image.Image, specs []media.RenditionSpec, old []store.Rendition) (out []store.Rendition, sizes map[string]int64, err error) {
+	inUse := map[string]bool{}
+	for _, rd := range old {
+		for _, u := range rd.URLs() {
+			inUse[u] = true
+		}
+	}
+	var written []string
+	defer func() {
+		if err != nil {
+			for _, key := range written {
+				if !inUse[blob.URL(key)] {
+					p.Blobs.Delete(context.Background(), key)
+				}
+			}
+		}
+	}()
+
+	sizes = map[string]int64{}
+	put := func(key string, enc media.Encoder, rendered image.Image) error {
+		var buf bytes.Buffer
+		if err := enc.Encode(ctx, &buf, rendered); err != nil {
+			return err
+		}
+		sizes[blob.URL(key)] = int64(buf.Len())
+		if err := p.Blobs.Put(ctx, key, &buf); err != nil {
+			return err
+		}
+		written = append(written, key)
+		return nil
+	}
+
+	for _, spec := range specs {
+		rendered := media.Render(img, spec)
+		key := media.RenditionName(id, spec.Name)
+		if err := put(key, media.JPEGEncoder, rendered); err != nil {
+			return nil, nil, err
+		}
+		rd := store.Rendition{
+			PhotoID: id,
+			Name:    spec.Name,
+			URL:     blob.URL(key),
+			Width:   rendered.Bounds().Dx(),
+			Height:  rendered.Bounds().Dy(),
+			Size:    sizes[blob.URL(key)],
+		}
+		// Extra formats are optional: a failed encode just isn't offered
+		for _, enc := range p.Encoders {
+			f := string(enc.Format)
+			if err := put(blob.KeyFromURL(rd.URLFor(f)), enc, rendered); err != nil {
+				log.Printf("rendition %s %s: %v", key, f, err)
+				continue
+			}
+			rd.Formats = append(rd.Formats, f)
+		}
+		out = append(out, rd)
+	}
+	return out, sizes, nil
+}
+
+// discard removes what Process stored for a photo that no longer exists:
+// the renditions it wrote and every side-table row.
+func (p *Processor) discard(ctx context.Context, photoID string, renditions []store.Rendition) {
+	for _, rd := range renditions {
+		for _, u := range rd.URLs() {
+			key := blob.KeyFromURL(u)
+			if err := p.Blobs.Delete(ctx, key); err != nil {
+				log.Printf("delete %s: %v", key, err)
+			}
+		}
+	}
+	if err := p.Renditions.DeleteForPhoto(photoID); err != nil {
+		log.Printf("renditions %s: %v", photoID, err)
+	}
+	if err := p.Palettes.DeleteForPhoto(photoID); err != nil {
+		log.Printf("palette %s: %v", photoID, err)
+	}
+	if err := p.Exif.DeleteForPhoto(photoID); err != nil {
+		log.Printf("exif %s: %v", photoID, err)
+	}
+}
+
+// dropStale removes renditions and formats an earlier run made that the
+// current configuration no longer produces.
+func (p *Processor) dropStale(ctx context.Context, photoID string, old, current []store.Rendition) {
+	keep := map[string]bool{}
+	names := map[string]bool{}
+	for _, rd := range current {
+		names[rd.Name] = true
+		for _, u := range rd.URLs() {
+			keep[u] = true
+		}
+	}
+	for _, rd := range old {
+		for _, u := range rd.URLs() {
+			if keep[u] {
+				continue
+			}
+			key := blob.KeyFromURL(u)
+			if err := p.Blobs.Delete(ctx, key); err != nil {
+				log.Printf("delete %s: %v", key, err)
+				continue
+			}
+			p.Usage.ForgetKey(key)
+		}
+		if !names[rd.Name] {
+			if err := p.Renditions.Delete(photoID, rd.Name); err != nil {
+				log.Printf("renditions %s: %v", photoID, err)
+			}
+		}
+	}
+}
+
+// ThumbnailURL picks the grid thumbnail: the rendition called name, else the first one.
+// A square photo's display sizes are square too, so the shape says nothing.
+func ThumbnailURL(renditions []store.Rendition, name string) string {
+	for _, rd := range renditions {
+		if rd.Name == name {
+			return rd.URL
+		}
+	}
+	if len(renditions) > 0 {
+		return renditions[0].URL
+	}
+	return ""
+}
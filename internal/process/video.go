@@ -0,0 +1,56 @@
+package process
+
+import (
+	"encoding/json"
+	"time"
+
+	"m365/internal/media"
+	"m365/internal/store"
+	"m365/internal/tz"
+)
+
+// VideoMetadata is what a clip's container tells us, in the shape EXIF
+// gives for stills. The raw dump is the container's metadata keys.
+func VideoMetadata(info *media.VideoInfo) Metadata {
+	var m Metadata
+	if lat, lon, ok := info.Location(); ok {
+		m.Lat, m.Lon = lat, lon
+	}
+	m.Exif = store.Exif{
+		Make:  firstMeta(info, "com.apple.quicktime.make", "com.android.manufacturer", "©mak"),
+		Model: firstMeta(info, "com.apple.quicktime.model", "com.android.model", "©mod"),
+	}
+	if t, ok := info.LocalTime(); ok {
+		m.Exif.TakenAt = t.Format("2006-01-02T15:04:05-07:00")
+	} else if !info.CreatedAt.IsZero() {
+		m.Exif.TakenAt = info.CreatedAt.Format("2006-01-02T15:04:05-07:00")
+	}
+	b, _ := json.Marshal(info.Meta)
+	m.ExifJSON = string(b)
+	return m
+}
+
+func firstMeta(info *media.VideoInfo, keys ...string) string {
+	for _, k := range keys {
+		if v := info.Meta[k]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// VideoCaptureDay is CaptureDay for clips: the recorded local time when the
+// container has one, else the creation time (UTC) in the time zone at the
+// clip's location, else in loc.
+func VideoCaptureDay(info *media.VideoInfo, loc *time.Location) (day string, ok bool) {
+	if t, ok := info.LocalTime(); ok {
+		return t.Format("2006-01-02"), true
+	}
+	if info.CreatedAt.IsZero() {
+		return "", false
+	}
+	if lat, lon, ok := info.Location(); ok {
+		loc = tz.Lookup(lat, lon)
+	}
+	return info.CreatedAt.In(loc).Format("2006-01-02"), true
+}
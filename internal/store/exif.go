@@ -0,0 +1,104 @@
+package store
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// Exif is the camera metadata of a photo in usable units. Zero values and
+// nil pointers mean the camera didn't record the field; the pointer fields
+// are ones where zero is a real reading.
+type Exif struct {
+	Make          string   `json:",omitempty"`
+	Model         string   `json:",omitempty"`
+	Lens          string   `json:",omitempty"`
+	FocalLength   float64  `json:",omitempty"` // mm
+	FocalLength35 int      `json:",omitempty"` // 35mm-equivalent mm
+	Aperture      float64  `json:",omitempty"` // f-number
+	ExposureTime  float64  `json:",omitempty"` // seconds
+	ISO           int      `json:",omitempty"`
+	ExposureBias  *float64 `json:",omitempty"` // EV
+	Flash         *bool    `json:",omitempty"` // fired
+	// TakenAt is the local capture time, "2006-01-02T15:04:05", followed by
+	// the UTC offset ("+02:00") when the camera recorded one.
+	TakenAt      string   `json:",omitempty"`
+	GPSAltitude  *float64 `json:",omitempty"` // meters above sea level
+	GPSDirection *float64 `json:",omitempty"` // degrees the camera faced
+}
+
+const exifColumns = "photo_id, make, model, lens, focal_length, focal_length_35, aperture, exposure_time, iso, exposure_bias, flash, taken_at, gps_altitude, gps_direction"
+
+type ExifStore struct {
+	db *sql.DB
+}
+
+func NewExifStore(db *sql.DB) *ExifStore {
+	return &ExifStore{db: db}
+}
+
+// Save stores a photo's metadata, replacing what was there.
+func (s *ExifStore) Save(photoID string, e *Exif) error {
+	var flash *int
+	if e.Flash != nil {
+		v := 0
+		if *e.Flash {
+			v = 1
+		}
+		flash = &v
+	}
+	_, err := s.db.Exec(`
+	INSERT OR REPLACE INTO exif (`+exifColumns+`)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		photoID, e.Make, e.Model, e.Lens, e.FocalLength, e.FocalLength35, e.Aperture, e.ExposureTime,
+		e.ISO, e.ExposureBias, flash, e.TakenAt, e.GPSAltitude, e.GPSDirection)
+	return err
+}
+
+// ForPhotos returns the metadata of several photos keyed by photo id.
+func (s *ExifStore) ForPhotos(photoIDs []string) (map[string]*Exif, error) {
+	out := make(map[string]*Exif, len(photoIDs))
+	if len(photoIDs) == 0 {
+		return out, nil
+	}
+	args := make([]any, len(photoIDs))
+	for i, id := range photoIDs {
+		args[i] = id
+	}
+	rows, err := s.db.Query(`SELECT `+exifColumns+` FROM exif
+	WHERE photo_id IN (?`+strings.Repeat(",?", len(photoIDs)-1)+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var e Exif
+		var bias, alt, dir sql.NullFloat64
+		var flash sql.NullBool
+		if err := rows.Scan(&id, &e.Make, &e.Model, &e.Lens, &e.FocalLength, &e.FocalLength35, &e.Aperture,
+			&e.ExposureTime, &e.ISO, &bias, &flash, &e.TakenAt, &alt, &dir); err != nil {
+			return nil, err
+		}
+		e.ExposureBias = nullFloat(bias)
+		e.GPSAltitude = nullFloat(alt)
+		e.GPSDirection = nullFloat(dir)
+		if flash.Valid {
+			e.Flash = &flash.Bool
+		}
+		out[id] = &e
+	}
+	return out, rows.Err()
+}
+
+// DeleteForPhoto forgets a photo's metadata.
+func (s *ExifStore) DeleteForPhoto(photoID string) error {
+	_, err := s.db.Exec("DELETE FROM exif WHERE photo_id = ?", photoID)
+	return err
+}
+
+func nullFloat(n sql.NullFloat64) *float64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Float64
+}
@@ -0,0 +1,56 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// GCRun summarizes one garbage collection pass over media storage.
+type GCRun struct {
+	StartedAt      time.Time
+	DryRun         bool
+	Scanned        int
+	Deleted        int
+	ReclaimedBytes int64
+	Errors         int
+}
+
+type GCStore struct {
+	db *sql.DB
+}
+
+func NewGCStore(db *sql.DB) *GCStore {
+	return &GCStore{db: db}
+}
+
+func (s *GCStore) Record(r GCRun) error {
+	_, err := s.db.Exec("INSERT INTO gc_runs (started_at, dry_run, scanned, deleted, reclaimed_bytes, errors) VALUES (?, ?, ?, ?, ?, ?)",
+		r.StartedAt, r.DryRun, r.Scanned, r.Deleted, r.ReclaimedBytes, r.Errors)
+	return err
+}
+
+// Recent returns the last limit runs, newest first.
+func (s *GCStore) Recent(limit int) ([]GCRun, error) {
+	rows, err := s.db.Query("SELECT started_at, dry_run, scanned, deleted, reclaimed_bytes, errors FROM gc_runs ORDER BY started_at DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []GCRun
+	for rows.Next() {
+		var r GCRun
+		if err := rows.Scan(&r.StartedAt, &r.DryRun, &r.Scanned, &r.Deleted, &r.ReclaimedBytes, &r.Errors); err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// TotalReclaimed sums bytes freed by real (non dry-run) passes.
+func (s *GCStore) TotalReclaimed() (int64, error) {
+	var n int64
+	err := s.db.QueryRow("SELECT COALESCE(SUM(reclaimed_bytes), 0) FROM gc_runs WHERE NOT dry_run").Scan(&n)
+	return n, err
+}
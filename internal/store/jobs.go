@@ -0,0 +1,156 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Job states.
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// Job is one unit of background work on a photo.
+type Job struct {
+	ID          int64
+	Kind        string
+	PhotoID     string
+	Status      string
+	Attempts    int
+	MaxAttempts int
+	RunAt       time.Time
+	LastError   string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+type JobStore struct {
+	db *sql.DB
+}
+
+func NewJobStore(db *sql.DB) *JobStore {
+	return &JobStore{db: db}
+}
+
+const jobColumns = "id, kind, photo_id, status, attempts, max_attempts, run_at, last_error, created_at, updated_at"
+
+func scanJob(row scanner, j *Job) error {
+	return row.Scan(&j.ID, &j.Kind, &j.PhotoID, &j.Status, &j.Attempts, &j.MaxAttempts, &j.RunAt, &j.LastError, &j.CreatedAt, &j.UpdatedAt)
+}
+
+// Enqueue adds a job that is due immediately.
+func (s *JobStore) Enqueue(kind, photoID string, maxAttempts int) (int64, error) {
+	now := time.Now()
+	res, err := s.db.Exec(`
+	INSERT INTO jobs (kind, photo_id, status, max_attempts, run_at, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?)`, kind, photoID, JobPending, maxAttempts, now, now, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// Claim marks the oldest due pending job as running, leased until
+// now+lease, and returns it, or sql.ErrNoRows when nothing is due. The
+// single UPDATE keeps two workers from claiming the same job.
+func (s *JobStore) Claim(now time.Time, lease time.Duration) (*Job, error) {
+	j := &Job{}
+	err := scanJob(s.db.QueryRow(`
+	UPDATE jobs SET status = ?, attempts = attempts + 1, updated_at = ?, lease_until = ?
+	WHERE id = (
+		SELECT id FROM jobs WHERE status = ? AND run_at <= ?
+		ORDER BY run_at, id LIMIT 1
+	) AND status = ?
+	RETURNING `+jobColumns, JobRunning, now, now.Add(lease), JobPending, now, JobPending), j)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Renew extends the lease of a job that is still running.
+func (s *JobStore) Renew(id int64, until time.Time) error {
+	_, err := s.db.Exec("UPDATE jobs SET lease_until = ? WHERE id = ? AND status = ?", until, id, JobRunning)
+	return err
+}
+
+// Complete marks a job done.
+func (s *JobStore) Complete(id int64) error {
+	_, err := s.db.Exec("UPDATE jobs SET status = ?, last_error = '', updated_at = ? WHERE id = ?", JobDone, time.Now(), id)
+	return err
+}
+
+// Retry puts a job back in the queue to run at runAt.
+func (s *JobStore) Retry(id int64, msg string, runAt time.Time) error {
+	_, err := s.db.Exec("UPDATE jobs SET status = ?, last_error = ?, run_at = ?, updated_at = ? WHERE id = ?",
+		JobPending, msg, runAt, time.Now(), id)
+	return err
+}
+
+// Fail gives up on a job.
+func (s *JobStore) Fail(id int64, msg string) error {
+	_, err := s.db.Exec("UPDATE jobs SET status = ?, last_error = ?, updated_at = ? WHERE id = ?",
+		JobFailed, msg, time.Now(), id)
+	return err
+}
+
+// Requeue returns running jobs whose lease ran out before now to the queue:
+// their worker crashed or was stopped. Jobs another process is still
+// working on keep renewing their lease and are left alone.
+func (s *JobStore) Requeue(now time.Time) (int64, error) {
+	res, err := s.db.Exec(`
+	UPDATE jobs SET status = ?, run_at = ?, updated_at = ?
+	WHERE status = ? AND (lease_until IS NULL OR lease_until < ?)`,
+		JobPending, now, now, JobRunning, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Counts returns the number of jobs in each state.
+func (s *JobStore) Counts() (map[string]int, error) {
+	rows, err := s.db.Query("SELECT status, COUNT(*) FROM jobs GROUP BY status")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		counts[status] = n
+	}
+	return counts, rows.Err()
+}
+
+// Recent returns the latest jobs in a state ("" for any), newest first.
+func (s *JobStore) Recent(status string, limit int) ([]Job, error) {
+	rows, err := s.db.Query("SELECT "+jobColumns+" FROM jobs WHERE ? = '' OR status = ? ORDER BY updated_at DESC LIMIT ?",
+		status, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var jobs []Job
+	for rows.Next() {
+		var j Job
+		if err := scanJob(rows, &j); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// PruneDone deletes finished jobs older than before.
+func (s *JobStore) PruneDone(before time.Time) error {
+	_, err := s.db.Exec("DELETE FROM jobs WHERE status = ? AND updated_at < ?", JobDone, before)
+	return err
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"database/sql"
+	"math"
+	"strings"
+)
+
+// PaletteColor is one of a photo's dominant colors.
+type PaletteColor struct {
+	Color  string  // #rrggbb
+	Weight float64 // share of pixels, 0-1
+	// CIELAB center, used for distance
+	L float64 `json:"-"`
+	A float64 `json:"-"`
+	B float64 `json:"-"`
+}
+
+// ColorMatch is a photo whose palette has a color near a searched one.
+type ColorMatch struct {
+	PhotoID  string
+	Color    string  // the closest palette color
+	Weight   float64 // its share of the photo
+	Distance float64 // CIE76 ΔE to the searched color
+}
+
+type PaletteStore struct {
+	db *sql.DB
+}
+
+func NewPaletteStore(db *sql.DB) *PaletteStore {
+	return &PaletteStore{db: db}
+}
+
+// Save replaces a photo's palette; colors are stored in the given order.
+func (s *PaletteStore) Save(photoID string, colors []PaletteColor) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM palettes WHERE photo_id = ?", photoID); err != nil {
+		return err
+	}
+	for i, c := range colors {
+		if _, err := tx.Exec("INSERT INTO palettes (photo_id, rank, color, weight, l, a, b) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			photoID, i, c.Color, c.Weight, c.L, c.A, c.B); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ForPhotos returns the palettes of several photos keyed by photo id.
+func (s *PaletteStore) ForPhotos(photoIDs []string) (map[string][]PaletteColor, error) {
+	out := make(map[string][]PaletteColor, len(photoIDs))
+	if len(photoIDs) == 0 {
+		return out, nil
+	}
+	args := make([]any, len(photoIDs))
+	for i, id := range photoIDs {
+		args[i] = id
+	}
+	rows, err := s.db.Query(`
+	SELECT photo_id, color, weight, l, a, b FROM palettes
+	WHERE photo_id IN (?`+strings.Repeat(",?", len(photoIDs)-1)+`)
+	ORDER BY photo_id, rank`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var c PaletteColor
+		if err := rows.Scan(&id, &c.Color, &c.Weight, &c.L, &c.A, &c.B); err != nil {
+			return nil, err
+		}
+		out[id] = append(out[id], c)
+	}
+	return out, rows.Err()
+}
+
+// Near finds photos with a palette color within maxDistance (ΔE) of the
+// CIELAB color l, a, b, ignoring colors covering less than minWeight of the
+// photo. Each photo appears once, closest first.
+func (s *PaletteStore) Near(l, a, b, maxDistance, minWeight float64, limit int) ([]ColorMatch, error) {
+	rows, err := s.db.Query(`
+	SELECT p.photo_id, p.color, p.weight,
+		(p.l - ?) * (p.l - ?) + (p.a - ?) * (p.a - ?) + (p.b - ?) * (p.b - ?) AS d2
+	FROM palettes p JOIN photos ON photos.id = p.photo_id
+	WHERE p.weight >= ? AND d2 <= ?
+	ORDER BY d2, p.weight DESC`,
+		l, l, a, a, b, b, minWeight, maxDistance*maxDistance)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	seen := map[string]bool{}
+	out := []ColorMatch{}
+	for rows.Next() {
+		var m ColorMatch
+		var d2 float64
+		if err := rows.Scan(&m.PhotoID, &m.Color, &m.Weight, &d2); err != nil {
+			return nil, err
+		}
+		if seen[m.PhotoID] {
+			continue
+		}
+		seen[m.PhotoID] = true
+		m.Distance = math.Sqrt(d2)
+		out = append(out, m)
+		if limit > 0 && len(out) == limit {
+			break
+		}
+	}
+	return out, rows.Err()
+}
+
+// DeleteForPhoto forgets a photo's palette.
+func (s *PaletteStore) DeleteForPhoto(photoID string) error {
+	_, err := s.db.Exec("DELETE FROM palettes WHERE photo_id = ?", photoID)
+	return err
+}
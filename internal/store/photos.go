@@ -2,6 +2,8 @@ package store
 
 import (
 	"database/sql"
+    "path"
+    "strings"
     "time"
 )
 
@@ -14,9 +16,33 @@ type Photo struct {
 	Lon           float64
 	Notes         string
     ExifData      string
+    SHA256        string // hex digest of the original's bytes
+    PHash         string // perceptual dHash, 16 hex digits
+    UserID        string // uploader
+    Format        string // original's file type: jpeg, heic, dng, cr3, mp4, mov, ...
+    LiveVideo     string `json:",omitempty"` // URL of a Live Photo's motion clip
+    Duration      float64 `json:",omitempty"` // seconds, for videos and Live Photo clips
+    Status        string `json:",omitempty"` // StatusProcessing or StatusFailed; "" once renditions exist
+    // Placeholder shown until the thumbnail loads; set by processing
+    Width         int    // upright pixel size of the original
+    Height        int
+    BlurHash      string
+    Color         string // dominant color, "#rrggbb"
 	CreatedAt     time.Time
+    // Renditions, Palette and Exif are filled in by the API, not stored on the row
+    Renditions    []Rendition `json:",omitempty"`
+    Palette       []PaletteColor `json:",omitempty"`
+    Exif          *Exif `json:",omitempty"`
 }
 
+// Photo processing states. Rows are saved as processing right after upload
+// and cleared when their job has made the renditions.
+const (
+    StatusReady      = ""
+    StatusProcessing = "processing"
+    StatusFailed     = "failed"
+)
+
 type PhotoStore struct {
 	db *sql.DB
 }
@@ -25,10 +51,31 @@ func NewPhotoStore(db *sql.DB) *PhotoStore {
 	return &PhotoStore{db: db}
 }
 
+// photoColumns is the column list matching scanPhoto.
+const photoColumns = "day, id, filepath, thumbnail_path, lat, lon, notes, exif_data, sha256, phash, user_id, format, live_video, duration, status, width, height, blurhash, color, created_at"
+
+type scanner interface {
+    Scan(dest ...any) error
+}
+
+func scanPhoto(row scanner, p *Photo) error {
+    if err := row.Scan(&p.Day, &p.ID, &p.Filepath, &p.ThumbnailPath, &p.Lat, &p.Lon, &p.Notes, &p.ExifData, &p.SHA256, &p.PHash, &p.UserID, &p.Format, &p.LiveVideo, &p.Duration, &p.Status, &p.Width, &p.Height, &p.BlurHash, &p.Color, &p.CreatedAt); err != nil {
+        return err
+    }
+    if p.Format == "" {
+        // Rows from before the column existed: the extension is the format
+        p.Format = strings.TrimPrefix(path.Ext(p.Filepath), ".")
+        if p.Format == "jpg" {
+            p.Format = "jpeg"
+        }
+    }
+    return nil
+}
+
 func (s *PhotoStore) Save(p *Photo) error {
 	query := `
-    INSERT INTO photos (day, id, filepath, thumbnail_path, lat, lon, notes, exif_data, created_at)
-    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+    INSERT INTO photos (` + photoColumns + `)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
     ON CONFLICT(day) DO UPDATE SET
         id=excluded.id,
         filepath=excluded.filepath,
@@ -37,17 +84,46 @@ func (s *PhotoStore) Save(p *Photo) error {
         lon=excluded.lon,
         notes=excluded.notes,
         exif_data=excluded.exif_data,
+        sha256=excluded.sha256,
+        phash=excluded.phash,
+        user_id=excluded.user_id,
+        format=excluded.format,
+        live_video=excluded.live_video,
+        duration=excluded.duration,
+        status=excluded.status,
+        width=excluded.width,
+        height=excluded.height,
+        blurhash=excluded.blurhash,
+        color=excluded.color,
         created_at=excluded.created_at;
     `
-    _, err := s.db.Exec(query, p.Day, p.ID, p.Filepath, p.ThumbnailPath, p.Lat, p.Lon, p.Notes, p.ExifData, p.CreatedAt)
+    _, err := s.db.Exec(query, p.Day, p.ID, p.Filepath, p.ThumbnailPath, p.Lat, p.Lon, p.Notes, p.ExifData, p.SHA256, p.PHash, p.UserID, p.Format, p.LiveVideo, p.Duration, p.Status, p.Width, p.Height, p.BlurHash, p.Color, p.CreatedAt)
     return err
 }
 
+// GetByID returns the photo with the given id.
+func (s *PhotoStore) GetByID(id string) (*Photo, error) {
+    p := &Photo{}
+    err := scanPhoto(s.db.QueryRow("SELECT "+photoColumns+" FROM photos WHERE id = ?", id), p)
+    if err != nil {
+        return nil, err
+    }
+    return p, nil
+}
+
 func (s *PhotoStore) GetByDay(day string) (*Photo, error) {
     p := &Photo{}
-    err := s.db.QueryRow("SELECT day, id, filepath, thumbnail_path, lat, lon, notes, exif_data, created_at FROM photos WHERE day = ?", day).Scan(
-        &p.Day, &p.ID, &p.Filepath, &p.ThumbnailPath, &p.Lat, &p.Lon, &p.Notes, &p.ExifData, &p.CreatedAt,
-    )
+    err := scanPhoto(s.db.QueryRow("SELECT "+photoColumns+" FROM photos WHERE day = ?", day), p)
+    if err != nil {
+        return nil, err
+    }
+    return p, nil
+}
+
+// GetBySHA256 returns the earliest photo whose original has the given digest.
+func (s *PhotoStore) GetBySHA256(sum string) (*Photo, error) {
+    p := &Photo{}
+    err := scanPhoto(s.db.QueryRow("SELECT "+photoColumns+" FROM photos WHERE sha256 = ? ORDER BY day LIMIT 1", sum), p)
     if err != nil {
         return nil, err
     }
@@ -55,7 +131,7 @@ func (s *PhotoStore) GetByDay(day string) (*Photo, error) {
 }
 
 func (s *PhotoStore) List(limit int) ([]Photo, error) {
-    rows, err := s.db.Query("SELECT day, id, filepath, thumbnail_path, lat, lon, notes, exif_data, created_at FROM photos ORDER BY day DESC LIMIT ?", limit)
+    rows, err := s.db.Query("SELECT "+photoColumns+" FROM photos ORDER BY day DESC LIMIT ?", limit)
     if err != nil {
         return nil, err
     }
@@ -64,10 +140,107 @@ func (s *PhotoStore) List(limit int) ([]Photo, error) {
     photos := []Photo{}
     for rows.Next() {
         var p Photo
-        if err := rows.Scan(&p.Day, &p.ID, &p.Filepath, &p.ThumbnailPath, &p.Lat, &p.Lon, &p.Notes, &p.ExifData, &p.CreatedAt); err != nil {
+        if err := scanPhoto(rows, &p); err != nil {
             return nil, err
         }
         photos = append(photos, p)
     }
-    return photos, nil
+    return photos, rows.Err()
+}
+
+// All returns every photo, newest day first.
+func (s *PhotoStore) All() ([]Photo, error) {
+    return s.List(-1)
+}
+
+// SaveProcessed stores what a processing job extracted and generated.
+// It returns sql.ErrNoRows when the photo has been deleted meanwhile.
+func (s *PhotoStore) SaveProcessed(p *Photo) error {
+    res, err := s.db.Exec(`
+    UPDATE photos SET thumbnail_path = ?, lat = ?, lon = ?, exif_data = ?, phash = ?, status = ?,
+        width = ?, height = ?, blurhash = ?, color = ?, duration = ?
+    WHERE id = ?`, p.ThumbnailPath, p.Lat, p.Lon, p.ExifData, p.PHash, p.Status,
+        p.Width, p.Height, p.BlurHash, p.Color, p.Duration, p.ID)
+    if err != nil {
+        return err
+    }
+    if n, err := res.RowsAffected(); err == nil && n == 0 {
+        return sql.ErrNoRows
+    }
+    return err
+}
+
+func (s *PhotoStore) SetStatus(id, status string) error {
+    _, err := s.db.Exec("UPDATE photos SET status = ? WHERE id = ?", status, id)
+    return err
+}
+
+func (s *PhotoStore) Delete(day string) error {
+    _, err := s.db.Exec("DELETE FROM photos WHERE day = ?", day)
+    return err
+}
+
+// CountByFilepath reports how many rows reference an original, as their
+// photo or video or as a Live Photo's clip.
+func (s *PhotoStore) CountByFilepath(filepath string) (int, error) {
+    var n int
+    err := s.db.QueryRow("SELECT COUNT(*) FROM photos WHERE filepath = ? OR live_video = ?", filepath, filepath).Scan(&n)
+    return n, err
+}
+
+// CountByUserFilepath reports how many of a user's rows reference an original.
+func (s *PhotoStore) CountByUserFilepath(userID, filepath string) (int, error) {
+    var n int
+    err := s.db.QueryRow("SELECT COUNT(*) FROM photos WHERE user_id = ? AND (filepath = ? OR live_video = ?)", userID, filepath, filepath).Scan(&n)
+    return n, err
+}
+
+// References reports whether a photo uses the media at url, counting the
+// same URLs as MediaURLs: renditions in every format, of existing photos.
+func (s *PhotoStore) References(url string) (bool, error) {
+    ext := path.Ext(url)
+    jpeg := strings.TrimSuffix(url, ext) + ".jpg"
+    var used bool
+    err := s.db.QueryRow(`
+    SELECT EXISTS (SELECT 1 FROM photos WHERE filepath = ?1 OR thumbnail_path = ?1 OR live_video = ?1)
+        OR EXISTS (
+            SELECT 1 FROM renditions WHERE url = ?2 AND photo_id IN (SELECT id FROM photos)
+            AND (?1 = ?2 OR instr(',' || formats || ',', ?3) > 0)
+        )
+    `, url, jpeg, ","+strings.TrimPrefix(ext, ".")+",").Scan(&used)
+    return used, err
+}
+
+// MediaURLs returns every media URL a row references, for orphan detection.
+func (s *PhotoStore) MediaURLs() ([]string, error) {
+    rows, err := s.db.Query(`
+    SELECT filepath FROM photos WHERE filepath != ''
+    UNION SELECT thumbnail_path FROM photos WHERE thumbnail_path != ''
+    UNION SELECT live_video FROM photos WHERE live_video != ''
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var urls []string
+    for rows.Next() {
+        var u string
+        if err := rows.Scan(&u); err != nil {
+            return nil, err
+        }
+        urls = append(urls, u)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+
+    renditions, err := NewRenditionStore(s.db).Referenced()
+    if err != nil {
+        return nil, err
+    }
+    for i := range renditions {
+        urls = append(urls, renditions[i].URLs()...)
+    }
+    return urls, nil
 }
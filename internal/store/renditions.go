@@ -0,0 +1,142 @@
+package store
+
+import (
+	"database/sql"
+	"path"
+	"strings"
+)
+
+// Rendition is a derived image of a photo at one size.
+type Rendition struct {
+	PhotoID string `json:"-"`
+	Name    string
+	URL     string
+	Width   int
+	Height  int
+	Size    int64 `json:"-"`
+	// Formats lists encodings stored next to the JPEG, e.g. "webp". The
+	// server picks one per request from the Accept header.
+	Formats []string `json:"-"`
+}
+
+// URLFor returns where the rendition is stored in another format.
+func (r *Rendition) URLFor(format string) string {
+	return strings.TrimSuffix(r.URL, path.Ext(r.URL)) + "." + format
+}
+
+// URLs returns the JPEG URL followed by one per extra format.
+func (r *Rendition) URLs() []string {
+	urls := []string{r.URL}
+	for _, f := range r.Formats {
+		urls = append(urls, r.URLFor(f))
+	}
+	return urls
+}
+
+const renditionColumns = "photo_id, name, url, width, height, size, formats"
+
+func scanRendition(row scanner, r *Rendition) error {
+	var formats string
+	if err := row.Scan(&r.PhotoID, &r.Name, &r.URL, &r.Width, &r.Height, &r.Size, &formats); err != nil {
+		return err
+	}
+	r.Formats = nil
+	if formats != "" {
+		r.Formats = strings.Split(formats, ",")
+	}
+	return nil
+}
+
+type RenditionStore struct {
+	db *sql.DB
+}
+
+func NewRenditionStore(db *sql.DB) *RenditionStore {
+	return &RenditionStore{db: db}
+}
+
+// Save records a rendition, replacing any earlier one with the same name.
+func (s *RenditionStore) Save(r *Rendition) error {
+	_, err := s.db.Exec(`
+	INSERT INTO renditions (`+renditionColumns+`)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(photo_id, name) DO UPDATE SET
+		url=excluded.url, width=excluded.width, height=excluded.height,
+		size=excluded.size, formats=excluded.formats`,
+		r.PhotoID, r.Name, r.URL, r.Width, r.Height, r.Size, strings.Join(r.Formats, ","))
+	return err
+}
+
+// ForPhoto returns a photo's renditions, smallest first.
+func (s *RenditionStore) ForPhoto(photoID string) ([]Rendition, error) {
+	m, err := s.ForPhotos([]string{photoID})
+	return m[photoID], err
+}
+
+// ForPhotos returns the renditions of several photos keyed by photo id.
+func (s *RenditionStore) ForPhotos(photoIDs []string) (map[string][]Rendition, error) {
+	out := make(map[string][]Rendition, len(photoIDs))
+	if len(photoIDs) == 0 {
+		return out, nil
+	}
+	args := make([]any, len(photoIDs))
+	for i, id := range photoIDs {
+		args[i] = id
+	}
+	rows, err := s.db.Query(`
+	SELECT `+renditionColumns+` FROM renditions
+	WHERE photo_id IN (?`+strings.Repeat(",?", len(photoIDs)-1)+`)
+	ORDER BY photo_id, width * height`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r Rendition
+		if err := scanRendition(rows, &r); err != nil {
+			return nil, err
+		}
+		out[r.PhotoID] = append(out[r.PhotoID], r)
+	}
+	return out, rows.Err()
+}
+
+// ByURL returns the rendition stored at url (its JPEG URL).
+func (s *RenditionStore) ByURL(url string) (*Rendition, error) {
+	r := &Rendition{}
+	err := scanRendition(s.db.QueryRow("SELECT "+renditionColumns+" FROM renditions WHERE url = ? LIMIT 1", url), r)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Referenced returns every rendition, in every format, whose photo row still exists.
+func (s *RenditionStore) Referenced() ([]Rendition, error) {
+	rows, err := s.db.Query("SELECT " + renditionColumns + " FROM renditions WHERE photo_id IN (SELECT id FROM photos)")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Rendition
+	for rows.Next() {
+		var r Rendition
+		if err := scanRendition(rows, &r); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// DeleteForPhoto forgets every rendition of a photo.
+func (s *RenditionStore) DeleteForPhoto(photoID string) error {
+	_, err := s.db.Exec("DELETE FROM renditions WHERE photo_id = ?", photoID)
+	return err
+}
+
+// Delete forgets one named rendition of a photo.
+func (s *RenditionStore) Delete(photoID, name string) error {
+	_, err := s.db.Exec("DELETE FROM renditions WHERE photo_id = ? AND name = ?", photoID, name)
+	return err
+}
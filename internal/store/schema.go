@@ -0,0 +1,48 @@
+package store
+
+import (
+	"database/sql"
+	_ "embed"
+	"strings"
+)
+
+//go:embed schema.sql
+var schemaSQL string
+
+// migrations bring databases created by an older schema.sql up to date.
+// New columns go both here and in schema.sql; indexes on them only here,
+// since schema.sql runs before the columns exist on old databases.
+var migrations = []string{
+	"ALTER TABLE photos ADD COLUMN sha256 TEXT NOT NULL DEFAULT ''",
+	"CREATE INDEX IF NOT EXISTS idx_photos_sha256 ON photos(sha256)",
+	"ALTER TABLE photos ADD COLUMN phash TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE photos ADD COLUMN user_id TEXT NOT NULL DEFAULT ''",
+	"CREATE INDEX IF NOT EXISTS idx_media_usage_key ON media_usage(key)",
+	"ALTER TABLE renditions ADD COLUMN formats TEXT NOT NULL DEFAULT ''",
+	"CREATE INDEX IF NOT EXISTS idx_renditions_url ON renditions(url)",
+	"ALTER TABLE photos ADD COLUMN format TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE photos ADD COLUMN status TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE photos ADD COLUMN width INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE photos ADD COLUMN height INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE photos ADD COLUMN blurhash TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE photos ADD COLUMN color TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE users ADD COLUMN timezone TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE users ADD COLUMN day_policy TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE photos ADD COLUMN live_video TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE photos ADD COLUMN duration REAL NOT NULL DEFAULT 0",
+	"ALTER TABLE jobs ADD COLUMN lease_until DATETIME",
+	"ALTER TABLE uploads ADD COLUMN result TEXT NOT NULL DEFAULT ''",
+}
+
+// Migrate creates any missing tables and columns. Safe to run on every start.
+func Migrate(db *sql.DB) error {
+	if _, err := db.Exec(schemaSQL); err != nil {
+		return err
+	}
+	for _, stmt := range migrations {
+		if _, err := db.Exec(stmt); err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return err
+		}
+	}
+	return nil
+}
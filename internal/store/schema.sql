@@ -1,7 +1,9 @@
 CREATE TABLE IF NOT EXISTS users (
     id TEXT PRIMARY KEY,
     username TEXT UNIQUE,
-    credentials BLOB -- WebAuthn credentials
+    credentials BLOB, -- WebAuthn credentials
+    timezone TEXT NOT NULL DEFAULT '', -- IANA name for days of photos without a capture date; '' = server's
+    day_policy TEXT NOT NULL DEFAULT '' -- exif, client, reject; '' = exif
 );
 
 CREATE TABLE IF NOT EXISTS photos (
@@ -13,6 +15,17 @@ CREATE TABLE IF NOT EXISTS photos (
     lon REAL,
     notes TEXT,
     exif_data TEXT,
+    sha256 TEXT NOT NULL DEFAULT '', -- hex digest of the original
+    phash TEXT NOT NULL DEFAULT '', -- perceptual dHash
+    user_id TEXT NOT NULL DEFAULT '', -- uploader
+    format TEXT NOT NULL DEFAULT '', -- original's file type
+    live_video TEXT NOT NULL DEFAULT '', -- Live Photo motion clip
+    duration REAL NOT NULL DEFAULT 0, -- seconds, for videos and Live Photo clips
+    status TEXT NOT NULL DEFAULT '', -- processing, failed; '' once ready
+    width INTEGER NOT NULL DEFAULT 0, -- upright size of the original
+    height INTEGER NOT NULL DEFAULT 0,
+    blurhash TEXT NOT NULL DEFAULT '',
+    color TEXT NOT NULL DEFAULT '', -- dominant color, #rrggbb
     created_at DATETIME
 );
 
@@ -21,3 +34,92 @@ CREATE TABLE IF NOT EXISTS sessions (
     user_id TEXT,
     expires_at DATETIME
 );
+
+-- Bytes stored per user and blob key, for quotas
+CREATE TABLE IF NOT EXISTS media_usage (
+    user_id TEXT NOT NULL,
+    key TEXT NOT NULL,
+    kind TEXT NOT NULL, -- original, thumbnail or rendition
+    size INTEGER NOT NULL,
+    created_at DATETIME,
+    PRIMARY KEY (user_id, key)
+);
+
+-- One row per media garbage collection run
+CREATE TABLE IF NOT EXISTS gc_runs (
+    started_at DATETIME,
+    dry_run BOOLEAN,
+    scanned INTEGER,
+    deleted INTEGER,
+    reclaimed_bytes INTEGER,
+    errors INTEGER
+);
+
+-- Derived images generated per photo (grid thumbnail, display sizes)
+CREATE TABLE IF NOT EXISTS renditions (
+    photo_id TEXT NOT NULL,
+    name TEXT NOT NULL, -- e.g. thumb, 1080, 2048
+    url TEXT NOT NULL,
+    width INTEGER NOT NULL,
+    height INTEGER NOT NULL,
+    size INTEGER NOT NULL, -- bytes
+    formats TEXT NOT NULL DEFAULT '', -- encodings stored besides JPEG, e.g. "webp,avif"
+    PRIMARY KEY (photo_id, name)
+);
+
+-- Background work (rendition generation, metadata extraction), retried with backoff
+CREATE TABLE IF NOT EXISTS jobs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    kind TEXT NOT NULL,
+    photo_id TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL DEFAULT 'pending', -- pending, running, done, failed
+    attempts INTEGER NOT NULL DEFAULT 0,
+    max_attempts INTEGER NOT NULL DEFAULT 5,
+    run_at DATETIME NOT NULL,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at DATETIME,
+    updated_at DATETIME,
+    lease_until DATETIME -- a running job's worker renews this; past it, the job is requeued
+);
+CREATE INDEX IF NOT EXISTS idx_jobs_pending ON jobs(status, run_at);
+
+-- Dominant colors per photo (k-means clusters), with CIELAB centers for color search
+CREATE TABLE IF NOT EXISTS palettes (
+    photo_id TEXT NOT NULL,
+    rank INTEGER NOT NULL, -- 0 = most common
+    color TEXT NOT NULL, -- #rrggbb
+    weight REAL NOT NULL, -- share of pixels
+    l REAL NOT NULL,
+    a REAL NOT NULL,
+    b REAL NOT NULL,
+    PRIMARY KEY (photo_id, rank)
+);
+
+-- Typed camera metadata per photo; photos.exif_data keeps the raw tag dump
+CREATE TABLE IF NOT EXISTS exif (
+    photo_id TEXT PRIMARY KEY,
+    make TEXT NOT NULL DEFAULT '',
+    model TEXT NOT NULL DEFAULT '',
+    lens TEXT NOT NULL DEFAULT '',
+    focal_length REAL NOT NULL DEFAULT 0, -- mm
+    focal_length_35 INTEGER NOT NULL DEFAULT 0, -- 35mm equivalent, mm
+    aperture REAL NOT NULL DEFAULT 0, -- f-number
+    exposure_time REAL NOT NULL DEFAULT 0, -- seconds
+    iso INTEGER NOT NULL DEFAULT 0,
+    exposure_bias REAL, -- EV; NULL when not recorded
+    flash INTEGER, -- 1 fired, 0 didn't; NULL when not recorded
+    taken_at TEXT NOT NULL DEFAULT '', -- 2006-01-02T15:04:05[+07:00]
+    gps_altitude REAL, -- meters above sea level
+    gps_direction REAL -- degrees from true or magnetic north the camera faced
+);
+
+-- Resumable (tus) uploads in progress; the bytes are in files named by id
+CREATE TABLE IF NOT EXISTS uploads (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    length INTEGER NOT NULL, -- total bytes announced at creation
+    metadata TEXT NOT NULL DEFAULT '{}', -- JSON of the Upload-Metadata pairs
+    result TEXT NOT NULL DEFAULT '', -- JSON upload response once the photo is stored
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL
+);
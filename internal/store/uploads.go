@@ -0,0 +1,93 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// Upload is a resumable upload. How much of it has arrived is the size of
+// its data file, not stored here.
+type Upload struct {
+	ID       string
+	UserID   string
+	Length   int64
+	Metadata map[string]string
+	// Result is the JSON upload response once the photo is stored and the
+	// data file gone; "" while bytes are still due
+	Result    string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+type UploadStore struct {
+	db *sql.DB
+}
+
+func NewUploadStore(db *sql.DB) *UploadStore {
+	return &UploadStore{db: db}
+}
+
+const uploadColumns = "id, user_id, length, metadata, result, created_at, expires_at"
+
+func scanUpload(row scanner, u *Upload) error {
+	var meta string
+	if err := row.Scan(&u.ID, &u.UserID, &u.Length, &meta, &u.Result, &u.CreatedAt, &u.ExpiresAt); err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(meta), &u.Metadata)
+}
+
+func (s *UploadStore) Create(u *Upload) error {
+	meta, err := json.Marshal(u.Metadata)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT INTO uploads ("+uploadColumns+") VALUES (?, ?, ?, ?, ?, ?, ?)",
+		u.ID, u.UserID, u.Length, string(meta), u.Result, u.CreatedAt, u.ExpiresAt)
+	return err
+}
+
+func (s *UploadStore) Get(id string) (*Upload, error) {
+	u := &Upload{}
+	if err := scanUpload(s.db.QueryRow("SELECT "+uploadColumns+" FROM uploads WHERE id = ?", id), u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Touch pushes back an upload's expiry, after data arrives.
+func (s *UploadStore) Touch(id string, expiresAt time.Time) error {
+	_, err := s.db.Exec("UPDATE uploads SET expires_at = ? WHERE id = ?", expiresAt, id)
+	return err
+}
+
+// Finish records the response of the photo an upload became, kept until
+// expiresAt for a client that missed it.
+func (s *UploadStore) Finish(id, result string, expiresAt time.Time) error {
+	_, err := s.db.Exec("UPDATE uploads SET result = ?, expires_at = ? WHERE id = ?", result, expiresAt, id)
+	return err
+}
+
+func (s *UploadStore) Delete(id string) error {
+	_, err := s.db.Exec("DELETE FROM uploads WHERE id = ?", id)
+	return err
+}
+
+// Expired returns the ids of uploads whose expiry is before now.
+func (s *UploadStore) Expired(now time.Time) ([]string, error) {
+	rows, err := s.db.Query("SELECT id FROM uploads WHERE expires_at < ?", now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,129 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Kinds of stored media tracked for quotas.
+const (
+	KindOriginal  = "original"
+	KindThumbnail = "thumbnail"
+	KindRendition = "rendition"
+)
+
+// Usage is the bytes a user (or the whole project, UserID "") has stored.
+type Usage struct {
+	UserID string
+	Bytes  int64
+	ByKind map[string]int64
+}
+
+// UsageStore keeps a ledger of stored blobs per user. A content-addressed
+// original shared by two users counts against both.
+type UsageStore struct {
+	db *sql.DB
+}
+
+func NewUsageStore(db *sql.DB) *UsageStore {
+	return &UsageStore{db: db}
+}
+
+func (s *UsageStore) Record(userID, key, kind string, size int64) error {
+	_, err := s.db.Exec(`
+    INSERT INTO media_usage (user_id, key, kind, size, created_at) VALUES (?, ?, ?, ?, ?)
+    ON CONFLICT(user_id, key) DO UPDATE SET kind=excluded.kind, size=excluded.size
+    `, userID, key, kind, size, time.Now())
+	return err
+}
+
+// Has reports whether userID is already charged for key.
+func (s *UsageStore) Has(userID, key string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM media_usage WHERE user_id = ? AND key = ?)", userID, key).Scan(&exists)
+	return exists, err
+}
+
+// Forget stops charging userID for key.
+func (s *UsageStore) Forget(userID, key string) error {
+	_, err := s.db.Exec("DELETE FROM media_usage WHERE user_id = ? AND key = ?", userID, key)
+	return err
+}
+
+// ForgetKey drops key for every user, once the blob itself is deleted.
+func (s *UsageStore) ForgetKey(key string) error {
+	_, err := s.db.Exec("DELETE FROM media_usage WHERE key = ?", key)
+	return err
+}
+
+func (s *UsageStore) ForUser(userID string) (Usage, error) {
+	u := Usage{UserID: userID, ByKind: map[string]int64{}}
+	rows, err := s.db.Query("SELECT kind, SUM(size) FROM media_usage WHERE user_id = ? GROUP BY kind", userID)
+	if err != nil {
+		return u, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind string
+		var n int64
+		if err := rows.Scan(&kind, &n); err != nil {
+			return u, err
+		}
+		u.ByKind[kind] = n
+		u.Bytes += n
+	}
+	return u, rows.Err()
+}
+
+// All returns per-user usage followed by the project total (UserID ""),
+// where shared blobs are counted once.
+func (s *UsageStore) All() ([]Usage, error) {
+	rows, err := s.db.Query("SELECT user_id, kind, SUM(size) FROM media_usage GROUP BY user_id, kind ORDER BY user_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var all []Usage
+	for rows.Next() {
+		var userID, kind string
+		var n int64
+		if err := rows.Scan(&userID, &kind, &n); err != nil {
+			return nil, err
+		}
+		if len(all) == 0 || all[len(all)-1].UserID != userID {
+			all = append(all, Usage{UserID: userID, ByKind: map[string]int64{}})
+		}
+		u := &all[len(all)-1]
+		u.ByKind[kind] += n
+		u.Bytes += n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	total := Usage{ByKind: map[string]int64{}}
+	rows, err = s.db.Query(`
+    SELECT kind, SUM(size) FROM (SELECT DISTINCT key, kind, size FROM media_usage) GROUP BY kind
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind string
+		var n int64
+		if err := rows.Scan(&kind, &n); err != nil {
+			return nil, err
+		}
+		total.ByKind[kind] = n
+		total.Bytes += n
+	}
+	return append(all, total), rows.Err()
+}
+
+// Clear empties the ledger before a rebuild.
+func (s *UsageStore) Clear() error {
+	_, err := s.db.Exec("DELETE FROM media_usage")
+	return err
+}
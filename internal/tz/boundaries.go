@@ -0,0 +1,200 @@
+package tz
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Boundaries are time zone polygons in the GeoJSON that
+// timezone-boundary-builder publishes with each tz release
+// (https://github.com/evansiroky/timezone-boundary-builder/releases):
+// a FeatureCollection of Polygon or MultiPolygon features with a "tzid"
+// property. The full set is ~150MB, so the server embeds a coarse one
+// (boundaries.geojson.gz, see cmd/gen-tz) and loads the full one from a
+// file when TZ_BOUNDARIES names one.
+type Boundaries struct {
+	zones []boundary
+}
+
+type boundary struct {
+	name                           string
+	minLat, minLon, maxLat, maxLon float32
+	polygons                       [][]ring // outer ring, then holes
+}
+
+// ring is a closed line of lon, lat points; float32 is good to a meter and
+// halves the memory of the full data set.
+type ring [][2]float32
+
+var loaded atomic.Pointer[Boundaries]
+
+//go:embed boundaries.geojson.gz
+var embeddedGz []byte
+
+var embedded = sync.OnceValue(func() *Boundaries {
+	zr, err := gzip.NewReader(bytes.NewReader(embeddedGz))
+	if err != nil {
+		panic(err)
+	}
+	b, err := ParseBoundaries(zr)
+	if err != nil {
+		panic(fmt.Sprintf("embedded boundaries: %v", err))
+	}
+	return b
+})
+
+// SetBoundaries makes Lookup use b before the nearest reference city; nil
+// goes back to the embedded polygons.
+func SetBoundaries(b *Boundaries) {
+	loaded.Store(b)
+}
+
+func boundaries() *Boundaries {
+	if b := loaded.Load(); b != nil {
+		return b
+	}
+	return embedded()
+}
+
+// LoadBoundaries reads a timezone-boundary-builder GeoJSON file, or the
+// release's .zip holding one.
+func LoadBoundaries(path string) (*Boundaries, error) {
+	if strings.EqualFold(filepath.Ext(path), ".zip") {
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			if ext := filepath.Ext(f.Name); ext == ".json" || ext == ".geojson" {
+				r, err := f.Open()
+				if err != nil {
+					return nil, err
+				}
+				defer r.Close()
+				return ParseBoundaries(r)
+			}
+		}
+		return nil, fmt.Errorf("%s: no GeoJSON file in archive", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseBoundaries(f)
+}
+
+// ParseBoundaries reads GeoJSON time zone polygons.
+func ParseBoundaries(r io.Reader) (*Boundaries, error) {
+	var fc struct {
+		Features []struct {
+			Properties struct {
+				TZID string `json:"tzid"`
+			} `json:"properties"`
+			Geometry struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.NewDecoder(r).Decode(&fc); err != nil {
+		return nil, err
+	}
+	b := &Boundaries{}
+	for _, f := range fc.Features {
+		var polygons [][][][2]float64
+		switch f.Geometry.Type {
+		case "Polygon":
+			var p [][][2]float64
+			if err := json.Unmarshal(f.Geometry.Coordinates, &p); err != nil {
+				return nil, fmt.Errorf("%s: %w", f.Properties.TZID, err)
+			}
+			polygons = [][][][2]float64{p}
+		case "MultiPolygon":
+			if err := json.Unmarshal(f.Geometry.Coordinates, &polygons); err != nil {
+				return nil, fmt.Errorf("%s: %w", f.Properties.TZID, err)
+			}
+		default:
+			continue
+		}
+		if f.Properties.TZID == "" {
+			return nil, errors.New("feature without tzid")
+		}
+		b.zones = append(b.zones, newBoundary(f.Properties.TZID, polygons))
+	}
+	if len(b.zones) == 0 {
+		return nil, errors.New("no time zone polygons")
+	}
+	return b, nil
+}
+
+func newBoundary(name string, polygons [][][][2]float64) boundary {
+	z := boundary{name: name, minLat: 90, minLon: 180, maxLat: -90, maxLon: -180}
+	for _, p := range polygons {
+		var rings []ring
+		for _, coords := range p {
+			rg := make(ring, len(coords))
+			for i, c := range coords {
+				lon, lat := float32(c[0]), float32(c[1])
+				rg[i] = [2]float32{lon, lat}
+				z.minLon, z.maxLon = min(z.minLon, lon), max(z.maxLon, lon)
+				z.minLat, z.maxLat = min(z.minLat, lat), max(z.maxLat, lat)
+			}
+			rings = append(rings, rg)
+		}
+		z.polygons = append(z.polygons, rings)
+	}
+	return z
+}
+
+// Zone returns the name of the zone whose polygon contains lat, lon.
+func (b *Boundaries) Zone(lat, lon float64) (string, bool) {
+	y, x := float32(lat), float32(lon)
+	for i := range b.zones {
+		z := &b.zones[i]
+		if y < z.minLat || y > z.maxLat || x < z.minLon || x > z.maxLon {
+			continue
+		}
+		for _, p := range z.polygons {
+			if len(p) == 0 || !p[0].contains(x, y) {
+				continue
+			}
+			inHole := false
+			for _, hole := range p[1:] {
+				if hole.contains(x, y) {
+					inHole = true
+					break
+				}
+			}
+			if !inHole {
+				return z.name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// contains is the even-odd rule: a ray from the point crosses the ring an
+// odd number of times when the point is inside.
+func (rg ring) contains(x, y float32) bool {
+	in := false
+	for i, j := 0, len(rg)-1; i < len(rg); j, i = i, i+1 {
+		xi, yi, xj, yj := rg[i][0], rg[i][1], rg[j][0], rg[j][1]
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			in = !in
+		}
+	}
+	return in
+}
@@ -0,0 +1,135 @@
+// Package tz finds the time zone at a coordinate without network access.
+//
+// A coordinate gets the zone whose polygon holds it: from the full
+// timezone-boundary-builder set when one is loaded (see LoadBoundaries),
+// else from the coarse polygons embedded in boundaries.geojson.gz. Those
+// are Natural Earth's 1:110m country borders (public domain), each country
+// split between its zones in zone.tab by nearest reference location. They
+// tell countries apart except within 10-20km of a border; between the zones
+// of one country (US, Russia, Brazil...) they are no better than the
+// nearest reference. Rebuild them with cmd/gen-tz, preferably from a
+// timezone-boundary-builder release.
+//
+// Outside every polygon (the sea, small islands) Lookup falls back to the
+// embedded table: zone.tab from the tz database (2025b, public domain), a
+// reference location, usually the principal city, for each zone of each
+// country. zone.tab rather than zone1970.tab because the latter merges
+// zones across countries (Reykjavik into Abidjan), which would leave whole
+// countries without a nearby point. A coordinate gets the zone of the
+// nearest reference, then the nautical zone far out at sea. Regenerate with
+//
+//	cp /usr/share/zoneinfo/zone.tab internal/tz/
+package tz
+
+import (
+	_ "embed"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // LoadLocation works in containers without /usr/share/zoneinfo
+)
+
+//go:embed zone.tab
+var zoneTab string
+
+// seaDistance is how far from every reference location, in km, a point is
+// taken to be at sea and given the nautical zone for its longitude.
+const seaDistance = 1000
+
+// Reference is a zone's reference location from zone.tab.
+type Reference struct {
+	Country  string // ISO 3166 alpha-2
+	Zone     string
+	Lat, Lon float64
+}
+
+// References returns every zone's reference location.
+func References() []Reference {
+	return zones()
+}
+
+var zones = sync.OnceValue(func() []Reference {
+	var out []Reference
+	for _, line := range strings.Split(zoneTab, "\n") {
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		f := strings.Split(line, "\t")
+		if len(f) < 3 {
+			continue
+		}
+		lat, lon, ok := parseISO6709(f[1])
+		if !ok {
+			continue
+		}
+		out = append(out, Reference{f[0], f[2], lat, lon})
+	}
+	return out
+})
+
+// Lookup returns the time zone at lat, lon (degrees).
+func Lookup(lat, lon float64) *time.Location {
+	if name, ok := boundaries().Zone(lat, lon); ok {
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc
+		}
+	}
+	best, bestD := "", math.Inf(1)
+	for _, z := range zones() {
+		if d := distance(lat, lon, z.Lat, z.Lon); d < bestD {
+			best, bestD = z.Zone, d
+		}
+	}
+	if bestD <= seaDistance {
+		if loc, err := time.LoadLocation(best); err == nil {
+			return loc
+		}
+	}
+	h := int(math.Round(lon / 15))
+	return time.FixedZone(fmt.Sprintf("UTC%+d", h), h*3600)
+}
+
+// parseISO6709 reads "+DDMM+DDDMM" or "+DDMMSS+DDDMMSS".
+func parseISO6709(s string) (lat, lon float64, ok bool) {
+	i := strings.LastIndexAny(s, "+-")
+	if i <= 0 {
+		return 0, 0, false
+	}
+	lat, ok1 := parseDMS(s[:i], 2)
+	lon, ok2 := parseDMS(s[i:], 3)
+	return lat, lon, ok1 && ok2
+}
+
+func parseDMS(s string, degDigits int) (float64, bool) {
+	if len(s) != 1+degDigits+2 && len(s) != 1+degDigits+4 {
+		return 0, false
+	}
+	var parts []float64
+	for _, p := range []string{s[1 : 1+degDigits], s[1+degDigits : 3+degDigits], s[3+degDigits:]} {
+		if p == "" {
+			p = "0"
+		}
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return 0, false
+		}
+		parts = append(parts, float64(n))
+	}
+	v := parts[0] + parts[1]/60 + parts[2]/3600
+	if s[0] == '-' {
+		v = -v
+	}
+	return v, true
+}
+
+// distance is the great-circle distance in km.
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	const r = 6371
+	rad := math.Pi / 180
+	dLat, dLon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * r * math.Asin(math.Min(1, math.Sqrt(a)))
+}
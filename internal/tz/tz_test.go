@@ -0,0 +1,136 @@
+package tz
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testdata/borders.geojson holds a few borders, simplified to boxes, in the
+// format timezone-boundary-builder publishes: Portugal and Spain split at
+// the Caia river, Büsingen as a hole in Switzerland, and the Navajo Nation
+// (which observes DST) as a hole in Arizona (which doesn't).
+func useTestBoundaries(t *testing.T, path string) {
+	t.Helper()
+	b, err := LoadBoundaries(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetBoundaries(b)
+	t.Cleanup(func() { SetBoundaries(nil) })
+}
+
+var borderTowns = []struct {
+	name     string
+	lat, lon float64
+	zone     string
+	// nearest is what the reference cities alone give, "" when it's the same
+	nearest string
+}{
+	{"Elvas", 38.881, -7.163, "Europe/Lisbon", ""},
+	{"Badajoz, 18km east of Elvas", 38.878, -6.970, "Europe/Madrid", "Europe/Lisbon"},
+	{"Schaffhausen", 47.697, 8.634, "Europe/Zurich", "Europe/Busingen"},
+	{"Büsingen am Hochrhein", 47.697, 8.690, "Europe/Busingen", ""},
+	{"Flagstaff", 35.198, -111.651, "America/Phoenix", ""},
+	{"Window Rock, Navajo Nation", 35.681, -109.053, "America/Denver", "America/Phoenix"},
+	{"Tuba City, Navajo Nation", 36.135, -110.0, "America/Denver", "America/Phoenix"},
+	{"Farmington, 90km from Window Rock", 36.728, -108.218, "America/Denver", ""},
+}
+
+func TestLookupBoundaries(t *testing.T) {
+	useTestBoundaries(t, filepath.Join("testdata", "borders.geojson"))
+	for _, tt := range borderTowns {
+		if got := Lookup(tt.lat, tt.lon).String(); got != tt.zone {
+			t.Errorf("%s: %s, want %s", tt.name, got, tt.zone)
+		}
+	}
+}
+
+func TestLookupNearestReference(t *testing.T) {
+	SetBoundaries(&Boundaries{}) // no polygons
+	t.Cleanup(func() { SetBoundaries(nil) })
+	for _, tt := range borderTowns {
+		want := tt.zone
+		if tt.nearest != "" {
+			want = tt.nearest
+		}
+		if got := Lookup(tt.lat, tt.lon).String(); got != want {
+			t.Errorf("%s: %s, want %s", tt.name, got, want)
+		}
+	}
+}
+
+// The embedded polygons get national borders right where the nearest
+// reference city is across one, with a different offset.
+func TestLookupEmbedded(t *testing.T) {
+	tests := []struct {
+		name     string
+		lat, lon float64
+		zone     string
+	}{
+		{"Elvas", 38.881, -7.163, "Europe/Lisbon"},
+		{"Badajoz, nearest Lisbon", 38.878, -6.970, "Europe/Madrid"},
+		{"Mérida, nearest Lisbon", 38.916, -6.344, "Europe/Madrid"},
+		{"Grodno, nearest Vilnius", 53.678, 23.830, "Europe/Minsk"},
+		{"Yanji, nearest Vladivostok", 42.891, 129.508, "Asia/Shanghai"},
+		{"Flagstaff", 35.198, -111.651, "America/Phoenix"},
+		{"Ponta Delgada, off the coarse map", 37.740, -25.668, "Atlantic/Azores"},
+		{"mid-Atlantic", 30.0, -45.0, "UTC-3"},
+	}
+	for _, tt := range tests {
+		if got := Lookup(tt.lat, tt.lon).String(); got != tt.zone {
+			t.Errorf("%s: %s, want %s", tt.name, got, tt.zone)
+		}
+	}
+}
+
+// Points no polygon covers (the sea, without the "with oceans" data set)
+// fall back to the reference cities, then to the nautical zone.
+func TestLookupOutsideBoundaries(t *testing.T) {
+	useTestBoundaries(t, filepath.Join("testdata", "borders.geojson"))
+	tests := []struct {
+		name     string
+		lat, lon float64
+		zone     string
+	}{
+		{"Ponta Delgada, Azores", 37.740, -25.668, "Atlantic/Azores"},
+		{"mid-Atlantic", 30.0, -45.0, "UTC-3"},
+	}
+	for _, tt := range tests {
+		if got := Lookup(tt.lat, tt.lon).String(); got != tt.zone {
+			t.Errorf("%s: %s, want %s", tt.name, got, tt.zone)
+		}
+	}
+}
+
+func TestLoadBoundariesZip(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "borders.geojson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "timezones.geojson.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	w, err := zw.Create("combined.json")
+	if err == nil {
+		_, err = w.Write(data)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	useTestBoundaries(t, path)
+	if got := Lookup(38.878, -6.970).String(); got != "Europe/Madrid" {
+		t.Errorf("Badajoz: %s, want Europe/Madrid", got)
+	}
+}